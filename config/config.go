@@ -1,9 +1,8 @@
 package config
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"log"
+	"log/slog"
+	"sync"
 )
 
 type GlobalConfig struct {
@@ -14,65 +13,181 @@ type GlobalConfig struct {
 type ConnectionsConfig struct {
 	KafkaServer    KafkaConsumer  `json:"KafkaConsumer"`
 	Client         Client         `json:"Client"`
-	Mongo          Mongo          `json:"Mongo"`
+	Storage        Storage        `json:"Storage"`
 	EventProcessor EventProcessor `json:"EventProcessor"`
+	Admin          Admin          `json:"Admin"`
+	Logging        Logging        `json:"Logging"`
+	Tracing        Tracing        `json:"Tracing"`
+	Authorization  Authorization  `json:"Authorization"`
+	Presence       Presence       `json:"Presence"`
 }
 
 type KafkaConsumer struct {
-	ServerUrls            []string `json:"server_urls"`
-	CGroup                string   `json:"c_group"`
-	ConnectionPullSize    int      `json:"connection_pull_size"`
-	Topics                []string `json:"topics"`
+	ServerUrls         []string `json:"server_urls"`
+	CGroup             string   `json:"c_group"`
+	ConnectionPullSize int      `json:"connection_pull_size"`
+	Topics             []string `json:"topics"`
+	BrokerUrls         []string `json:"broker_urls"` //Kafka brokers polled for the consumer lag, lag is not measured when empty
+	Version            string   `json:"version"`     //Kafka version of the brokers, records carry their headers and timestamps from 0.11.0.0
 }
 
 type EventProcessor struct {
 	Url string `json:"url"`
 }
 
+// Client configures the client listener, its connections and the limits they are held to
 type Client struct {
-	ListenPort            string `json:"listen_port"`
-	MaxConnectionPoolSize int    `json:"max_connection_pool_size"`
-	MaxBuffSize           int    `json:"max_buff_size"`
+	ListenPort            string        `json:"listen_port"`
+	MaxConnectionPoolSize int           `json:"max_connection_pool_size"` //open connections of the replica, further ones are refused
+	MaxBuffSize           int           `json:"max_buff_size"`            //client messages larger than that many bytes close the connection
+	OutboundQueueSize     int           `json:"outbound_queue_size"`      //messages queued for each connection
+	OverflowPolicy        string        `json:"overflow_policy"`          //what happens to a message when the queue is full, one of the Overflow policies
+	MaxConnectionsPerIP   int           `json:"max_connections_per_ip"`   //0 means no cap
+	MaxConnectionsPerUser int           `json:"max_connections_per_user"` //0 means no cap
+	ConnectRate           float64       `json:"connect_rate"`             //new connections per second, no limit when 0
+	ConnectBurst          int           `json:"connect_burst"`
+	AllowedOrigins        []string      `json:"allowed_origins"` //origins browsers may connect from: "https://app.partyfy.com", "https://*.partyfy.com" or "*", the host itself when empty
+	TLS                   ClientTLS     `json:"tls"`             //the listener serves TLS when TLS.CertFile is set
+	Inbound               InboundLimits `json:"inbound"`
+	Signals               Signals       `json:"signals"`
+	Compression           Compression   `json:"compression"`
 }
 
-type Mongo struct {
-	Uri         string   `json:"uri"`
-	Database    string   `json:"database"`
+// Signals throttles the ephemeral signals of the clients apart from their messages: Rate per second for each user
+// with bursts of Burst, a rate of 0 disables the limit. A signal is worthless TTLSeconds after it was sent, it is
+// not delivered later and the receivers forget it unless it is sent again
+type Signals struct {
+	Rate       float64 `json:"rate"`
+	Burst      int     `json:"burst"`
+	TTLSeconds int     `json:"ttl_seconds"`
 }
 
-func GetConfig() GlobalConfig {
-	return *globalConfig
+// Compression configures permessage-deflate on client sockets. It is used when the client offers it too,
+// Level goes from 1 (fastest) to 9 (smallest frames)
+type Compression struct {
+	Enabled bool `json:"enabled"`
+	Level   int  `json:"level"`
 }
 
-var globalConfig *GlobalConfig
+// InboundLimits throttles the messages clients send. Rate and Burst apply to each user, EventRate and EventBurst
+// to each event for all its senders together; a rate of 0 disables the limit. A user throttled MuteAfter times
+// within a minute is muted for MuteSeconds, doubled for every further mute within an hour up to MaxMuteSeconds
+type InboundLimits struct {
+	Rate           float64 `json:"rate"`
+	Burst          int     `json:"burst"`
+	EventRate      float64 `json:"event_rate"`
+	EventBurst     int     `json:"event_burst"`
+	MuteAfter      int     `json:"mute_after"`
+	MuteSeconds    int     `json:"mute_seconds"`
+	MaxMuteSeconds int     `json:"max_mute_seconds"`
+}
 
-func init() {
+// ClientTLS configures TLS on the client listener. The certificate, key and client CA files are loaded again
+// when they change. ClientAuth is "none", "optional" (certificates are verified against ClientCAFile when
+// the client presents one) or "require" (mutual TLS for every client)
+type ClientTLS struct {
+	CertFile     string `json:"cert_file"`
+	KeyFile      string `json:"key_file"`
+	ClientCAFile string `json:"client_ca_file"`
+	ClientAuth   string `json:"client_auth"`
+}
 
-	log.Println("Creating configuration...")
+// Enabled tells whether the listener serves TLS
+func (clientTLS ClientTLS) Enabled() bool {
+	return clientTLS.CertFile != ""
+}
 
-	log.Println("Reading config.json file...")
-	fileRaw, err := ioutil.ReadFile("./resources/config.json")
+// Overflow policies of the outbound queues, see Client.OverflowPolicy
+const (
+	OverflowSpill      = "spill"       //stores the message as unsent
+	OverflowDropOldest = "drop_oldest" //drops the oldest queued ephemeral message to make room, disconnects when none is queued
+	OverflowDisconnect = "disconnect"  //stores the message and closes the slow client
+)
 
-	if err != nil {
-		log.Fatal("Can not read from config.json file", err)
-	} else {
-		log.Println("Reading successful")
-	}
+// Admin configures the admin API, served on ListenPort. Requests must carry Token, the API refuses every request when it is empty
+type Admin struct {
+	Token      string `json:"token"`
+	ListenPort string `json:"listen_port"`
+}
 
-	log.Println("Validating config.json file...")
-	isValid := json.Valid(fileRaw)
-	if !isValid {
-		log.Fatal("Invalid config.json file format. JSON structure expected expected")
-	} else {
-		log.Println("Validating successful")
-	}
+// Storage selects the message store. Driver is one of "mongo", "postgres", "sqlite" or "memory".
+// Uri is the Mongo connection string, the PostgreSQL DSN or the SQLite file path; Database is used by Mongo only
+type Storage struct {
+	Driver     string     `json:"driver"`
+	Uri        string     `json:"uri"`
+	Database   string     `json:"database"`
+	Encryption Encryption `json:"encryption"`
+}
+
+// Encryption enables envelope encryption of message bodies. Master keys are read from KeyFile or,
+// when it is empty, from the KeyEnv environment variable; new documents are encrypted with ActiveKeyID
+type Encryption struct {
+	Enabled     bool   `json:"enabled"`
+	KeyFile     string `json:"key_file"`
+	KeyEnv      string `json:"key_env"`
+	ActiveKeyID string `json:"active_key_id"`
+}
 
-	log.Println("Decoding config.json file... ")
-	err = json.Unmarshal(fileRaw, &globalConfig)
+// Logging configures the log output. Level is one of "debug", "info", "warn" or "error", Format is "json" or "logfmt".
+// Secrets are always redacted; message bodies are too unless LogBodies is set. Every field is applied on reload
+type Logging struct {
+	Level     string `json:"level"`
+	Format    string `json:"format"`
+	LogBodies bool   `json:"log_bodies"`
+}
+
+// Tracing configures OpenTelemetry spans. Exporter is "none", "otlp" (OTLP over HTTP to Endpoint, the
+// OTEL_EXPORTER_OTLP_* variables apply when it is empty), "stdout" or "file" (JSON lines appended to File).
+// Trace IDs are stored with the messages whatever the exporter; SampleRatio applies to traces started here
+type Tracing struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	File        string  `json:"file"`
+	SampleRatio float64 `json:"sample_ratio"`
+}
+
+// Authorization checks the senders of client messages with the Main Event Processor. Event messages need
+// the sender to be a member of the event. Direct messages need a relation between the users that neither blocked
+// when DirectMessages is "relation", "any" lets them through. Answers are cached for CacheSeconds
+type Authorization struct {
+	DirectMessages string `json:"direct_messages"`
+	CacheSeconds   int    `json:"cache_seconds"`
+}
+
+// Presence tracks who is online through the store, for every replica. A user goes offline OfflineGraceSeconds
+// after the last connection closed, so that reconnects and long polls do not flap. Replicas refresh the last seen
+// time of their users every HeartbeatSeconds, a user not refreshed for three heartbeats is offline. Changes made
+// on other replicas are looked for every SyncSeconds
+type Presence struct {
+	HeartbeatSeconds    int `json:"heartbeat_seconds"`
+	OfflineGraceSeconds int `json:"offline_grace_seconds"`
+	SyncSeconds         int `json:"sync_seconds"`
+}
+
+// Holder keeps the configuration the process runs with and hands it to the components
+type Holder struct {
+	mutex     sync.RWMutex
+	reloading sync.Mutex //held by a reload from loading to notifying, so that reloads apply in order
+	path      string
+	current   GlobalConfig
+	listeners []Listener
+}
+
+// NewHolder loads the configuration from path, see Load for the sources it is built from
+func NewHolder(path string) (*Holder, error) {
+	slog.Info("Creating configuration...")
+	loaded, err := Load(path)
 	if err != nil {
-		log.Fatal("Decoding failed ", err)
-	} else {
-		log.Println("Decoding successful")
+		return nil, err
 	}
+	slog.Info("Configuration created")
+	return &Holder{path: path, current: *loaded}, nil
+}
 
+// Get returns the current configuration. It changes when the configuration is reloaded
+func (holder *Holder) Get() GlobalConfig {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	return holder.current
 }
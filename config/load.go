@@ -0,0 +1,460 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/Shopify/sarama"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// PathEnv holds the configuration file path when the -config flag is not given
+	PathEnv = "PARTYFY_CONFIG"
+	// EnvPrefix starts the name of every override variable, e.g. PARTYFY_CONNECTIONSCONFIG_CLIENT_LISTEN_PORT
+	EnvPrefix   = "PARTYFY"
+	defaultPath = "./resources/config.json"
+	redacted    = "[redacted]"
+)
+
+// ValidationError lists every problem found in a configuration
+type ValidationError []string
+
+func (problems ValidationError) Error() string {
+	return strings.Join(problems, "; ")
+}
+
+// Defaults returns the configuration used for every field the file and the environment leave unset
+func Defaults() GlobalConfig {
+	return GlobalConfig{
+		ConnectionsConfig: ConnectionsConfig{
+			KafkaServer: KafkaConsumer{
+				ServerUrls: []string{"localhost:2181"},
+				CGroup:     "partyfy-message-service",
+				Version:    "0.11.0.0",
+				Topics: []string{
+					"event-updated",
+					"event-deleted",
+					"event-created",
+					"event-user-removed",
+					"event-user-added",
+					"image-added",
+					"image-user-attached",
+					"user-relation-created",
+				},
+			},
+			Client: Client{
+				ListenPort:            ":8083",
+				MaxConnectionPoolSize: 1200,
+				MaxBuffSize:           1024,
+				OutboundQueueSize:     64,
+				OverflowPolicy:        OverflowSpill,
+				MaxConnectionsPerUser: 4,
+				ConnectRate:           200,
+				ConnectBurst:          400,
+				AllowedOrigins:        []string{"*"},
+				TLS: ClientTLS{
+					ClientAuth: "none",
+				},
+				Inbound: InboundLimits{
+					Rate:           5,
+					Burst:          20,
+					EventRate:      20,
+					EventBurst:     50,
+					MuteAfter:      20,
+					MuteSeconds:    30,
+					MaxMuteSeconds: 3600,
+				},
+				Signals: Signals{
+					Rate:       2,
+					Burst:      10,
+					TTLSeconds: 6,
+				},
+				Compression: Compression{
+					Level: 1,
+				},
+			},
+			Storage: Storage{
+				Driver:   "mongo",
+				Uri:      "mongodb://localhost:27017",
+				Database: "partyfy",
+			},
+			EventProcessor: EventProcessor{
+				Url: "http://localhost:9000",
+			},
+			Admin: Admin{
+				ListenPort: ":8084",
+			},
+			Logging: Logging{
+				Level:  "info",
+				Format: "json",
+			},
+			Tracing: Tracing{
+				Exporter:    "none",
+				SampleRatio: 1,
+			},
+			Authorization: Authorization{
+				DirectMessages: "relation",
+				CacheSeconds:   60,
+			},
+			Presence: Presence{
+				HeartbeatSeconds:    30,
+				OfflineGraceSeconds: 10,
+				SyncSeconds:         2,
+			},
+		},
+	}
+}
+
+// Load builds the configuration in layers: defaults, then the file, then environment overrides.
+// The file path comes from the argument or PathEnv; ./resources/config.json is read when it exists and none is set
+func Load(path string) (*GlobalConfig, error) {
+
+	loaded := Defaults()
+
+	if path == "" {
+		path = os.Getenv(PathEnv)
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultPath); err == nil {
+			path = defaultPath
+		}
+	}
+	if path != "" {
+		slog.Info("Reading configuration file...", "path", path)
+		if err := readFile(path, &loaded); err != nil {
+			return nil, err
+		}
+	}
+
+	var problems ValidationError
+	if err := applyEnv(reflect.ValueOf(&loaded).Elem(), EnvPrefix); err != nil {
+		problems = append(problems, err.(ValidationError)...)
+	}
+	if err := loaded.Validate(); err != nil {
+		problems = append(problems, err.(ValidationError)...)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return &loaded, nil
+}
+
+// readFile decodes the file over the defaults. YAML and TOML documents are converted to JSON first
+// so that the json tags are the only field names to maintain
+func readFile(path string, target *GlobalConfig) error {
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("can not read configuration file: %v", err)
+	}
+
+	var document interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		if !json.Valid(raw) {
+			return fmt.Errorf("invalid %s file format, JSON structure expected", path)
+		}
+	case ".yaml", ".yml":
+		if err = yaml.Unmarshal(raw, &document); err != nil {
+			return fmt.Errorf("invalid YAML in %s: %v", path, err)
+		}
+		if raw, err = json.Marshal(stringKeys(document)); err != nil {
+			return err
+		}
+	case ".toml":
+		var table map[string]interface{}
+		if _, err = toml.Decode(string(raw), &table); err != nil {
+			return fmt.Errorf("invalid TOML in %s: %v", path, err)
+		}
+		if raw, err = json.Marshal(table); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported configuration file format %q, expected .json, .yaml, .yml or .toml", filepath.Ext(path))
+	}
+
+	if err = json.Unmarshal(raw, target); err != nil {
+		return fmt.Errorf("decoding %s failed: %v", path, err)
+	}
+	return nil
+}
+
+// stringKeys turns the map[interface{}]interface{} produced by the YAML decoder into maps JSON can encode
+func stringKeys(value interface{}) interface{} {
+	switch typed := value.(type) {
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			converted[fmt.Sprint(key)] = stringKeys(item)
+		}
+		return converted
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = stringKeys(item)
+		}
+	}
+	return value
+}
+
+// applyEnv overrides every field from PREFIX_<JSON TAG PATH> variables. Lists are comma separated
+func applyEnv(value reflect.Value, prefix string) error {
+
+	var problems ValidationError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := prefix + "_" + envName(value.Type().Field(i))
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnv(field, name); err != nil {
+				problems = append(problems, err.(ValidationError)...)
+			}
+			continue
+		}
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+		var err error
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(raw)
+		case reflect.Int:
+			var parsed int64
+			parsed, err = strconv.ParseInt(raw, 10, 0)
+			field.SetInt(parsed)
+		case reflect.Float64:
+			var parsed float64
+			parsed, err = strconv.ParseFloat(raw, 64)
+			field.SetFloat(parsed)
+		case reflect.Bool:
+			var parsed bool
+			parsed, err = strconv.ParseBool(raw)
+			field.SetBool(parsed)
+		case reflect.Slice:
+			var items []string
+			for _, item := range strings.Split(raw, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					items = append(items, item)
+				}
+			}
+			field.Set(reflect.ValueOf(items))
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+func envName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// Validate reports every problem of the configuration at once
+func (globalConfig GlobalConfig) Validate() error {
+
+	var problems ValidationError
+	connections := globalConfig.ConnectionsConfig
+
+	if len(connections.KafkaServer.ServerUrls) == 0 {
+		problems = append(problems, "KafkaConsumer.server_urls must not be empty")
+	}
+	if connections.KafkaServer.CGroup == "" {
+		problems = append(problems, "KafkaConsumer.c_group must not be empty")
+	}
+	if len(connections.KafkaServer.Topics) == 0 {
+		problems = append(problems, "KafkaConsumer.topics must not be empty")
+	}
+	if version, err := sarama.ParseKafkaVersion(connections.KafkaServer.Version); err != nil || !version.IsAtLeast(sarama.V0_11_0_0) {
+		problems = append(problems, "KafkaConsumer.version must be a Kafka version from 0.11.0.0 on, such as 2.0.0")
+	}
+
+	if connections.Client.ListenPort == "" {
+		problems = append(problems, "Client.listen_port must not be empty")
+	}
+	if connections.Admin.ListenPort == "" {
+		problems = append(problems, "Admin.listen_port must not be empty")
+	} else if connections.Admin.ListenPort == connections.Client.ListenPort {
+		problems = append(problems, "Admin.listen_port must differ from Client.listen_port")
+	}
+	if connections.Client.MaxConnectionPoolSize <= 0 {
+		problems = append(problems, "Client.max_connection_pool_size must be positive")
+	}
+	if connections.Client.MaxBuffSize <= 0 {
+		problems = append(problems, "Client.max_buff_size must be positive")
+	}
+	if connections.Client.OutboundQueueSize <= 0 {
+		problems = append(problems, "Client.outbound_queue_size must be positive")
+	}
+	switch connections.Client.OverflowPolicy {
+	case OverflowSpill, OverflowDropOldest, OverflowDisconnect:
+	default:
+		problems = append(problems, "Client.overflow_policy must be one of spill, drop_oldest or disconnect")
+	}
+	if connections.Client.MaxConnectionsPerIP < 0 {
+		problems = append(problems, "Client.max_connections_per_ip must not be negative")
+	}
+	if connections.Client.MaxConnectionsPerUser < 0 {
+		problems = append(problems, "Client.max_connections_per_user must not be negative")
+	}
+	if connections.Client.ConnectRate < 0 {
+		problems = append(problems, "Client.connect_rate must not be negative")
+	} else if connections.Client.ConnectRate > 0 && connections.Client.ConnectBurst < 1 {
+		problems = append(problems, "Client.connect_burst must be positive when connect_rate is set")
+	}
+	for _, origin := range connections.Client.AllowedOrigins {
+		if origin != "*" && !strings.Contains(origin, "://") {
+			problems = append(problems, "Client.allowed_origins entries must be * or scheme://host[:port], got "+origin)
+		}
+	}
+	inbound := connections.Client.Inbound
+	if inbound.Rate < 0 || inbound.EventRate < 0 {
+		problems = append(problems, "Client.inbound rates must not be negative")
+	}
+	if inbound.Rate > 0 && inbound.Burst < 1 {
+		problems = append(problems, "Client.inbound.burst must be positive when rate is set")
+	}
+	if inbound.EventRate > 0 && inbound.EventBurst < 1 {
+		problems = append(problems, "Client.inbound.event_burst must be positive when event_rate is set")
+	}
+	if inbound.MuteAfter < 0 {
+		problems = append(problems, "Client.inbound.mute_after must not be negative")
+	} else if inbound.MuteAfter > 0 && (inbound.MuteSeconds <= 0 || inbound.MaxMuteSeconds < inbound.MuteSeconds) {
+		problems = append(problems, "Client.inbound needs mute_seconds > 0 and max_mute_seconds >= mute_seconds when mute_after is set")
+	}
+	signals := connections.Client.Signals
+	if signals.Rate < 0 {
+		problems = append(problems, "Client.signals.rate must not be negative")
+	}
+	if signals.Rate > 0 && signals.Burst < 1 {
+		problems = append(problems, "Client.signals.burst must be positive when rate is set")
+	}
+	if signals.TTLSeconds < 1 || signals.TTLSeconds > 60 {
+		problems = append(problems, "Client.signals.ttl_seconds must be between 1 and 60")
+	}
+	if compression := connections.Client.Compression; compression.Level < 1 || compression.Level > 9 {
+		problems = append(problems, "Client.compression.level must be between 1 and 9")
+	}
+	clientTLS := connections.Client.TLS
+	if (clientTLS.CertFile == "") != (clientTLS.KeyFile == "") {
+		problems = append(problems, "Client.tls needs both cert_file and key_file")
+	}
+	switch clientTLS.ClientAuth {
+	case "none":
+	case "optional", "require":
+		if !clientTLS.Enabled() || clientTLS.ClientCAFile == "" {
+			problems = append(problems, "Client.tls.client_auth needs cert_file, key_file and client_ca_file")
+		}
+	default:
+		problems = append(problems, "Client.tls.client_auth must be one of none, optional or require")
+	}
+
+	switch connections.Storage.Driver {
+	case "mongo":
+		if connections.Storage.Database == "" {
+			problems = append(problems, "Storage.database must not be empty for the mongo driver")
+		}
+		fallthrough
+	case "postgres", "sqlite":
+		if connections.Storage.Uri == "" {
+			problems = append(problems, "Storage.uri must not be empty for the "+connections.Storage.Driver+" driver")
+		}
+	case "memory":
+	default:
+		problems = append(problems, "Storage.driver must be one of mongo, postgres, sqlite or memory")
+	}
+	encryption := connections.Storage.Encryption
+	if encryption.Enabled && encryption.KeyFile == "" && encryption.KeyEnv == "" {
+		problems = append(problems, "Storage.encryption needs key_file or key_env when enabled")
+	}
+
+	if parsed, err := url.Parse(connections.EventProcessor.Url); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		problems = append(problems, "EventProcessor.url must be an absolute URL")
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(connections.Logging.Level)); err != nil {
+		problems = append(problems, "Logging.level must be one of debug, info, warn or error")
+	}
+	if connections.Logging.Format != "json" && connections.Logging.Format != "logfmt" {
+		problems = append(problems, "Logging.format must be json or logfmt")
+	}
+
+	switch connections.Tracing.Exporter {
+	case "none", "otlp", "stdout":
+	case "file":
+		if connections.Tracing.File == "" {
+			problems = append(problems, "Tracing.file must not be empty for the file exporter")
+		}
+	default:
+		problems = append(problems, "Tracing.exporter must be one of none, otlp, stdout or file")
+	}
+	if connections.Tracing.SampleRatio < 0 || connections.Tracing.SampleRatio > 1 {
+		problems = append(problems, "Tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if connections.Authorization.DirectMessages != "relation" && connections.Authorization.DirectMessages != "any" {
+		problems = append(problems, "Authorization.direct_messages must be relation or any")
+	}
+	if connections.Authorization.CacheSeconds < 0 {
+		problems = append(problems, "Authorization.cache_seconds must not be negative")
+	}
+	presence := connections.Presence
+	if presence.HeartbeatSeconds <= 0 || presence.SyncSeconds <= 0 {
+		problems = append(problems, "Presence.heartbeat_seconds and Presence.sync_seconds must be positive")
+	}
+	if presence.OfflineGraceSeconds < 0 {
+		problems = append(problems, "Presence.offline_grace_seconds must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// Redacted returns a copy that is safe to print: tokens are hidden and passwords are removed from URIs
+func (globalConfig GlobalConfig) Redacted() GlobalConfig {
+	copied := globalConfig
+	if copied.ConnectionsConfig.Admin.Token != "" {
+		copied.ConnectionsConfig.Admin.Token = redacted
+	}
+	copied.ConnectionsConfig.Storage.Uri = RedactURI(copied.ConnectionsConfig.Storage.Uri)
+	copied.ConnectionsConfig.EventProcessor.Url = RedactURI(copied.ConnectionsConfig.EventProcessor.Url)
+	return copied
+}
+
+var dsnPassword = regexp.MustCompile(`(password=)(\S+)`)
+
+// RedactURI hides the password of a URI or of a PostgreSQL key=value connection string
+func RedactURI(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err != nil || parsed.User == nil {
+		// PostgreSQL key=value connection strings
+		return dsnPassword.ReplaceAllString(raw, "${1}"+redacted)
+	}
+	if password, hasPassword := parsed.User.Password(); hasPassword {
+		return strings.Replace(raw, ":"+password+"@", ":"+redacted+"@", 1)
+	}
+	return raw
+}
@@ -0,0 +1,83 @@
+package config
+
+import (
+	"log/slog"
+	"reflect"
+	"strings"
+)
+
+// Listener is notified after a reload with the configuration before and after it
+type Listener func(previous GlobalConfig, current GlobalConfig)
+
+// RestartRequiredError lists the changed settings that can not be applied to a running process
+type RestartRequiredError []string
+
+func (fields RestartRequiredError) Error() string {
+	return "restart required to change " + strings.Join(fields, ", ") + "; configuration was not reloaded"
+}
+
+// Subscribe registers a listener called on every successful reload
+func (holder *Holder) Subscribe(listener Listener) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	holder.listeners = append(holder.listeners, listener)
+}
+
+// Reload reads the configuration again from the same sources as at start up. Nothing is applied when
+// the new configuration is invalid or changes a setting that needs a restart. Concurrent reloads run one after the
+// other, the listeners of one are all notified before the next loads
+func (holder *Holder) Reload() error {
+	holder.reloading.Lock()
+	defer holder.reloading.Unlock()
+
+	slog.Info("Reloading configuration...")
+	reloaded, err := Load(holder.path)
+	if err != nil {
+		slog.Error("Configuration was not reloaded", "error", err)
+		return err
+	}
+
+	holder.mutex.Lock()
+	previous := holder.current
+	if err = checkLiveChanges(previous, *reloaded); err != nil {
+		holder.mutex.Unlock()
+		slog.Error("Configuration was not reloaded", "error", err)
+		return err
+	}
+	holder.current = *reloaded
+	notify := append([]Listener(nil), holder.listeners...)
+	holder.mutex.Unlock()
+
+	for _, listener := range notify {
+		listener(previous, *reloaded)
+	}
+	slog.Info("Configuration reloaded")
+	return nil
+}
+
+// checkLiveChanges rejects changes of the settings read only once: the listener addresses and TLS files, the store, the tracing and the instance ID
+func checkLiveChanges(previous GlobalConfig, current GlobalConfig) error {
+	var fields RestartRequiredError
+	if previous.Uuid != current.Uuid {
+		fields = append(fields, "uuid")
+	}
+	if previous.ConnectionsConfig.Client.ListenPort != current.ConnectionsConfig.Client.ListenPort {
+		fields = append(fields, "Client.listen_port")
+	}
+	if previous.ConnectionsConfig.Client.TLS != current.ConnectionsConfig.Client.TLS {
+		fields = append(fields, "Client.tls")
+	}
+	if previous.ConnectionsConfig.Admin.ListenPort != current.ConnectionsConfig.Admin.ListenPort {
+		fields = append(fields, "Admin.listen_port")
+	}
+	if !reflect.DeepEqual(previous.ConnectionsConfig.Storage, current.ConnectionsConfig.Storage) {
+		fields = append(fields, "Storage")
+	}
+	if previous.ConnectionsConfig.Tracing != current.ConnectionsConfig.Tracing {
+		fields = append(fields, "Tracing")
+	}
+	if len(fields) > 0 {
+		return fields
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/encryption"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/persistient"
+	"time"
+)
+
+// encryptedStore encrypts message bodies before they reach the backend and decrypts them on the way back,
+// so history and replay of unsent messages see plaintext bodies
+type encryptedStore struct {
+	Store
+	encryptionConfig config.Encryption
+	keyring          *encryption.Keyring
+}
+
+func newEncryptedStore(backend Store, encryptionConfig config.Encryption) Store {
+	return &encryptedStore{Store: backend, encryptionConfig: encryptionConfig}
+}
+
+// Start loads the master keys before the backend connects
+func (holder *encryptedStore) Start(ctx context.Context) error {
+	keyring, err := encryption.LoadKeyring(holder.encryptionConfig)
+	if err != nil {
+		slog.Error("Unable to load master keys", logging.Err(err))
+		return err
+	}
+	holder.keyring = keyring
+	slog.Info("Message bodies are encrypted", "key_id", keyring.ActiveKeyID())
+	return holder.Store.Start(ctx)
+}
+
+func (holder *encryptedStore) Insert(ctx context.Context, messages ...persistient.EventMessage) error {
+	encrypted := make([]persistient.EventMessage, len(messages))
+	for i, message := range messages {
+		if err := holder.encrypt(&message); err != nil {
+			slog.Error("Unable to encrypt message body", logging.Err(err))
+			return err
+		}
+		encrypted[i] = message
+	}
+	return holder.Store.Insert(ctx, encrypted...)
+}
+
+func (holder *encryptedStore) FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.Store.FindByReceiverID(ctx, userID, holder.decrypting(foreach))
+}
+
+func (holder *encryptedStore) FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.Store.FindUnsentByReceiverUserID(ctx, userID, holder.decrypting(foreach))
+}
+
+func (holder *encryptedStore) FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error {
+	return holder.Store.FindUnsentOrCreatedAfter(ctx, userID, after, holder.decrypting(foreach))
+}
+
+func (holder *encryptedStore) FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error {
+	return holder.Store.FindMessagesForEvent(ctx, eventID, holder.decrypting(foreach))
+}
+
+func (holder *encryptedStore) FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.Store.FindByUserID(ctx, userID, holder.decrypting(foreach))
+}
+
+func (holder *encryptedStore) FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error {
+	return holder.Store.FindHistory(ctx, query, holder.decrypting(foreach))
+}
+
+// Reencrypt brings every stored message under the active master key. Messages written before encryption
+// was enabled get encrypted, the others only get their data key wrapped again
+func (holder *encryptedStore) Reencrypt(ctx context.Context) (updated int, err error) {
+
+	activeKeyID := holder.keyring.ActiveKeyID()
+	err = holder.Store.FindNotEncryptedWithKey(ctx, activeKeyID, func(message persistient.EventMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		if message.KeyID == "" {
+			err = holder.encrypt(&message)
+		} else {
+			var sealed encryption.Sealed
+			sealed, err = holder.keyring.Rewrap(sealedOf(message))
+			message.KeyID, message.WrappedKey = sealed.KeyID, sealed.WrappedKey
+		}
+		if err == nil {
+			err = holder.Store.UpdateEncryption(ctx, message)
+		}
+		if err != nil {
+			slog.Error("Unable to re-encrypt message", logging.MessageID, message.ID, logging.Err(err))
+			return err
+		}
+		updated++
+		return nil
+	})
+	return updated, err
+}
+
+func (holder *encryptedStore) encrypt(message *persistient.EventMessage) error {
+	plaintext, err := json.Marshal(message.Body)
+	if err != nil {
+		return err
+	}
+	sealed, err := holder.keyring.Seal(plaintext)
+	if err != nil {
+		return err
+	}
+	message.Body = nil
+	message.KeyID, message.WrappedKey, message.Ciphertext = sealed.KeyID, sealed.WrappedKey, sealed.Ciphertext
+	return nil
+}
+
+func (holder *encryptedStore) decrypting(foreach MessageCallback) MessageCallback {
+	return func(message persistient.EventMessage, err error) error {
+		if err == nil && message.KeyID != "" {
+			var plaintext []byte
+			plaintext, err = holder.keyring.Open(sealedOf(message))
+			if err == nil {
+				err = json.Unmarshal(plaintext, &message.Body)
+			}
+			if err != nil {
+				slog.Error("Unable to decrypt message", logging.MessageID, message.ID, logging.Err(err))
+			}
+			message.KeyID, message.WrappedKey, message.Ciphertext = "", nil, nil
+		}
+		return foreach(message, err)
+	}
+}
+
+func sealedOf(message persistient.EventMessage) encryption.Sealed {
+	return encryption.Sealed{KeyID: message.KeyID, WrappedKey: message.WrappedKey, Ciphertext: message.Ciphertext}
+}
+
+// Reencrypt re-encrypts the stored messages with the active master key after a key rotation.
+// The store must be started
+func Reencrypt(ctx context.Context, store Store) (updated int, err error) {
+	encrypted, ok := store.(*encryptedStore)
+	if !ok {
+		return 0, errors.New("message encryption is not enabled")
+	}
+	return encrypted.Reencrypt(ctx)
+}
@@ -0,0 +1,229 @@
+package db
+
+import (
+	"context"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/tracing"
+	"time"
+)
+
+// instrumentedStore records the duration and the errors of every backend operation, and traces the writes
+// done while routing and delivering. Time spent in the callbacks of the queries is not counted
+type instrumentedStore struct {
+	Store
+	driver string
+}
+
+func newInstrumentedStore(backend Store, driver string) Store {
+	return &instrumentedStore{Store: backend, driver: driver}
+}
+
+func (holder *instrumentedStore) Insert(ctx context.Context, messages ...persistient.EventMessage) error {
+	ctx, span := holder.startSpan(ctx, "insert")
+	span.SetAttributes(attribute.Int("partyfy.messages", len(messages)))
+	start := time.Now()
+	err := holder.Store.Insert(ctx, messages...)
+	observe("insert", start, err)
+	tracing.End(span, err)
+	return err
+}
+
+func (holder *instrumentedStore) FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find("find_by_receiver_id", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindByReceiverID(ctx, userID, foreach)
+	})
+}
+
+func (holder *instrumentedStore) FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find("find_unsent_by_receiver_id", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindUnsentByReceiverUserID(ctx, userID, foreach)
+	})
+}
+
+func (holder *instrumentedStore) FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error {
+	return holder.find("find_unsent_or_created_after", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindUnsentOrCreatedAfter(ctx, userID, after, foreach)
+	})
+}
+
+func (holder *instrumentedStore) FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error {
+	return holder.find("find_messages_for_event", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindMessagesForEvent(ctx, eventID, foreach)
+	})
+}
+
+func (holder *instrumentedStore) FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find("find_by_user_id", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindByUserID(ctx, userID, foreach)
+	})
+}
+
+func (holder *instrumentedStore) FindNotEncryptedWithKey(ctx context.Context, keyID string, foreach MessageCallback) error {
+	return holder.find("find_not_encrypted_with_key", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindNotEncryptedWithKey(ctx, keyID, foreach)
+	})
+}
+
+func (holder *instrumentedStore) SetMessageSent(ctx context.Context, msgID interface{}) {
+	ctx, span := holder.startSpan(ctx, "set_message_sent")
+	start := time.Now()
+	holder.Store.SetMessageSent(ctx, msgID)
+	observe("set_message_sent", start, nil)
+	span.End()
+}
+
+func (holder *instrumentedStore) EraseUser(ctx context.Context, userID int) (deleted int64, anonymized int64, err error) {
+	start := time.Now()
+	deleted, anonymized, err = holder.Store.EraseUser(ctx, userID)
+	observe("erase_user", start, err)
+	return deleted, anonymized, err
+}
+
+func (holder *instrumentedStore) InsertAudit(ctx context.Context, record persistient.AuditRecord) error {
+	start := time.Now()
+	err := holder.Store.InsertAudit(ctx, record)
+	observe("insert_audit", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) UpdateEncryption(ctx context.Context, message persistient.EventMessage) error {
+	start := time.Now()
+	err := holder.Store.UpdateEncryption(ctx, message)
+	observe("update_encryption", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) CountUnsent(ctx context.Context) (int64, error) {
+	start := time.Now()
+	count, err := holder.Store.CountUnsent(ctx)
+	observe("count_unsent", start, err)
+	return count, err
+}
+
+func (holder *instrumentedStore) CountUnsentByReceiverID(ctx context.Context, userID int) (int64, error) {
+	start := time.Now()
+	count, err := holder.Store.CountUnsentByReceiverID(ctx, userID)
+	observe("count_unsent_by_receiver_id", start, err)
+	return count, err
+}
+
+func (holder *instrumentedStore) FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error {
+	return holder.find("find_history", foreach, func(foreach MessageCallback) error {
+		return holder.Store.FindHistory(ctx, query, foreach)
+	})
+}
+
+func (holder *instrumentedStore) MarkRead(ctx context.Context, query ReadQuery) (int64, error) {
+	start := time.Now()
+	updated, err := holder.Store.MarkRead(ctx, query)
+	observe("mark_read", start, err)
+	return updated, err
+}
+
+func (holder *instrumentedStore) CountUnread(ctx context.Context, userID int) ([]UnreadCount, error) {
+	start := time.Now()
+	counts, err := holder.Store.CountUnread(ctx, userID)
+	observe("count_unread", start, err)
+	return counts, err
+}
+
+func (holder *instrumentedStore) SetOnline(ctx context.Context, userID int, replica string, now time.Time) error {
+	start := time.Now()
+	err := holder.Store.SetOnline(ctx, userID, replica, now)
+	observe("set_online", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) SetOffline(ctx context.Context, userID int, replica string, lastSeen, now time.Time) error {
+	start := time.Now()
+	err := holder.Store.SetOffline(ctx, userID, replica, lastSeen, now)
+	observe("set_offline", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) TouchPresence(ctx context.Context, replica string, now time.Time) error {
+	start := time.Now()
+	err := holder.Store.TouchPresence(ctx, replica, now)
+	observe("touch_presence", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) SetPresenceHidden(ctx context.Context, userID int, hidden bool, now time.Time) error {
+	start := time.Now()
+	err := holder.Store.SetPresenceHidden(ctx, userID, hidden, now)
+	observe("set_presence_hidden", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) FindPresence(ctx context.Context, userIDs []int) ([]persistient.Presence, error) {
+	start := time.Now()
+	found, err := holder.Store.FindPresence(ctx, userIDs)
+	observe("find_presence", start, err)
+	return found, err
+}
+
+func (holder *instrumentedStore) FindPresenceChanges(ctx context.Context, after time.Time) ([]persistient.Presence, error) {
+	start := time.Now()
+	changed, err := holder.Store.FindPresenceChanges(ctx, after)
+	observe("find_presence_changes", start, err)
+	return changed, err
+}
+
+func (holder *instrumentedStore) ExpectReceipts(ctx context.Context, receipts ...persistient.Receipt) error {
+	start := time.Now()
+	err := holder.Store.ExpectReceipts(ctx, receipts...)
+	observe("expect_receipts", start, err)
+	return err
+}
+
+func (holder *instrumentedStore) RecordDelivered(ctx context.Context, receiverID int, messageKeys []string, at time.Time) ([]persistient.Receipt, error) {
+	start := time.Now()
+	recorded, err := holder.Store.RecordDelivered(ctx, receiverID, messageKeys, at)
+	observe("record_delivered", start, err)
+	return recorded, err
+}
+
+func (holder *instrumentedStore) RecordRead(ctx context.Context, query ReadQuery, at time.Time) ([]persistient.Receipt, error) {
+	start := time.Now()
+	recorded, err := holder.Store.RecordRead(ctx, query, at)
+	observe("record_read", start, err)
+	return recorded, err
+}
+
+func (holder *instrumentedStore) FindReceipts(ctx context.Context, senderID int, messageKeys []string) ([]persistient.Receipt, error) {
+	start := time.Now()
+	found, err := holder.Store.FindReceipts(ctx, senderID, messageKeys)
+	observe("find_receipts", start, err)
+	return found, err
+}
+
+func (holder *instrumentedStore) CountReceipts(ctx context.Context, messageKeys []string) ([]ReceiptCount, error) {
+	start := time.Now()
+	counts, err := holder.Store.CountReceipts(ctx, messageKeys)
+	observe("count_receipts", start, err)
+	return counts, err
+}
+
+func (holder *instrumentedStore) find(operation string, foreach MessageCallback, query func(foreach MessageCallback) error) error {
+	var inCallbacks time.Duration
+	start := time.Now()
+	err := query(func(message persistient.EventMessage, err error) error {
+		callbackStart := time.Now()
+		defer func() { inCallbacks += time.Since(callbackStart) }()
+		return foreach(message, err)
+	})
+	observe(operation, start.Add(inCallbacks), err)
+	return err
+}
+
+func (holder *instrumentedStore) startSpan(ctx context.Context, operation string) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "store."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.system", holder.driver), attribute.String("db.operation", operation)))
+}
+
+func observe(operation string, start time.Time, err error) {
+	metrics.ObserveDuration(metrics.StoreDuration, metrics.StoreErrors, operation, start, err)
+}
@@ -0,0 +1,461 @@
+package db
+
+import (
+	"context"
+	"partyfy-message-service/persistient"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in process memory. It is meant for local runs and tests, nothing survives a restart
+type memoryStore struct {
+	mutex    sync.RWMutex
+	lastID   int64
+	messages []persistient.EventMessage
+	audit    []persistient.AuditRecord
+	presence map[int]persistient.Presence
+	receipts []persistient.Receipt
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{presence: make(map[int]persistient.Presence)}
+}
+
+func (holder *memoryStore) Start(ctx context.Context) error {
+	return nil
+}
+
+func (holder *memoryStore) Close() error {
+	return nil
+}
+
+func (holder *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (holder *memoryStore) Insert(ctx context.Context, messages ...persistient.EventMessage) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	for _, message := range messages {
+		holder.lastID++
+		message.ID = holder.lastID
+		holder.messages = append(holder.messages, message)
+	}
+	return nil
+}
+
+func (holder *memoryStore) FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(func(message *persistient.EventMessage) bool {
+		return message.ReceiverID == userID
+	}, foreach)
+}
+
+func (holder *memoryStore) FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(func(message *persistient.EventMessage) bool {
+		return message.ReceiverID == userID && !message.IsSent
+	}, foreach)
+}
+
+func (holder *memoryStore) FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error {
+	holder.mutex.RLock()
+	var found []persistient.EventMessage
+	for i := range holder.messages {
+		message := &holder.messages[i]
+		if message.ReceiverID == userID && (!message.IsSent || message.CreatedAt.After(after)) {
+			found = append(found, *message)
+		}
+	}
+	holder.mutex.RUnlock()
+
+	sort.SliceStable(found, func(i, j int) bool { return found[i].CreatedAt.Before(found[j].CreatedAt) })
+	for _, message := range found {
+		if foreach(message, nil) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (holder *memoryStore) FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error {
+	return holder.find(func(message *persistient.EventMessage) bool {
+		return message.EventID == eventID
+	}, foreach)
+}
+
+func (holder *memoryStore) FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(func(message *persistient.EventMessage) bool {
+		return message.SenderID == userID || message.ReceiverID == userID
+	}, foreach)
+}
+
+func (holder *memoryStore) EraseUser(ctx context.Context, userID int) (deleted int64, anonymized int64, err error) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	kept := holder.messages[:0]
+	for _, message := range holder.messages {
+		switch {
+		case message.ReceiverID == userID || (message.SenderID == userID && message.EventID == 0):
+			deleted++
+			continue
+		case message.SenderID == userID:
+			message.SenderID = 0
+			message.Body = ErasedBody
+			message.KeyID, message.WrappedKey, message.Ciphertext = "", nil, nil
+			anonymized++
+		}
+		kept = append(kept, message)
+	}
+	holder.messages = kept
+	delete(holder.presence, userID)
+	receipts := holder.receipts[:0]
+	for _, receipt := range holder.receipts {
+		if receipt.SenderID != userID && receipt.ReceiverID != userID {
+			receipts = append(receipts, receipt)
+		}
+	}
+	holder.receipts = receipts
+	return deleted, anonymized, nil
+}
+
+func (holder *memoryStore) SetMessageSent(ctx context.Context, msgID interface{}) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	for i := range holder.messages {
+		if holder.messages[i].ID == msgID {
+			holder.messages[i].IsSent = true
+			return
+		}
+	}
+}
+
+func (holder *memoryStore) InsertAudit(ctx context.Context, record persistient.AuditRecord) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	holder.audit = append(holder.audit, record)
+	return nil
+}
+
+func (holder *memoryStore) FindNotEncryptedWithKey(ctx context.Context, keyID string, foreach MessageCallback) error {
+	return holder.find(func(message *persistient.EventMessage) bool {
+		return message.KeyID != keyID
+	}, foreach)
+}
+
+func (holder *memoryStore) UpdateEncryption(ctx context.Context, message persistient.EventMessage) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	for i := range holder.messages {
+		if holder.messages[i].ID == message.ID {
+			holder.messages[i].Body = message.Body
+			holder.messages[i].KeyID = message.KeyID
+			holder.messages[i].WrappedKey = message.WrappedKey
+			holder.messages[i].Ciphertext = message.Ciphertext
+			return nil
+		}
+	}
+	return nil
+}
+
+func (holder *memoryStore) CountUnsent(ctx context.Context) (int64, error) {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var count int64
+	for i := range holder.messages {
+		if !holder.messages[i].IsSent {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (holder *memoryStore) CountUnsentByReceiverID(ctx context.Context, userID int) (int64, error) {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var count int64
+	for i := range holder.messages {
+		if holder.messages[i].ReceiverID == userID && !holder.messages[i].IsSent {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (holder *memoryStore) FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error {
+	holder.mutex.RLock()
+	var found []persistient.EventMessage
+	for i := range holder.messages {
+		message := &holder.messages[i]
+		if inConversation(message, query.UserID, query.PeerID, query.EventID) &&
+			(query.Before.IsZero() || message.CreatedAt.Before(query.Before)) {
+			found = append(found, *message)
+		}
+	}
+	holder.mutex.RUnlock()
+
+	// Messages are appended in ID order, the stable sort keeps the newest ID first among equal times
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	sort.SliceStable(found, func(i, j int) bool { return found[i].CreatedAt.After(found[j].CreatedAt) })
+	if query.Limit > 0 && len(found) > query.Limit {
+		found = found[:query.Limit]
+	}
+	for _, message := range found {
+		if foreach(message, nil) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (holder *memoryStore) MarkRead(ctx context.Context, query ReadQuery) (int64, error) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	var updated int64
+	for i := range holder.messages {
+		message := &holder.messages[i]
+		if message.ReceiverID == query.UserID && !message.IsRead && inConversation(message, query.UserID, query.PeerID, query.EventID) &&
+			(query.Until.IsZero() || !message.CreatedAt.After(query.Until)) {
+			message.IsRead = true
+			updated++
+		}
+	}
+	return updated, nil
+}
+
+func (holder *memoryStore) CountUnread(ctx context.Context, userID int) ([]UnreadCount, error) {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var counts []UnreadCount
+	index := make(map[UnreadCount]int)
+	for i := range holder.messages {
+		message := &holder.messages[i]
+		if message.ReceiverID != userID || message.SenderID == userID || message.IsRead || message.Channel != ChatChannel {
+			continue
+		}
+		key := UnreadCount{EventID: message.EventID}
+		if message.EventID == 0 {
+			key.SenderID = message.SenderID
+		}
+		position, seen := index[key]
+		if !seen {
+			position = len(counts)
+			index[key] = position
+			counts = append(counts, key)
+		}
+		counts[position].Count++
+	}
+	return counts, nil
+}
+
+func (holder *memoryStore) SetOnline(ctx context.Context, userID int, replica string, now time.Time) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	presence := holder.presence[userID]
+	if len(presence.Replicas) == 0 {
+		presence.Online, presence.Since, presence.UpdatedAt = true, now, now
+	}
+	presence.UserID, presence.LastSeen = userID, now
+	if !containsReplica(presence.Replicas, replica) {
+		presence.Replicas = append(append([]string(nil), presence.Replicas...), replica)
+	}
+	holder.presence[userID] = presence
+	return nil
+}
+
+func (holder *memoryStore) SetOffline(ctx context.Context, userID int, replica string, lastSeen, now time.Time) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	presence, found := holder.presence[userID]
+	if !found || !containsReplica(presence.Replicas, replica) {
+		return nil
+	}
+	var left []string
+	for _, other := range presence.Replicas {
+		if other != replica {
+			left = append(left, other)
+		}
+	}
+	presence.Replicas = left
+	if len(left) == 0 {
+		presence.Online, presence.LastSeen, presence.UpdatedAt = false, lastSeen, now
+	}
+	holder.presence[userID] = presence
+	return nil
+}
+
+func (holder *memoryStore) TouchPresence(ctx context.Context, replica string, now time.Time) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	for userID, presence := range holder.presence {
+		if containsReplica(presence.Replicas, replica) {
+			presence.LastSeen = now
+			holder.presence[userID] = presence
+		}
+	}
+	return nil
+}
+
+func (holder *memoryStore) SetPresenceHidden(ctx context.Context, userID int, hidden bool, now time.Time) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	presence := holder.presence[userID]
+	presence.UserID, presence.Hidden, presence.UpdatedAt = userID, hidden, now
+	holder.presence[userID] = presence
+	return nil
+}
+
+func (holder *memoryStore) FindPresence(ctx context.Context, userIDs []int) ([]persistient.Presence, error) {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var found []persistient.Presence
+	for _, userID := range userIDs {
+		if presence, seen := holder.presence[userID]; seen {
+			found = append(found, presence)
+		}
+	}
+	return found, nil
+}
+
+func (holder *memoryStore) FindPresenceChanges(ctx context.Context, after time.Time) ([]persistient.Presence, error) {
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var changed []persistient.Presence
+	for _, presence := range holder.presence {
+		if presence.UpdatedAt.After(after) {
+			changed = append(changed, presence)
+		}
+	}
+	return changed, nil
+}
+
+func (holder *memoryStore) ExpectReceipts(ctx context.Context, receipts ...persistient.Receipt) error {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	holder.receipts = append(holder.receipts, receipts...)
+	return nil
+}
+
+func (holder *memoryStore) RecordDelivered(ctx context.Context, receiverID int, messageKeys []string, at time.Time) ([]persistient.Receipt, error) {
+	keys := make(map[string]bool, len(messageKeys))
+	for _, messageKey := range messageKeys {
+		keys[messageKey] = true
+	}
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	var recorded []persistient.Receipt
+	for i := range holder.receipts {
+		receipt := &holder.receipts[i]
+		if receipt.ReceiverID == receiverID && receipt.DeliveredAt.IsZero() && keys[receipt.MessageKey] {
+			receipt.DeliveredAt = at
+			recorded = append(recorded, *receipt)
+		}
+	}
+	return recorded, nil
+}
+
+func (holder *memoryStore) RecordRead(ctx context.Context, query ReadQuery, at time.Time) ([]persistient.Receipt, error) {
+	holder.mutex.Lock()
+	defer holder.mutex.Unlock()
+	var recorded []persistient.Receipt
+	for i := range holder.receipts {
+		receipt := &holder.receipts[i]
+		if receipt.ReceiverID != query.UserID || !receipt.ReadAt.IsZero() || receipt.EventID != query.EventID ||
+			(query.EventID == 0 && receipt.SenderID != query.PeerID) ||
+			(!query.Until.IsZero() && receipt.CreatedAt.After(query.Until)) {
+			continue
+		}
+		receipt.ReadAt = at
+		if receipt.DeliveredAt.IsZero() {
+			receipt.DeliveredAt = at
+		}
+		recorded = append(recorded, *receipt)
+	}
+	return recorded, nil
+}
+
+func (holder *memoryStore) FindReceipts(ctx context.Context, senderID int, messageKeys []string) ([]persistient.Receipt, error) {
+	keys := make(map[string]bool, len(messageKeys))
+	for _, messageKey := range messageKeys {
+		keys[messageKey] = true
+	}
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var found []persistient.Receipt
+	for _, receipt := range holder.receipts {
+		if receipt.SenderID == senderID && keys[receipt.MessageKey] {
+			found = append(found, receipt)
+		}
+	}
+	return found, nil
+}
+
+func (holder *memoryStore) CountReceipts(ctx context.Context, messageKeys []string) ([]ReceiptCount, error) {
+	index := make(map[string]int, len(messageKeys))
+	for _, messageKey := range messageKeys {
+		index[messageKey] = -1
+	}
+	holder.mutex.RLock()
+	defer holder.mutex.RUnlock()
+	var counts []ReceiptCount
+	for _, receipt := range holder.receipts {
+		position, wanted := index[receipt.MessageKey]
+		if !wanted {
+			continue
+		}
+		if position < 0 {
+			position = len(counts)
+			index[receipt.MessageKey] = position
+			counts = append(counts, ReceiptCount{MessageKey: receipt.MessageKey})
+		}
+		counts[position].Receivers++
+		if !receipt.DeliveredAt.IsZero() {
+			counts[position].Delivered++
+		}
+		if !receipt.ReadAt.IsZero() {
+			counts[position].Read++
+		}
+	}
+	return counts, nil
+}
+
+func containsReplica(replicas []string, replica string) bool {
+	for _, other := range replicas {
+		if other == replica {
+			return true
+		}
+	}
+	return false
+}
+
+// inConversation tells whether the message belongs to the direct conversation of userID with peerID,
+// or to the chat of eventID as received by userID
+func inConversation(message *persistient.EventMessage, userID int, peerID int, eventID int64) bool {
+	if message.Channel != ChatChannel {
+		return false
+	}
+	if eventID != 0 {
+		return message.EventID == eventID && message.ReceiverID == userID
+	}
+	return message.EventID == 0 &&
+		((message.SenderID == userID && message.ReceiverID == peerID) || (message.SenderID == peerID && message.ReceiverID == userID))
+}
+
+func (holder *memoryStore) find(filter func(message *persistient.EventMessage) bool, foreach MessageCallback) error {
+	holder.mutex.RLock()
+	var found []persistient.EventMessage
+	for i := range holder.messages {
+		if filter(&holder.messages[i]) {
+			found = append(found, holder.messages[i])
+		}
+	}
+	holder.mutex.RUnlock()
+
+	for _, message := range found {
+		if foreach(message, nil) != nil {
+			break
+		}
+	}
+	return nil
+}
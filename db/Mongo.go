@@ -5,105 +5,506 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"log/slog"
 	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
 	"partyfy-message-service/persistient"
 	"time"
 )
 
 const MessagesCollection = "messages"
+const AuditCollection = "audit"
+const PresenceCollection = "presence"
+const ReceiptsCollection = "receipts"
 
-var database *mongo.Database
-var collectionsMap map[string]*Collection
-
-type Collection struct {
-	collection *mongo.Collection
+type mongoStore struct {
+	uri      string
+	client   *mongo.Client
+	messages *mongo.Collection
+	audit    *mongo.Collection
+	presence *mongo.Collection
+	receipts *mongo.Collection
 }
 
-func init() {
+func newMongoStore(storageConfig config.Storage) (Store, error) {
 
-	mongoConfig := config.GetConfig().ConnectionsConfig.Mongo
-	client, err := mongo.NewClient(options.Client().ApplyURI(mongoConfig.Uri))
+	client, err := mongo.NewClient(options.Client().ApplyURI(storageConfig.Uri))
 	if err != nil {
-		log.Fatal("Unable to create Mongo client with address: "+mongoConfig.Uri, "; ", err)
-		return
+		slog.Error("Unable to create Mongo client", "uri", storageConfig.Uri, logging.Err(err))
+		return nil, err
 	}
 
-	ctx := createContext()
-	err = client.Connect(ctx)
+	database := client.Database(storageConfig.Database)
+	return &mongoStore{
+		uri:      storageConfig.Uri,
+		client:   client,
+		messages: database.Collection(MessagesCollection),
+		audit:    database.Collection(AuditCollection),
+		presence: database.Collection(PresenceCollection),
+		receipts: database.Collection(ReceiptsCollection),
+	}, nil
+}
+
+func (holder *mongoStore) Start(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	err := holder.client.Connect(ctx)
 	if err != nil {
-		log.Fatal("Unable to connect to Mongo database with address: ", mongoConfig.Uri, "; ", err)
-		return
+		slog.Error("Unable to connect to Mongo database", "uri", holder.uri, logging.Err(err))
 	}
-
-	database = client.Database(mongoConfig.Database)
-	collectionsMap = make(map[string]*Collection)
+	return err
 }
 
-func GetCollection(name string) *Collection {
-	if collectionsMap[name] == nil {
-		collectionsMap[name] = &Collection{database.Collection(name)}
-	}
-	return collectionsMap[name]
+func (holder *mongoStore) Ping(ctx context.Context) error {
+	return holder.client.Ping(ctx, readpref.Primary())
 }
 
-func (holder *Collection) Insert(docs ...interface{}) error {
+func (holder *mongoStore) Close() error {
 	ctx := createContext()
-	_, err := holder.collection.InsertMany(ctx, docs)
+	return holder.client.Disconnect(ctx)
+}
+
+func (holder *mongoStore) Insert(ctx context.Context, messages ...persistient.EventMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	docs := make([]interface{}, len(messages))
+	for i := range messages {
+		docs[i] = messages[i]
+	}
+	_, err := holder.messages.InsertMany(ctx, docs)
 	if err != nil {
-		log.Println("Error inserting document: ", err)
+		slog.Error("Error inserting document", logging.Err(err))
 	}
 	return err
 }
 
-func (holder *Collection) FindByReceiverID(userID int, foreach func(message persistient.EventMessage, err error) error) error {
-	ctx := createContext()
-	queryResult, err := holder.collection.Find(ctx, bson.M{"receiverID": userID})
+func (holder *mongoStore) FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindByReceiverID", bson.M{"receiverID": userID}, foreach)
+}
+
+func (holder *mongoStore) FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindUnsentByReceiverUserID", bson.M{"isSent": false, "receiverID": userID}, foreach)
+}
+
+func (holder *mongoStore) FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	queryResult, err := holder.messages.Find(ctx,
+		bson.M{"receiverID": userID, "$or": bson.A{bson.M{"isSent": false}, bson.M{"createdAt": bson.M{"$gt": after}}}},
+		options.Find().SetSort(bson.D{{Key: "createdAt", Value: 1}, {Key: "_id", Value: 1}}))
 	if err != nil {
-		log.Println("Unable to get result from FindUnsentByReceiverUserID: ", err)
+		slog.Error("Unable to get result", "query", "FindUnsentOrCreatedAfter", logging.Err(err))
+		return err
 	}
 	defer queryResult.Close(ctx)
 	return decodeMultipleResult(queryResult, foreach)
 }
 
-func (holder *Collection) FindUnsentByReceiverUserID(userID int, foreach func(message persistient.EventMessage, err error) error) error {
-	ctx := createContext()
-	queryResult, err := holder.collection.Find(ctx, bson.M{"isSent": false, "receiverID": userID})
+func (holder *mongoStore) FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error {
+	return holder.find(ctx, "FindMessagesForEvent", bson.M{"eventID": eventID}, foreach)
+}
+
+func (holder *mongoStore) FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindByUserID", bson.M{"$or": bson.A{
+		bson.M{"senderID": userID},
+		bson.M{"receiverID": userID},
+	}}, foreach)
+}
+
+func (holder *mongoStore) EraseUser(ctx context.Context, userID int) (deleted int64, anonymized int64, err error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	deleteResult, err := holder.messages.DeleteMany(ctx, bson.M{"$or": bson.A{
+		bson.M{"receiverID": userID},
+		bson.M{"senderID": userID, "eventID": 0},
+	}})
 	if err != nil {
-		log.Println("Unable to get result from FindUnsentByReceiverUserID: ", err)
+		slog.Error("Error deleting messages of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
 	}
-	defer queryResult.Close(ctx)
-	return decodeMultipleResult(queryResult, foreach)
-}
 
-func (holder *Collection) FindMessagesForEvent(eventID int64, foreach func(message persistient.EventMessage, err error) error) error {
-	ctx := createContext()
-	queryResult, err := holder.collection.Find(ctx, bson.M{"eventID": eventID})
+	updateResult, err := holder.messages.UpdateMany(ctx,
+		bson.M{"senderID": userID, "eventID": bson.M{"$ne": 0}},
+		bson.M{
+			"$set":   bson.M{"senderID": 0, "body": ErasedBody},
+			"$unset": bson.M{"keyID": "", "wrappedKey": "", "ciphertext": ""},
+		})
 	if err != nil {
-		log.Println("Unable to get result from FindUnsentByReceiverUserID: ", err)
+		slog.Error("Error anonymizing event messages of user", logging.UserID, userID, logging.Err(err))
+		return deleteResult.DeletedCount, 0, err
 	}
-	defer queryResult.Close(ctx)
-	return decodeMultipleResult(queryResult, foreach)
+	if _, err = holder.presence.DeleteOne(ctx, bson.M{"userID": userID}); err != nil {
+		slog.Error("Error deleting presence of user", logging.UserID, userID, logging.Err(err))
+		return deleteResult.DeletedCount, updateResult.ModifiedCount, err
+	}
+	_, err = holder.receipts.DeleteMany(ctx, bson.M{"$or": bson.A{bson.M{"senderID": userID}, bson.M{"receiverID": userID}}})
+	if err != nil {
+		slog.Error("Error deleting receipts of user", logging.UserID, userID, logging.Err(err))
+		return deleteResult.DeletedCount, updateResult.ModifiedCount, err
+	}
+	return deleteResult.DeletedCount, updateResult.ModifiedCount, nil
 }
 
-func (holder *Collection) SetMessageSent(msgID interface{}) {
-	ctx := createContext()
-	result := holder.collection.FindOneAndUpdate(ctx,
+func (holder *mongoStore) SetMessageSent(ctx context.Context, msgID interface{}) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	result := holder.messages.FindOneAndUpdate(ctx,
 		bson.M{"_id": msgID},
 		bson.D{{"$set", bson.D{{"isSent", true}}}})
 	_, err := result.DecodeBytes()
 	if err != nil {
-		log.Println("Error updating EventMessage document: ", err)
+		slog.Error("Error updating EventMessage document", logging.MessageID, msgID, logging.Err(err))
+	}
+}
+
+func (holder *mongoStore) InsertAudit(ctx context.Context, record persistient.AuditRecord) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := holder.audit.InsertOne(ctx, record)
+	if err != nil {
+		slog.Error("Error inserting audit record", logging.UserID, record.UserID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) FindNotEncryptedWithKey(ctx context.Context, keyID string, foreach MessageCallback) error {
+	return holder.find(ctx, "FindNotEncryptedWithKey", bson.M{"keyID": bson.M{"$ne": keyID}}, foreach)
+}
+
+func (holder *mongoStore) UpdateEncryption(ctx context.Context, message persistient.EventMessage) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := holder.messages.UpdateOne(ctx,
+		bson.M{"_id": message.ID},
+		bson.M{"$set": bson.M{
+			"body":       message.Body,
+			"keyID":      message.KeyID,
+			"wrappedKey": message.WrappedKey,
+			"ciphertext": message.Ciphertext,
+		}})
+	if err != nil {
+		slog.Error("Error updating encryption of EventMessage document", logging.MessageID, message.ID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) CountUnsent(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return holder.messages.CountDocuments(ctx, bson.M{"isSent": false})
+}
+
+func (holder *mongoStore) CountUnsentByReceiverID(ctx context.Context, userID int) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return holder.messages.CountDocuments(ctx, bson.M{"receiverID": userID, "isSent": false})
+}
+
+func (holder *mongoStore) FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error {
+	filter := conversationFilter(query.UserID, query.PeerID, query.EventID)
+	if !query.Before.IsZero() {
+		// Messages stored before createdAt existed have none, they come last
+		filter["createdAt"] = bson.M{"$not": bson.M{"$gte": query.Before}}
+	}
+	findOptions := options.Find().SetSort(bson.D{{Key: "createdAt", Value: -1}, {Key: "_id", Value: -1}})
+	if query.Limit > 0 {
+		findOptions.SetLimit(int64(query.Limit))
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	queryResult, err := holder.messages.Find(ctx, filter, findOptions)
+	if err != nil {
+		slog.Error("Unable to get result", "query", "FindHistory", logging.Err(err))
+		return err
 	}
+	defer queryResult.Close(ctx)
+	return decodeMultipleResult(queryResult, foreach)
+}
+
+func (holder *mongoStore) MarkRead(ctx context.Context, query ReadQuery) (int64, error) {
+	filter := conversationFilter(query.UserID, query.PeerID, query.EventID)
+	filter["receiverID"] = query.UserID
+	filter["isRead"] = bson.M{"$ne": true}
+	if !query.Until.IsZero() {
+		filter["createdAt"] = bson.M{"$not": bson.M{"$gt": query.Until}}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	result, err := holder.messages.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"isRead": true}})
+	if err != nil {
+		slog.Error("Error marking messages read", logging.UserID, query.UserID, logging.Err(err))
+		return 0, err
+	}
+	return result.ModifiedCount, nil
+}
+
+func (holder *mongoStore) CountUnread(ctx context.Context, userID int) ([]UnreadCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	cursor, err := holder.messages.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{
+			"receiverID": userID,
+			"senderID":   bson.M{"$ne": userID},
+			"isRead":     bson.M{"$ne": true},
+			"channel":    ChatChannel,
+		}},
+		bson.M{"$group": bson.M{
+			"_id": bson.M{
+				"eventID":  "$eventID",
+				"senderID": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$eventID", 0}}, "$senderID", 0}},
+			},
+			"count": bson.M{"$sum": 1},
+		}},
+	})
+	if err != nil {
+		slog.Error("Unable to count unread messages", logging.UserID, userID, logging.Err(err))
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var counts []UnreadCount
+	for cursor.Next(ctx) {
+		var group struct {
+			ID struct {
+				EventID  int64 `bson:"eventID"`
+				SenderID int   `bson:"senderID"`
+			} `bson:"_id"`
+			Count int64 `bson:"count"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		counts = append(counts, UnreadCount{SenderID: group.ID.SenderID, EventID: group.ID.EventID, Count: group.Count})
+	}
+	return counts, cursor.Err()
+}
+
+func (holder *mongoStore) SetOnline(ctx context.Context, userID int, replica string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	// The pipeline reads and writes the replicas in one atomic update, since and updatedAt only change with the first one
+	replicas := bson.M{"$ifNull": bson.A{"$replicas", bson.A{}}}
+	connected := bson.M{"$gt": bson.A{bson.M{"$size": replicas}, 0}}
+	_, err := holder.presence.UpdateOne(ctx, bson.M{"userID": userID},
+		bson.A{bson.M{"$set": bson.M{
+			"online":    true,
+			"replicas":  bson.M{"$setUnion": bson.A{replicas, bson.A{bson.M{"$literal": replica}}}},
+			"since":     bson.M{"$cond": bson.A{connected, "$since", now}},
+			"lastSeen":  now,
+			"updatedAt": bson.M{"$cond": bson.A{connected, "$updatedAt", now}},
+		}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		slog.Error("Error recording user online", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) SetOffline(ctx context.Context, userID int, replica string, lastSeen, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	connected := bson.M{"$gt": bson.A{bson.M{"$size": "$replicas"}, 0}}
+	_, err := holder.presence.UpdateOne(ctx, bson.M{"userID": userID, "replicas": replica},
+		bson.A{
+			bson.M{"$set": bson.M{"replicas": bson.M{"$setDifference": bson.A{"$replicas", bson.A{bson.M{"$literal": replica}}}}}},
+			bson.M{"$set": bson.M{
+				"online":    connected,
+				"lastSeen":  bson.M{"$cond": bson.A{connected, "$lastSeen", lastSeen}},
+				"updatedAt": bson.M{"$cond": bson.A{connected, "$updatedAt", now}},
+			}},
+		})
+	if err != nil {
+		slog.Error("Error recording user offline", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) TouchPresence(ctx context.Context, replica string, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := holder.presence.UpdateMany(ctx, bson.M{"replicas": replica}, bson.M{"$set": bson.M{"lastSeen": now}})
+	if err != nil {
+		slog.Error("Error refreshing presence", "replica", replica, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) SetPresenceHidden(ctx context.Context, userID int, hidden bool, now time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	_, err := holder.presence.UpdateOne(ctx, bson.M{"userID": userID},
+		bson.M{"$set": bson.M{"hidden": hidden, "updatedAt": now}}, options.Update().SetUpsert(true))
+	if err != nil {
+		slog.Error("Error recording presence visibility", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) FindPresence(ctx context.Context, userIDs []int) ([]persistient.Presence, error) {
+	return holder.findPresence(ctx, "FindPresence", bson.M{"userID": bson.M{"$in": userIDs}})
+}
+
+func (holder *mongoStore) FindPresenceChanges(ctx context.Context, after time.Time) ([]persistient.Presence, error) {
+	return holder.findPresence(ctx, "FindPresenceChanges", bson.M{"updatedAt": bson.M{"$gt": after}})
+}
+
+func (holder *mongoStore) findPresence(ctx context.Context, name string, filter bson.M) ([]persistient.Presence, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	cursor, err := holder.presence.Find(ctx, filter)
+	if err != nil {
+		slog.Error("Unable to get result", "query", name, logging.Err(err))
+		return nil, err
+	}
+	var found []persistient.Presence
+	if err := cursor.All(ctx, &found); err != nil {
+		slog.Error("Error while reading query result", "query", name, logging.Err(err))
+		return nil, err
+	}
+	return found, nil
+}
+
+func (holder *mongoStore) ExpectReceipts(ctx context.Context, receipts ...persistient.Receipt) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	docs := make([]interface{}, len(receipts))
+	for i := range receipts {
+		docs[i] = receipts[i]
+	}
+	_, err := holder.receipts.InsertMany(ctx, docs)
+	if err != nil {
+		slog.Error("Error inserting receipts", logging.Err(err))
+	}
+	return err
+}
+
+func (holder *mongoStore) RecordDelivered(ctx context.Context, receiverID int, messageKeys []string, at time.Time) ([]persistient.Receipt, error) {
+	filter := bson.M{"receiverID": receiverID, "deliveredAt": time.Time{}, "messageKey": bson.M{"$in": messageKeys}}
+	return holder.updateReceipts(ctx, "RecordDelivered", filter, bson.M{"$set": bson.M{"deliveredAt": at}})
+}
+
+func (holder *mongoStore) RecordRead(ctx context.Context, query ReadQuery, at time.Time) ([]persistient.Receipt, error) {
+	filter := bson.M{"receiverID": query.UserID, "readAt": time.Time{}, "eventID": query.EventID}
+	if query.EventID == 0 {
+		filter["senderID"] = query.PeerID
+	}
+	if !query.Until.IsZero() {
+		filter["createdAt"] = bson.M{"$lte": query.Until}
+	}
+	// Messages read without an ack are delivered at the same time
+	delivered := bson.M{"$gt": bson.A{"$deliveredAt", time.Time{}}}
+	return holder.updateReceipts(ctx, "RecordRead", filter, bson.A{bson.M{"$set": bson.M{
+		"readAt":      at,
+		"deliveredAt": bson.M{"$cond": bson.A{delivered, "$deliveredAt", at}},
+	}}})
+}
+
+func (holder *mongoStore) FindReceipts(ctx context.Context, senderID int, messageKeys []string) ([]persistient.Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	cursor, err := holder.receipts.Find(ctx, bson.M{"senderID": senderID, "messageKey": bson.M{"$in": messageKeys}},
+		options.Find().SetSort(bson.D{{Key: "messageKey", Value: 1}, {Key: "receiverID", Value: 1}}))
+	if err != nil {
+		slog.Error("Unable to get result", "query", "FindReceipts", logging.Err(err))
+		return nil, err
+	}
+	var found []persistient.Receipt
+	if err := cursor.All(ctx, &found); err != nil {
+		slog.Error("Error while reading query result", "query", "FindReceipts", logging.Err(err))
+		return nil, err
+	}
+	return found, nil
+}
+
+func (holder *mongoStore) CountReceipts(ctx context.Context, messageKeys []string) ([]ReceiptCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	countSet := func(field string) bson.M {
+		return bson.M{"$sum": bson.M{"$cond": bson.A{bson.M{"$gt": bson.A{field, time.Time{}}}, 1, 0}}}
+	}
+	cursor, err := holder.receipts.Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"messageKey": bson.M{"$in": messageKeys}}},
+		bson.M{"$group": bson.M{
+			"_id":       "$messageKey",
+			"receivers": bson.M{"$sum": 1},
+			"delivered": countSet("$deliveredAt"),
+			"read":      countSet("$readAt"),
+		}},
+	})
+	if err != nil {
+		slog.Error("Unable to count receipts", logging.Err(err))
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var counts []ReceiptCount
+	for cursor.Next(ctx) {
+		var group struct {
+			MessageKey string `bson:"_id"`
+			Receivers  int64  `bson:"receivers"`
+			Delivered  int64  `bson:"delivered"`
+			Read       int64  `bson:"read"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return nil, err
+		}
+		counts = append(counts, ReceiptCount{MessageKey: group.MessageKey, Receivers: group.Receivers, Delivered: group.Delivered, Read: group.Read})
+	}
+	return counts, cursor.Err()
+}
+
+// updateReceipts updates the receipts matching the filter one by one, every receipt is found and updated atomically
+// so that concurrent updates never both return it. The update must make the receipt leave the filter
+func (holder *mongoStore) updateReceipts(ctx context.Context, name string, filter bson.M, update interface{}) ([]persistient.Receipt, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	updateOptions := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	var receipts []persistient.Receipt
+	for {
+		var receipt persistient.Receipt
+		err := holder.receipts.FindOneAndUpdate(ctx, filter, update, updateOptions).Decode(&receipt)
+		if err == mongo.ErrNoDocuments {
+			return receipts, nil
+		}
+		if err != nil {
+			slog.Error("Error updating receipts", "query", name, logging.Err(err))
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+}
+
+// conversationFilter selects the chat messages of a direct conversation or an event chat, see inConversation
+func conversationFilter(userID int, peerID int, eventID int64) bson.M {
+	if eventID != 0 {
+		return bson.M{"channel": ChatChannel, "eventID": eventID, "receiverID": userID}
+	}
+	return bson.M{"channel": ChatChannel, "eventID": 0, "$or": bson.A{
+		bson.M{"senderID": userID, "receiverID": peerID},
+		bson.M{"senderID": peerID, "receiverID": userID},
+	}}
+}
+
+func (holder *mongoStore) find(ctx context.Context, name string, filter bson.M, foreach MessageCallback) error {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	queryResult, err := holder.messages.Find(ctx, filter)
+	if err != nil {
+		slog.Error("Unable to get result", "query", name, logging.Err(err))
+		return err
+	}
+	defer queryResult.Close(ctx)
+	return decodeMultipleResult(queryResult, foreach)
 }
 
-func decodeMultipleResult(cursor *mongo.Cursor, foreach func(message persistient.EventMessage, err error) error) error {
+func decodeMultipleResult(cursor *mongo.Cursor, foreach MessageCallback) error {
 	ctx := createContext()
-	var message persistient.EventMessage
 	for cursor.Next(ctx) {
+		var message persistient.EventMessage
 		err := cursor.Decode(&message)
 		if err != nil {
-			log.Println("Unable to decode document: ", err)
+			slog.Error("Unable to decode document", logging.Err(err))
 		}
 		message.ID = cursor.Current.Lookup("_id").ObjectID()
 		if foreach(message, err) != nil {
@@ -113,7 +514,7 @@ func decodeMultipleResult(cursor *mongo.Cursor, foreach func(message persistient
 	cursor.Close(ctx)
 	err := cursor.Err()
 	if err != nil {
-		log.Println(err)
+		slog.Error("Error while reading query result", logging.Err(err))
 	}
 	return err
 }
@@ -0,0 +1,770 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/persistient"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqlDialect hides the differences between the supported relational databases
+type sqlDialect struct {
+	driverName string
+	serial     string
+	bytes      string
+	// placeholder renders the n-th (1-based) query argument
+	placeholder func(n int) string
+}
+
+var sqlDialects = map[string]sqlDialect{
+	PostgresDriver: {
+		driverName:  "postgres",
+		serial:      "BIGSERIAL PRIMARY KEY",
+		bytes:       "BYTEA",
+		placeholder: func(n int) string { return "$" + strconv.Itoa(n) },
+	},
+	SqliteDriver: {
+		driverName:  "sqlite3",
+		serial:      "INTEGER PRIMARY KEY AUTOINCREMENT",
+		bytes:       "BLOB",
+		placeholder: func(n int) string { return "?" },
+	},
+}
+
+// sqlMigrations are applied in order and recorded in the schema_migrations table.
+// Never edit an applied migration, append a new one instead
+var sqlMigrations = []string{
+	`CREATE TABLE messages (
+		id          {{serial}},
+		channel     VARCHAR(128) NOT NULL,
+		event_id    BIGINT       NOT NULL DEFAULT 0,
+		sender_id   INTEGER      NOT NULL DEFAULT 0,
+		receiver_id INTEGER      NOT NULL DEFAULT 0,
+		is_sent     BOOLEAN      NOT NULL DEFAULT FALSE,
+		body        TEXT
+	);
+	CREATE INDEX messages_receiver_id_is_sent_idx ON messages (receiver_id, is_sent);
+	CREATE INDEX messages_event_id_idx ON messages (event_id);
+	CREATE INDEX messages_sender_id_event_id_idx ON messages (sender_id, event_id);
+	CREATE TABLE audit (
+		id         {{serial}},
+		action     VARCHAR(16)  NOT NULL,
+		user_id    INTEGER      NOT NULL,
+		requester  VARCHAR(255) NOT NULL,
+		deleted    BIGINT       NOT NULL DEFAULT 0,
+		anonymized BIGINT       NOT NULL DEFAULT 0,
+		time       TIMESTAMP    NOT NULL
+	);
+	CREATE INDEX audit_user_id_idx ON audit (user_id);`,
+
+	`ALTER TABLE messages ADD COLUMN key_id VARCHAR(64);
+	ALTER TABLE messages ADD COLUMN wrapped_key {{bytes}};
+	ALTER TABLE messages ADD COLUMN ciphertext {{bytes}};
+	CREATE INDEX messages_key_id_idx ON messages (key_id);`,
+
+	`ALTER TABLE messages ADD COLUMN trace_id VARCHAR(32);
+	ALTER TABLE messages ADD COLUMN span_id VARCHAR(16);`,
+
+	`ALTER TABLE messages ADD COLUMN created_at TIMESTAMP NOT NULL DEFAULT '1970-01-01 00:00:00';
+	ALTER TABLE messages ADD COLUMN is_read BOOLEAN NOT NULL DEFAULT FALSE;
+	CREATE INDEX messages_receiver_id_event_id_created_at_idx ON messages (receiver_id, event_id, created_at);`,
+
+	`CREATE TABLE presence (
+		user_id    INTEGER     NOT NULL PRIMARY KEY,
+		online     BOOLEAN     NOT NULL DEFAULT FALSE,
+		replica    VARCHAR(64) NOT NULL DEFAULT '',
+		since      TIMESTAMP   NOT NULL DEFAULT '1970-01-01 00:00:00',
+		last_seen  TIMESTAMP   NOT NULL DEFAULT '1970-01-01 00:00:00',
+		hidden     BOOLEAN     NOT NULL DEFAULT FALSE,
+		updated_at TIMESTAMP   NOT NULL DEFAULT '1970-01-01 00:00:00'
+	);
+	CREATE INDEX presence_updated_at_idx ON presence (updated_at);
+	CREATE INDEX presence_replica_online_idx ON presence (replica, online);`,
+
+	`ALTER TABLE messages ADD COLUMN message_key VARCHAR(32);
+	CREATE TABLE receipts (
+		message_key  VARCHAR(32) NOT NULL,
+		receiver_id  INTEGER     NOT NULL,
+		sender_id    INTEGER     NOT NULL,
+		event_id     BIGINT      NOT NULL DEFAULT 0,
+		created_at   TIMESTAMP   NOT NULL,
+		delivered_at TIMESTAMP,
+		read_at      TIMESTAMP,
+		PRIMARY KEY (message_key, receiver_id)
+	);
+	CREATE INDEX receipts_receiver_id_event_id_created_at_idx ON receipts (receiver_id, event_id, created_at);`,
+
+	`CREATE TABLE presence_replicas (
+		user_id INTEGER     NOT NULL,
+		replica VARCHAR(64) NOT NULL,
+		PRIMARY KEY (user_id, replica)
+	);
+	CREATE INDEX presence_replicas_replica_idx ON presence_replicas (replica);
+	INSERT INTO presence_replicas (user_id, replica) SELECT user_id, replica FROM presence WHERE online AND replica <> '';
+	DROP INDEX presence_replica_online_idx;
+	ALTER TABLE presence DROP COLUMN replica;`,
+}
+
+const messageColumns = "id, channel, event_id, sender_id, receiver_id, is_sent, body, key_id, wrapped_key, ciphertext, trace_id, span_id, created_at, is_read, message_key"
+
+const presenceColumns = "user_id, online, since, last_seen, hidden, updated_at"
+
+const receiptColumns = "message_key, sender_id, receiver_id, event_id, created_at, delivered_at, read_at"
+
+type sqlStore struct {
+	db      *sql.DB
+	dialect sqlDialect
+}
+
+func newSqlStore(storageConfig config.Storage) (Store, error) {
+
+	dialect := sqlDialects[storageConfig.Driver]
+	database, err := sql.Open(dialect.driverName, storageConfig.Uri)
+	if err != nil {
+		slog.Error("Unable to open database", "driver", storageConfig.Driver, logging.Err(err))
+		return nil, err
+	}
+	if dialect.driverName == "sqlite3" {
+		// SQLite allows a single writer, concurrent connections would fail with "database is locked"
+		database.SetMaxOpenConns(1)
+	}
+	return &sqlStore{db: database, dialect: dialect}, nil
+}
+
+func (holder *sqlStore) Start(ctx context.Context) error {
+	if err := holder.db.PingContext(ctx); err != nil {
+		slog.Error("Unable to connect to database", "driver", holder.dialect.driverName, logging.Err(err))
+		return err
+	}
+	if err := holder.migrate(); err != nil {
+		slog.Error("Unable to migrate database", "driver", holder.dialect.driverName, logging.Err(err))
+		return err
+	}
+	return nil
+}
+
+func (holder *sqlStore) Ping(ctx context.Context) error {
+	return holder.db.PingContext(ctx)
+}
+
+func (holder *sqlStore) Close() error {
+	return holder.db.Close()
+}
+
+func (holder *sqlStore) migrate() error {
+
+	_, err := holder.db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER   PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = holder.db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		slog.Info("Applying database migration", "version", version+1)
+		tx, err := holder.db.Begin()
+		if err != nil {
+			return err
+		}
+		migration := strings.NewReplacer("{{serial}}", holder.dialect.serial, "{{bytes}}", holder.dialect.bytes).
+			Replace(sqlMigrations[version])
+		for _, statement := range strings.Split(migration, ";") {
+			if strings.TrimSpace(statement) == "" {
+				continue
+			}
+			if _, err = tx.Exec(statement); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+		_, err = tx.Exec(holder.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version+1, time.Now().UTC())
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		if err = tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (holder *sqlStore) Insert(ctx context.Context, messages ...persistient.EventMessage) error {
+
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Error inserting document", logging.Err(err))
+		return err
+	}
+	statement, err := tx.Prepare(holder.rebind(
+		"INSERT INTO messages (channel, event_id, sender_id, receiver_id, is_sent, body, key_id, wrapped_key, ciphertext, trace_id, span_id, created_at, is_read, message_key)" +
+			" VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)"))
+	if err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error inserting document", logging.Err(err))
+		return err
+	}
+	defer statement.Close()
+
+	for _, message := range messages {
+		body, err := json.Marshal(message.Body)
+		if err == nil {
+			_, err = statement.ExecContext(ctx, message.Channel, message.EventID, message.SenderID, message.ReceiverID, message.IsSent, string(body),
+				nullString(message.KeyID), message.WrappedKey, message.Ciphertext, nullString(message.TraceID), nullString(message.SpanID),
+				message.CreatedAt.UTC(), message.IsRead, nullString(message.MessageKey))
+		}
+		if err != nil {
+			_ = tx.Rollback()
+			slog.Error("Error inserting document", logging.Err(err))
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (holder *sqlStore) FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindByReceiverID", "receiver_id = ?", foreach, userID)
+}
+
+func (holder *sqlStore) FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindUnsentByReceiverUserID", "receiver_id = ? AND is_sent = ?", foreach, userID, false)
+}
+
+func (holder *sqlStore) FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error {
+	return holder.query(ctx, "FindUnsentOrCreatedAfter", "receiver_id = ? AND (is_sent = ? OR created_at > ?)",
+		" ORDER BY created_at, id", foreach, userID, false, after.UTC())
+}
+
+func (holder *sqlStore) FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error {
+	return holder.find(ctx, "FindMessagesForEvent", "event_id = ?", foreach, eventID)
+}
+
+func (holder *sqlStore) FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error {
+	return holder.find(ctx, "FindByUserID", "sender_id = ? OR receiver_id = ?", foreach, userID, userID)
+}
+
+func (holder *sqlStore) EraseUser(ctx context.Context, userID int) (deleted int64, anonymized int64, err error) {
+
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Error deleting messages of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
+	}
+	result, err := tx.ExecContext(ctx, holder.rebind(
+		"DELETE FROM messages WHERE receiver_id = ? OR (sender_id = ? AND event_id = 0)"), userID, userID)
+	if err == nil {
+		deleted, err = result.RowsAffected()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error deleting messages of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
+	}
+
+	erasedBody, _ := json.Marshal(ErasedBody)
+	result, err = tx.ExecContext(ctx, holder.rebind(
+		"UPDATE messages SET sender_id = 0, body = ?, key_id = NULL, wrapped_key = NULL, ciphertext = NULL"+
+			" WHERE sender_id = ? AND event_id <> 0"), string(erasedBody), userID)
+	if err == nil {
+		anonymized, err = result.RowsAffected()
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error anonymizing event messages of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
+	}
+	if _, err = tx.ExecContext(ctx, holder.rebind("DELETE FROM presence_replicas WHERE user_id = ?"), userID); err == nil {
+		_, err = tx.ExecContext(ctx, holder.rebind("DELETE FROM presence WHERE user_id = ?"), userID)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error deleting presence of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
+	}
+	if _, err = tx.ExecContext(ctx, holder.rebind("DELETE FROM receipts WHERE sender_id = ? OR receiver_id = ?"), userID, userID); err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error deleting receipts of user", logging.UserID, userID, logging.Err(err))
+		return 0, 0, err
+	}
+	return deleted, anonymized, tx.Commit()
+}
+
+func (holder *sqlStore) SetMessageSent(ctx context.Context, msgID interface{}) {
+	_, err := holder.db.ExecContext(ctx, holder.rebind("UPDATE messages SET is_sent = ? WHERE id = ?"), true, msgID)
+	if err != nil {
+		slog.Error("Error updating EventMessage document", logging.MessageID, msgID, logging.Err(err))
+	}
+}
+
+func (holder *sqlStore) InsertAudit(ctx context.Context, record persistient.AuditRecord) error {
+	_, err := holder.db.ExecContext(ctx, holder.rebind(
+		"INSERT INTO audit (action, user_id, requester, deleted, anonymized, time) VALUES (?, ?, ?, ?, ?, ?)"),
+		record.Action, record.UserID, record.Requester, record.Deleted, record.Anonymized, record.Time)
+	if err != nil {
+		slog.Error("Error inserting audit record", logging.UserID, record.UserID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) FindNotEncryptedWithKey(ctx context.Context, keyID string, foreach MessageCallback) error {
+	return holder.find(ctx, "FindNotEncryptedWithKey", "key_id IS NULL OR key_id <> ?", foreach, keyID)
+}
+
+func (holder *sqlStore) UpdateEncryption(ctx context.Context, message persistient.EventMessage) error {
+	body, err := json.Marshal(message.Body)
+	if err == nil {
+		_, err = holder.db.ExecContext(ctx, holder.rebind("UPDATE messages SET body = ?, key_id = ?, wrapped_key = ?, ciphertext = ? WHERE id = ?"),
+			string(body), nullString(message.KeyID), message.WrappedKey, message.Ciphertext, message.ID)
+	}
+	if err != nil {
+		slog.Error("Error updating encryption of EventMessage document", logging.MessageID, message.ID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) CountUnsent(ctx context.Context) (int64, error) {
+	var count int64
+	err := holder.db.QueryRowContext(ctx, holder.rebind("SELECT COUNT(*) FROM messages WHERE is_sent = ?"), false).Scan(&count)
+	return count, err
+}
+
+func (holder *sqlStore) CountUnsentByReceiverID(ctx context.Context, userID int) (int64, error) {
+	var count int64
+	err := holder.db.QueryRowContext(ctx, holder.rebind("SELECT COUNT(*) FROM messages WHERE receiver_id = ? AND is_sent = ?"), userID, false).Scan(&count)
+	return count, err
+}
+
+func (holder *sqlStore) FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error {
+	where, args := conversation(query.UserID, query.PeerID, query.EventID)
+	if !query.Before.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, query.Before.UTC())
+	}
+	order := " ORDER BY created_at DESC, id DESC"
+	if query.Limit > 0 {
+		order += " LIMIT " + strconv.Itoa(query.Limit)
+	}
+	return holder.query(ctx, "FindHistory", where, order, foreach, args...)
+}
+
+func (holder *sqlStore) MarkRead(ctx context.Context, query ReadQuery) (int64, error) {
+	where, args := conversation(query.UserID, query.PeerID, query.EventID)
+	where = "receiver_id = ? AND is_read = ? AND " + where
+	args = append([]interface{}{query.UserID, false}, args...)
+	if !query.Until.IsZero() {
+		where += " AND created_at <= ?"
+		args = append(args, query.Until.UTC())
+	}
+	result, err := holder.db.ExecContext(ctx, holder.rebind("UPDATE messages SET is_read = ? WHERE "+where), append([]interface{}{true}, args...)...)
+	if err != nil {
+		slog.Error("Error marking messages read", logging.UserID, query.UserID, logging.Err(err))
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (holder *sqlStore) CountUnread(ctx context.Context, userID int) ([]UnreadCount, error) {
+	rows, err := holder.db.QueryContext(ctx, holder.rebind(
+		"SELECT event_id, sender_id, COUNT(*) FROM messages"+
+			" WHERE receiver_id = ? AND sender_id <> ? AND is_read = ? AND channel = ? GROUP BY event_id, sender_id"),
+		userID, userID, false, ChatChannel)
+	if err != nil {
+		slog.Error("Unable to count unread messages", logging.UserID, userID, logging.Err(err))
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Event chats are counted per sender by the query, they are summed up here
+	var counts []UnreadCount
+	events := make(map[int64]int)
+	for rows.Next() {
+		var count UnreadCount
+		if err := rows.Scan(&count.EventID, &count.SenderID, &count.Count); err != nil {
+			return nil, err
+		}
+		if count.EventID == 0 {
+			counts = append(counts, count)
+			continue
+		}
+		position, seen := events[count.EventID]
+		if !seen {
+			position = len(counts)
+			events[count.EventID] = position
+			counts = append(counts, UnreadCount{EventID: count.EventID})
+		}
+		counts[position].Count += count.Count
+	}
+	return counts, rows.Err()
+}
+
+func (holder *sqlStore) SetOnline(ctx context.Context, userID int, replica string, now time.Time) error {
+
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Error recording user online", logging.UserID, userID, logging.Err(err))
+		return err
+	}
+	// The presence row is written first, its lock serializes the replicas adding and removing themselves
+	_, err = tx.ExecContext(ctx, holder.rebind(
+		"INSERT INTO presence (user_id, online, since, last_seen, updated_at) VALUES (?, ?, ?, ?, ?)"+
+			" ON CONFLICT (user_id) DO UPDATE SET online = excluded.online, last_seen = excluded.last_seen,"+
+			" since = CASE WHEN presence.online THEN presence.since ELSE excluded.since END,"+
+			" updated_at = CASE WHEN presence.online THEN presence.updated_at ELSE excluded.updated_at END"),
+		userID, true, now.UTC(), now.UTC(), now.UTC())
+	if err == nil {
+		_, err = tx.ExecContext(ctx, holder.rebind(
+			"INSERT INTO presence_replicas (user_id, replica) VALUES (?, ?) ON CONFLICT (user_id, replica) DO NOTHING"),
+			userID, replica)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		_ = tx.Rollback()
+	}
+	if err != nil {
+		slog.Error("Error recording user online", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) SetOffline(ctx context.Context, userID int, replica string, lastSeen, now time.Time) error {
+
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Error recording user offline", logging.UserID, userID, logging.Err(err))
+		return err
+	}
+	// Locking the presence row first makes the replicas left below include the ones added meanwhile
+	_, err = tx.ExecContext(ctx, holder.rebind("UPDATE presence SET user_id = user_id WHERE user_id = ?"), userID)
+	var removed int64
+	if err == nil {
+		var result sql.Result
+		result, err = tx.ExecContext(ctx, holder.rebind("DELETE FROM presence_replicas WHERE user_id = ? AND replica = ?"), userID, replica)
+		if err == nil {
+			removed, err = result.RowsAffected()
+		}
+	}
+	if err == nil && removed > 0 {
+		_, err = tx.ExecContext(ctx, holder.rebind(
+			"UPDATE presence SET online = ?, last_seen = ?, updated_at = ?"+
+				" WHERE user_id = ? AND NOT EXISTS (SELECT 1 FROM presence_replicas WHERE user_id = ?)"),
+			false, lastSeen.UTC(), now.UTC(), userID, userID)
+	}
+	if err == nil {
+		err = tx.Commit()
+	} else {
+		_ = tx.Rollback()
+	}
+	if err != nil {
+		slog.Error("Error recording user offline", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) TouchPresence(ctx context.Context, replica string, now time.Time) error {
+	_, err := holder.db.ExecContext(ctx, holder.rebind(
+		"UPDATE presence SET last_seen = ? WHERE user_id IN (SELECT user_id FROM presence_replicas WHERE replica = ?)"),
+		now.UTC(), replica)
+	if err != nil {
+		slog.Error("Error refreshing presence", "replica", replica, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) SetPresenceHidden(ctx context.Context, userID int, hidden bool, now time.Time) error {
+	_, err := holder.db.ExecContext(ctx, holder.rebind(
+		"INSERT INTO presence (user_id, hidden, updated_at) VALUES (?, ?, ?)"+
+			" ON CONFLICT (user_id) DO UPDATE SET hidden = excluded.hidden, updated_at = excluded.updated_at"),
+		userID, hidden, now.UTC())
+	if err != nil {
+		slog.Error("Error recording presence visibility", logging.UserID, userID, logging.Err(err))
+	}
+	return err
+}
+
+func (holder *sqlStore) FindPresence(ctx context.Context, userIDs []int) ([]persistient.Presence, error) {
+	if len(userIDs) == 0 {
+		return nil, nil
+	}
+	args := make([]interface{}, len(userIDs))
+	for i, userID := range userIDs {
+		args[i] = userID
+	}
+	return holder.queryPresence(ctx, "FindPresence", "user_id IN ("+placeholders(len(userIDs))+")", args...)
+}
+
+func (holder *sqlStore) FindPresenceChanges(ctx context.Context, after time.Time) ([]persistient.Presence, error) {
+	return holder.queryPresence(ctx, "FindPresenceChanges", "updated_at > ?", after.UTC())
+}
+
+func (holder *sqlStore) queryPresence(ctx context.Context, name string, where string, args ...interface{}) ([]persistient.Presence, error) {
+	rows, err := holder.db.QueryContext(ctx, holder.rebind("SELECT "+presenceColumns+" FROM presence WHERE "+where), args...)
+	if err != nil {
+		slog.Error("Unable to get result", "query", name, logging.Err(err))
+		return nil, err
+	}
+	var found []persistient.Presence
+	index := make(map[int]int)
+	for rows.Next() {
+		var presence persistient.Presence
+		err := rows.Scan(&presence.UserID, &presence.Online, &presence.Since, &presence.LastSeen, &presence.Hidden, &presence.UpdatedAt)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[presence.UserID] = len(found)
+		found = append(found, presence)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(found) == 0 {
+		return found, err
+	}
+
+	// The rows are closed first, SQLite has a single connection
+	rows, err = holder.db.QueryContext(ctx, holder.rebind(
+		"SELECT user_id, replica FROM presence_replicas WHERE user_id IN (SELECT user_id FROM presence WHERE "+where+") ORDER BY replica"), args...)
+	if err != nil {
+		slog.Error("Unable to get result", "query", name, logging.Err(err))
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var userID int
+		var replica string
+		if err := rows.Scan(&userID, &replica); err != nil {
+			return nil, err
+		}
+		if position, seen := index[userID]; seen {
+			found[position].Replicas = append(found[position].Replicas, replica)
+		}
+	}
+	return found, rows.Err()
+}
+
+func (holder *sqlStore) ExpectReceipts(ctx context.Context, receipts ...persistient.Receipt) error {
+
+	tx, err := holder.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Error inserting receipts", logging.Err(err))
+		return err
+	}
+	statement, err := tx.Prepare(holder.rebind(
+		"INSERT INTO receipts (message_key, sender_id, receiver_id, event_id, created_at) VALUES (?, ?, ?, ?, ?)" +
+			" ON CONFLICT (message_key, receiver_id) DO NOTHING"))
+	if err != nil {
+		_ = tx.Rollback()
+		slog.Error("Error inserting receipts", logging.Err(err))
+		return err
+	}
+	defer statement.Close()
+
+	for _, receipt := range receipts {
+		_, err := statement.ExecContext(ctx, receipt.MessageKey, receipt.SenderID, receipt.ReceiverID, receipt.EventID, receipt.CreatedAt.UTC())
+		if err != nil {
+			_ = tx.Rollback()
+			slog.Error("Error inserting receipts", logging.Err(err))
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (holder *sqlStore) RecordDelivered(ctx context.Context, receiverID int, messageKeys []string, at time.Time) ([]persistient.Receipt, error) {
+	if len(messageKeys) == 0 {
+		return nil, nil
+	}
+	where := "receiver_id = ? AND delivered_at IS NULL AND message_key IN (" + placeholders(len(messageKeys)) + ")"
+	args := append([]interface{}{receiverID}, keyArgs(messageKeys)...)
+	return holder.updateReceipts(ctx, "RecordDelivered", "delivered_at = ?", []interface{}{at.UTC()}, where, args)
+}
+
+func (holder *sqlStore) RecordRead(ctx context.Context, query ReadQuery, at time.Time) ([]persistient.Receipt, error) {
+	where := "receiver_id = ? AND read_at IS NULL AND event_id = ?"
+	args := []interface{}{query.UserID, query.EventID}
+	if query.EventID == 0 {
+		where += " AND sender_id = ?"
+		args = append(args, query.PeerID)
+	}
+	if !query.Until.IsZero() {
+		where += " AND created_at <= ?"
+		args = append(args, query.Until.UTC())
+	}
+	return holder.updateReceipts(ctx, "RecordRead", "read_at = ?, delivered_at = COALESCE(delivered_at, ?)",
+		[]interface{}{at.UTC(), at.UTC()}, where, args)
+}
+
+func (holder *sqlStore) FindReceipts(ctx context.Context, senderID int, messageKeys []string) ([]persistient.Receipt, error) {
+	if len(messageKeys) == 0 {
+		return nil, nil
+	}
+	rows, err := holder.db.QueryContext(ctx, holder.rebind("SELECT "+receiptColumns+" FROM receipts WHERE sender_id = ? AND message_key IN ("+
+		placeholders(len(messageKeys))+") ORDER BY message_key, receiver_id"), append([]interface{}{senderID}, keyArgs(messageKeys)...)...)
+	if err != nil {
+		slog.Error("Unable to get result", "query", "FindReceipts", logging.Err(err))
+		return nil, err
+	}
+	defer rows.Close()
+	return scanReceipts(rows)
+}
+
+func (holder *sqlStore) CountReceipts(ctx context.Context, messageKeys []string) ([]ReceiptCount, error) {
+	if len(messageKeys) == 0 {
+		return nil, nil
+	}
+	rows, err := holder.db.QueryContext(ctx, holder.rebind(
+		"SELECT message_key, COUNT(*), COUNT(delivered_at), COUNT(read_at) FROM receipts WHERE message_key IN ("+
+			placeholders(len(messageKeys))+") GROUP BY message_key"), keyArgs(messageKeys)...)
+	if err != nil {
+		slog.Error("Unable to count receipts", logging.Err(err))
+		return nil, err
+	}
+	defer rows.Close()
+	var counts []ReceiptCount
+	for rows.Next() {
+		var count ReceiptCount
+		if err := rows.Scan(&count.MessageKey, &count.Receivers, &count.Delivered, &count.Read); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// updateReceipts updates the receipts and returns them as updated, in one statement so that concurrent updates
+// never both return a receipt. The update must make the receipt leave the condition
+func (holder *sqlStore) updateReceipts(ctx context.Context, name string, set string, setArgs []interface{}, where string,
+	args []interface{}) ([]persistient.Receipt, error) {
+
+	rows, err := holder.db.QueryContext(ctx, holder.rebind("UPDATE receipts SET "+set+" WHERE "+where+" RETURNING "+receiptColumns),
+		append(setArgs, args...)...)
+	if err != nil {
+		slog.Error("Error updating receipts", "query", name, logging.Err(err))
+		return nil, err
+	}
+	defer rows.Close()
+	receipts, err := scanReceipts(rows)
+	if err != nil {
+		slog.Error("Error updating receipts", "query", name, logging.Err(err))
+		return nil, err
+	}
+	return receipts, nil
+}
+
+func scanReceipts(rows *sql.Rows) ([]persistient.Receipt, error) {
+	var receipts []persistient.Receipt
+	for rows.Next() {
+		var receipt persistient.Receipt
+		var deliveredAt, readAt sql.NullTime
+		err := rows.Scan(&receipt.MessageKey, &receipt.SenderID, &receipt.ReceiverID, &receipt.EventID, &receipt.CreatedAt,
+			&deliveredAt, &readAt)
+		if err != nil {
+			return nil, err
+		}
+		receipt.DeliveredAt, receipt.ReadAt = deliveredAt.Time, readAt.Time
+		receipts = append(receipts, receipt)
+	}
+	return receipts, rows.Err()
+}
+
+// conversation returns the condition selecting the chat messages of a direct conversation or an event chat,
+// see inConversation
+func conversation(userID int, peerID int, eventID int64) (string, []interface{}) {
+	if eventID != 0 {
+		return "channel = ? AND event_id = ? AND receiver_id = ?", []interface{}{ChatChannel, eventID, userID}
+	}
+	return "channel = ? AND event_id = 0 AND ((sender_id = ? AND receiver_id = ?) OR (sender_id = ? AND receiver_id = ?))",
+		[]interface{}{ChatChannel, userID, peerID, peerID, userID}
+}
+
+func (holder *sqlStore) find(ctx context.Context, name string, where string, foreach MessageCallback, args ...interface{}) error {
+	return holder.query(ctx, name, where, " ORDER BY id", foreach, args...)
+}
+
+func (holder *sqlStore) query(ctx context.Context, name string, where string, order string, foreach MessageCallback, args ...interface{}) error {
+
+	rows, err := holder.db.QueryContext(ctx, holder.rebind("SELECT "+messageColumns+" FROM messages WHERE "+where+order), args...)
+	if err != nil {
+		slog.Error("Unable to get result", "query", name, logging.Err(err))
+		return err
+	}
+
+	// Rows are read up front so that callbacks may use the store while iterating
+	var messages []persistient.EventMessage
+	var decodeErrors []error
+	for rows.Next() {
+		var message persistient.EventMessage
+		var id int64
+		var body, keyID, traceID, spanID, messageKey sql.NullString
+		err := rows.Scan(&id, &message.Channel, &message.EventID, &message.SenderID, &message.ReceiverID, &message.IsSent, &body,
+			&keyID, &message.WrappedKey, &message.Ciphertext, &traceID, &spanID, &message.CreatedAt, &message.IsRead, &messageKey)
+		if err == nil && body.Valid {
+			err = json.Unmarshal([]byte(body.String), &message.Body)
+		}
+		if err != nil {
+			slog.Error("Unable to decode document", logging.Err(err))
+		}
+		message.ID = id
+		message.KeyID = keyID.String
+		message.TraceID, message.SpanID = traceID.String, spanID.String
+		message.MessageKey = messageKey.String
+		messages = append(messages, message)
+		decodeErrors = append(decodeErrors, err)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		slog.Error("Error while reading query result", logging.Err(err))
+		return err
+	}
+
+	for i, message := range messages {
+		if foreach(message, decodeErrors[i]) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// rebind replaces the ? placeholders of a query with the ones of the dialect
+func (holder *sqlStore) rebind(query string) string {
+	parts := strings.Split(query, "?")
+	rebound := parts[0]
+	for i, part := range parts[1:] {
+		rebound += holder.dialect.placeholder(i+1) + part
+	}
+	return rebound
+}
+
+// placeholders returns the placeholders of a list of n values, for IN conditions
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func keyArgs(messageKeys []string) []interface{} {
+	args := make([]interface{}, len(messageKeys))
+	for i, messageKey := range messageKeys {
+		args[i] = messageKey
+	}
+	return args
+}
+
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
@@ -0,0 +1,147 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"partyfy-message-service/config"
+	"partyfy-message-service/persistient"
+	"time"
+)
+
+const (
+	MongoDriver    = "mongo"
+	PostgresDriver = "postgres"
+	SqliteDriver   = "sqlite"
+	MemoryDriver   = "memory"
+)
+
+// ChatChannel is the channel of the messages clients send each other, the only ones history and read marks cover
+const ChatChannel = "message"
+
+// ErasedBody replaces the body of event chat messages sent by an erased user
+const ErasedBody = "[erased]"
+
+// HistoryQuery selects the chat messages of a user, either the direct conversation with PeerID or the chat
+// of EventID. Before, when set, only returns messages created earlier, Limit caps the number of messages
+type HistoryQuery struct {
+	UserID  int
+	PeerID  int
+	EventID int64
+	Before  time.Time
+	Limit   int
+}
+
+// ReadQuery selects the chat messages received by a user from PeerID or in the chat of EventID.
+// Until, when set, only selects messages created up to that time
+type ReadQuery struct {
+	UserID  int
+	PeerID  int
+	EventID int64
+	Until   time.Time
+}
+
+// UnreadCount is the number of unread chat messages of a user in the chat of EventID, or from SenderID when
+// EventID is 0
+type UnreadCount struct {
+	SenderID int
+	EventID  int64
+	Count    int64
+}
+
+// ReceiptCount sums up the receipts of a client message: how many receivers it has, got it and read it
+type ReceiptCount struct {
+	MessageKey string
+	Receivers  int64
+	Delivered  int64
+	Read       int64
+}
+
+// MessageCallback is called for every message found by a query. Returning an error stops the iteration
+type MessageCallback func(message persistient.EventMessage, err error) error
+
+// Store holds the messages and the audit trail of the service. Every storage backend implements it the same way.
+// Constructors do no I/O, the connection is made by Start
+type Store interface {
+	Start(ctx context.Context) error
+	Close() error
+	Insert(ctx context.Context, messages ...persistient.EventMessage) error
+	FindByReceiverID(ctx context.Context, userID int, foreach MessageCallback) error
+	FindUnsentByReceiverUserID(ctx context.Context, userID int, foreach MessageCallback) error
+	// FindUnsentOrCreatedAfter returns the messages of the user not sent yet or created after the time, oldest first
+	FindUnsentOrCreatedAfter(ctx context.Context, userID int, after time.Time, foreach MessageCallback) error
+	FindMessagesForEvent(ctx context.Context, eventID int64, foreach MessageCallback) error
+	FindByUserID(ctx context.Context, userID int, foreach MessageCallback) error
+	SetMessageSent(ctx context.Context, msgID interface{})
+	// EraseUser deletes every message received by the user and every direct message the user sent.
+	// Messages sent to event chats stay for the other members but lose their sender and body.
+	EraseUser(ctx context.Context, userID int) (deleted int64, anonymized int64, err error)
+	InsertAudit(ctx context.Context, record persistient.AuditRecord) error
+	// FindNotEncryptedWithKey returns plaintext messages and messages encrypted with another master key than keyID
+	FindNotEncryptedWithKey(ctx context.Context, keyID string, foreach MessageCallback) error
+	// UpdateEncryption replaces the body and the encryption fields of a stored message
+	UpdateEncryption(ctx context.Context, message persistient.EventMessage) error
+	// CountUnsent returns the number of messages not delivered to their receiver yet
+	CountUnsent(ctx context.Context) (int64, error)
+	// CountUnsentByReceiverID returns the number of messages waiting for the user
+	CountUnsentByReceiverID(ctx context.Context, userID int) (int64, error)
+	// FindHistory returns the chat messages selected by the query, newest first
+	FindHistory(ctx context.Context, query HistoryQuery, foreach MessageCallback) error
+	// MarkRead marks the selected chat messages as read and returns how many were not read yet
+	MarkRead(ctx context.Context, query ReadQuery) (int64, error)
+	// CountUnread returns the unread chat messages of the user per event chat and per direct sender.
+	// Messages the user sent are never unread
+	CountUnread(ctx context.Context, userID int) ([]UnreadCount, error)
+	// SetOnline adds the replica to the ones the user is connected to. The user comes online, since now, with the first one
+	SetOnline(ctx context.Context, userID int, replica string, now time.Time) error
+	// SetOffline removes the replica from the ones the user is connected to. The user goes offline, last seen at lastSeen,
+	// when it was the last one
+	SetOffline(ctx context.Context, userID int, replica string, lastSeen, now time.Time) error
+	// TouchPresence refreshes the last seen time of the users connected to the replica
+	TouchPresence(ctx context.Context, replica string, now time.Time) error
+	// SetPresenceHidden records whether the user hides their presence from the others
+	SetPresenceHidden(ctx context.Context, userID int, hidden bool, now time.Time) error
+	// FindPresence returns the presence of the users, the ones never seen are left out
+	FindPresence(ctx context.Context, userIDs []int) ([]persistient.Presence, error)
+	// FindPresenceChanges returns the presences updated after the time
+	FindPresenceChanges(ctx context.Context, after time.Time) ([]persistient.Presence, error)
+	// ExpectReceipts records the receivers of client messages before the messages are routed, receipts are only
+	// recorded for them
+	ExpectReceipts(ctx context.Context, receipts ...persistient.Receipt) error
+	// RecordDelivered records that the receiver got the messages and returns the receipts that were not delivered yet
+	RecordDelivered(ctx context.Context, receiverID int, messageKeys []string, at time.Time) ([]persistient.Receipt, error)
+	// RecordRead records that the receiver read the messages selected by the query and returns the receipts that were
+	// not read yet. Messages read are delivered too
+	RecordRead(ctx context.Context, query ReadQuery, at time.Time) ([]persistient.Receipt, error)
+	// FindReceipts returns the receipts of the messages the sender sent
+	FindReceipts(ctx context.Context, senderID int, messageKeys []string) ([]persistient.Receipt, error)
+	// CountReceipts sums up the receipts of every message
+	CountReceipts(ctx context.Context, messageKeys []string) ([]ReceiptCount, error)
+	// Ping checks the backend can be reached, for the readiness check
+	Ping(ctx context.Context) error
+}
+
+// NewStore creates the backend selected by the driver, with metrics, and adds body encryption on top of it when enabled
+func NewStore(storageConfig config.Storage) (Store, error) {
+	backend, err := newBackend(storageConfig)
+	if err != nil {
+		return nil, err
+	}
+	backend = newInstrumentedStore(backend, storageConfig.Driver)
+	if !storageConfig.Encryption.Enabled {
+		return backend, nil
+	}
+	return newEncryptedStore(backend, storageConfig.Encryption), nil
+}
+
+func newBackend(storageConfig config.Storage) (Store, error) {
+	switch storageConfig.Driver {
+	case MongoDriver, "":
+		return newMongoStore(storageConfig)
+	case PostgresDriver, SqliteDriver:
+		return newSqlStore(storageConfig)
+	case MemoryDriver:
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", storageConfig.Driver)
+	}
+}
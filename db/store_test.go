@@ -0,0 +1,552 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"partyfy-message-service/config"
+	"partyfy-message-service/persistient"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The suite runs against every backend. Postgres and Mongo are only tested when a server is given through
+// PARTYFY_TEST_POSTGRES_URI or PARTYFY_TEST_MONGO_URI, memory and SQLite always run
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, func() Store {
+		return startStore(t, config.Storage{Driver: MemoryDriver})
+	})
+}
+
+func TestSqliteStore(t *testing.T) {
+	testStore(t, func() Store {
+		return startStore(t, config.Storage{Driver: SqliteDriver, Uri: filepath.Join(t.TempDir(), "messages.db")})
+	})
+}
+
+func TestPostgresStore(t *testing.T) {
+	uri := os.Getenv("PARTYFY_TEST_POSTGRES_URI")
+	if uri == "" {
+		t.Skip("PARTYFY_TEST_POSTGRES_URI is not set")
+	}
+	testStore(t, func() Store {
+		store := startStore(t, config.Storage{Driver: PostgresDriver, Uri: uri})
+		// The tests share the database, each starts from empty tables
+		for _, table := range []string{"messages", "audit", "presence_replicas", "presence", "receipts"} {
+			if _, err := store.(*sqlStore).db.Exec("DELETE FROM " + table); err != nil {
+				t.Fatalf("unable to empty %s: %v", table, err)
+			}
+		}
+		return store
+	})
+}
+
+func TestMongoStore(t *testing.T) {
+	uri := os.Getenv("PARTYFY_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("PARTYFY_TEST_MONGO_URI is not set")
+	}
+	testStore(t, func() Store {
+		database := fmt.Sprintf("partyfy_test_%d", time.Now().UnixNano())
+		store := startStore(t, config.Storage{Driver: MongoDriver, Uri: uri, Database: database})
+		t.Cleanup(func() {
+			_ = store.(*mongoStore).messages.Database().Drop(context.Background())
+		})
+		return store
+	})
+}
+
+// startStore creates the backend alone, without metrics or encryption, and closes it at the end of the test
+func startStore(t *testing.T, storageConfig config.Storage) Store {
+	store, err := newBackend(storageConfig)
+	if err != nil {
+		t.Fatalf("unable to create the %s store: %v", storageConfig.Driver, err)
+	}
+	if err := store.Start(context.Background()); err != nil {
+		t.Fatalf("unable to start the %s store: %v", storageConfig.Driver, err)
+	}
+	t.Cleanup(func() { _ = store.Close() })
+	return store
+}
+
+// testStore checks the behaviour every backend shares, each case gets a new empty store
+func testStore(t *testing.T, newStore func() Store) {
+	cases := []struct {
+		name string
+		test func(t *testing.T, store Store)
+	}{
+		{"unsent", testUnsent},
+		{"unsent or created after", testUnsentOrCreatedAfter},
+		{"find by user and event", testFindByUserAndEvent},
+		{"erase user", testEraseUser},
+		{"encryption", testEncryption},
+		{"audit", testAudit},
+		{"history", testHistory},
+		{"read marks", testReadMarks},
+		{"presence", testPresence},
+		{"presence on several replicas", testPresenceReplicas},
+		{"receipts", testReceipts},
+		{"concurrent receipts", testConcurrentReceipts},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.test(t, newStore())
+		})
+	}
+}
+
+// at returns a time of the tests, in milliseconds since every backend keeps that precision
+func at(offset time.Duration) time.Time {
+	return time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC).Add(offset)
+}
+
+func chat(senderID int, receiverID int, eventID int64, body string, createdAt time.Time) persistient.EventMessage {
+	return persistient.EventMessage{Channel: ChatChannel, SenderID: senderID, ReceiverID: receiverID, EventID: eventID, Body: body, CreatedAt: createdAt}
+}
+
+func insert(t *testing.T, store Store, messages ...persistient.EventMessage) {
+	t.Helper()
+	if err := store.Insert(context.Background(), messages...); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+}
+
+// collect runs a find and returns the messages it passed to the callback
+func collect(t *testing.T, find func(foreach MessageCallback) error) []persistient.EventMessage {
+	t.Helper()
+	var found []persistient.EventMessage
+	err := find(func(message persistient.EventMessage, err error) error {
+		if err != nil {
+			t.Errorf("decoding %v: %v", message.ID, err)
+		}
+		found = append(found, message)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("find: %v", err)
+	}
+	return found
+}
+
+// bodies returns the bodies of the messages in order
+func bodies(messages []persistient.EventMessage) []string {
+	found := make([]string, 0, len(messages))
+	for _, message := range messages {
+		found = append(found, fmt.Sprint(message.Body))
+	}
+	return found
+}
+
+func sortedBodies(messages []persistient.EventMessage) []string {
+	found := bodies(messages)
+	sort.Strings(found)
+	return found
+}
+
+func expectBodies(t *testing.T, what string, got []string, want ...string) {
+	t.Helper()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("%s: got %v, want %v", what, got, want)
+	}
+}
+
+func expectCount(t *testing.T, what string, got int64, err error, want int64) {
+	t.Helper()
+	if err != nil {
+		t.Fatalf("%s: %v", what, err)
+	}
+	if got != want {
+		t.Errorf("%s: got %d, want %d", what, got, want)
+	}
+}
+
+func testUnsent(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "a", at(0)), chat(1, 2, 0, "b", at(time.Second)), chat(2, 1, 0, "c", at(2*time.Second)))
+
+	unsent := collect(t, func(foreach MessageCallback) error { return store.FindUnsentByReceiverUserID(ctx, 2, foreach) })
+	expectBodies(t, "unsent of 2", sortedBodies(unsent), "a", "b")
+	count, err := store.CountUnsent(ctx)
+	expectCount(t, "CountUnsent", count, err, 3)
+
+	store.SetMessageSent(ctx, unsent[0].ID)
+	count, err = store.CountUnsentByReceiverID(ctx, 2)
+	expectCount(t, "CountUnsentByReceiverID", count, err, 1)
+	unsent = collect(t, func(foreach MessageCallback) error { return store.FindUnsentByReceiverUserID(ctx, 2, foreach) })
+	if len(unsent) != 1 {
+		t.Fatalf("unsent of 2 after SetMessageSent: got %v", bodies(unsent))
+	}
+	received := collect(t, func(foreach MessageCallback) error { return store.FindByReceiverID(ctx, 2, foreach) })
+	expectBodies(t, "received by 2", sortedBodies(received), "a", "b")
+}
+
+func testUnsentOrCreatedAfter(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "old sent", at(0)), chat(1, 2, 0, "old unsent", at(time.Second)),
+		chat(1, 2, 0, "new", at(3*time.Second)), chat(1, 3, 0, "other", at(4*time.Second)))
+	sent := collect(t, func(foreach MessageCallback) error { return store.FindByReceiverID(ctx, 2, foreach) })
+	for _, message := range sent {
+		if message.Body == "old sent" || message.Body == "new" {
+			store.SetMessageSent(ctx, message.ID)
+		}
+	}
+
+	found := collect(t, func(foreach MessageCallback) error {
+		return store.FindUnsentOrCreatedAfter(ctx, 2, at(2*time.Second), foreach)
+	})
+	expectBodies(t, "unsent or created after, oldest first", bodies(found), "old unsent", "new")
+	if len(found) == 2 && !found[0].CreatedAt.Equal(at(time.Second)) {
+		t.Errorf("creation time not kept: got %v, want %v", found[0].CreatedAt, at(time.Second))
+	}
+}
+
+func testFindByUserAndEvent(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "direct", at(0)), chat(3, 1, 7, "event to 1", at(time.Second)),
+		chat(3, 2, 7, "event to 2", at(2*time.Second)), chat(2, 3, 0, "unrelated", at(3*time.Second)))
+
+	byUser := collect(t, func(foreach MessageCallback) error { return store.FindByUserID(ctx, 1, foreach) })
+	expectBodies(t, "messages of 1", sortedBodies(byUser), "direct", "event to 1")
+	byEvent := collect(t, func(foreach MessageCallback) error { return store.FindMessagesForEvent(ctx, 7, foreach) })
+	expectBodies(t, "messages of event 7", sortedBodies(byEvent), "event to 1", "event to 2")
+
+	// Returning an error from the callback stops the iteration without failing the find
+	var visited int
+	err := store.FindByUserID(ctx, 1, func(message persistient.EventMessage, err error) error {
+		visited++
+		return fmt.Errorf("stop")
+	})
+	if err != nil || visited != 1 {
+		t.Errorf("stopping early: visited %d, err %v", visited, err)
+	}
+}
+
+func testEraseUser(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "direct from 1", at(0)), chat(2, 1, 0, "direct to 1", at(time.Second)),
+		chat(1, 2, 7, "event from 1", at(2*time.Second)), chat(2, 3, 0, "kept", at(3*time.Second)))
+	if err := store.SetOnline(ctx, 1, "replica-a", at(0)); err != nil {
+		t.Fatalf("SetOnline: %v", err)
+	}
+	if err := store.ExpectReceipts(ctx, persistient.Receipt{MessageKey: "k", SenderID: 1, ReceiverID: 2, CreatedAt: at(0)}); err != nil {
+		t.Fatalf("ExpectReceipts: %v", err)
+	}
+
+	deleted, anonymized, err := store.EraseUser(ctx, 1)
+	if err != nil {
+		t.Fatalf("EraseUser: %v", err)
+	}
+	if deleted != 2 || anonymized != 1 {
+		t.Errorf("EraseUser: deleted %d, anonymized %d, want 2 and 1", deleted, anonymized)
+	}
+
+	left := collect(t, func(foreach MessageCallback) error { return store.FindByReceiverID(ctx, 2, foreach) })
+	expectBodies(t, "messages left for 2", sortedBodies(left), ErasedBody)
+	if len(left) == 1 && left[0].SenderID != 0 {
+		t.Errorf("anonymized message still has sender %d", left[0].SenderID)
+	}
+	byUser := collect(t, func(foreach MessageCallback) error { return store.FindByUserID(ctx, 1, foreach) })
+	if len(byUser) != 0 {
+		t.Errorf("messages of the erased user: %v", bodies(byUser))
+	}
+	presence, err := store.FindPresence(ctx, []int{1})
+	if err != nil || len(presence) != 0 {
+		t.Errorf("presence of the erased user: %v, %v", presence, err)
+	}
+	receipts, err := store.FindReceipts(ctx, 1, []string{"k"})
+	if err != nil || len(receipts) != 0 {
+		t.Errorf("receipts of the erased user: %v, %v", receipts, err)
+	}
+}
+
+func testEncryption(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "plain", at(0)))
+
+	plain := collect(t, func(foreach MessageCallback) error { return store.FindNotEncryptedWithKey(ctx, "key-1", foreach) })
+	if len(plain) != 1 {
+		t.Fatalf("not encrypted with key-1: got %v", bodies(plain))
+	}
+	message := plain[0]
+	message.Body, message.KeyID, message.WrappedKey, message.Ciphertext = nil, "key-1", []byte{1, 2}, []byte{3, 4}
+	if err := store.UpdateEncryption(ctx, message); err != nil {
+		t.Fatalf("UpdateEncryption: %v", err)
+	}
+
+	plain = collect(t, func(foreach MessageCallback) error { return store.FindNotEncryptedWithKey(ctx, "key-1", foreach) })
+	if len(plain) != 0 {
+		t.Errorf("still not encrypted with key-1: %v", bodies(plain))
+	}
+	stored := collect(t, func(foreach MessageCallback) error { return store.FindByReceiverID(ctx, 2, foreach) })
+	if len(stored) != 1 || stored[0].KeyID != "key-1" || string(stored[0].Ciphertext) != string([]byte{3, 4}) ||
+		string(stored[0].WrappedKey) != string([]byte{1, 2}) {
+		t.Errorf("encrypted message not stored: %+v", stored)
+	}
+}
+
+func testAudit(t *testing.T, store Store) {
+	record := persistient.AuditRecord{Action: "erase", UserID: 1, Requester: "admin", Deleted: 2, Anonymized: 1, Time: at(0)}
+	if err := store.InsertAudit(context.Background(), record); err != nil {
+		t.Errorf("InsertAudit: %v", err)
+	}
+}
+
+func testHistory(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(1, 2, 0, "1", at(0)), chat(2, 1, 0, "2", at(time.Second)), chat(1, 2, 0, "3", at(2*time.Second)),
+		chat(1, 3, 0, "other peer", at(3*time.Second)), chat(3, 1, 7, "event", at(4*time.Second)),
+		chat(3, 2, 7, "event to 2", at(5*time.Second)))
+	signal := chat(1, 2, 0, "signal", at(6*time.Second))
+	signal.Channel = "event-updated"
+	insert(t, store, signal)
+
+	history := func(query HistoryQuery) []string {
+		return bodies(collect(t, func(foreach MessageCallback) error { return store.FindHistory(ctx, query, foreach) }))
+	}
+	expectBodies(t, "direct history, newest first", history(HistoryQuery{UserID: 1, PeerID: 2}), "3", "2", "1")
+	expectBodies(t, "same history from the peer", history(HistoryQuery{UserID: 2, PeerID: 1}), "3", "2", "1")
+	expectBodies(t, "history before", history(HistoryQuery{UserID: 1, PeerID: 2, Before: at(2 * time.Second)}), "2", "1")
+	expectBodies(t, "history limit", history(HistoryQuery{UserID: 1, PeerID: 2, Limit: 2}), "3", "2")
+	expectBodies(t, "event history of the receiver", history(HistoryQuery{UserID: 1, EventID: 7}), "event")
+}
+
+func testReadMarks(t *testing.T, store Store) {
+	ctx := context.Background()
+	insert(t, store, chat(2, 1, 0, "a", at(0)), chat(2, 1, 0, "b", at(time.Second)), chat(3, 1, 0, "c", at(2*time.Second)),
+		chat(3, 1, 7, "d", at(3*time.Second)), chat(1, 2, 0, "own", at(4*time.Second)))
+
+	counts, err := store.CountUnread(ctx, 1)
+	if err != nil {
+		t.Fatalf("CountUnread: %v", err)
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		return counts[i].EventID < counts[j].EventID || (counts[i].EventID == counts[j].EventID && counts[i].SenderID < counts[j].SenderID)
+	})
+	want := []UnreadCount{{SenderID: 2, Count: 2}, {SenderID: 3, Count: 1}, {EventID: 7, Count: 1}}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("CountUnread: got %v, want %v", counts, want)
+	}
+
+	updated, err := store.MarkRead(ctx, ReadQuery{UserID: 1, PeerID: 2, Until: at(0)})
+	expectCount(t, "MarkRead until", updated, err, 1)
+	updated, err = store.MarkRead(ctx, ReadQuery{UserID: 1, PeerID: 2})
+	expectCount(t, "MarkRead the rest", updated, err, 1)
+	updated, err = store.MarkRead(ctx, ReadQuery{UserID: 1, EventID: 7})
+	expectCount(t, "MarkRead event", updated, err, 1)
+
+	counts, err = store.CountUnread(ctx, 1)
+	if err != nil {
+		t.Fatalf("CountUnread: %v", err)
+	}
+	want = []UnreadCount{{SenderID: 3, Count: 1}}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("CountUnread after MarkRead: got %v, want %v", counts, want)
+	}
+}
+
+func testPresence(t *testing.T, store Store) {
+	ctx := context.Background()
+	if err := store.SetOnline(ctx, 1, "replica-a", at(0)); err != nil {
+		t.Fatalf("SetOnline: %v", err)
+	}
+	if err := store.SetOnline(ctx, 2, "replica-b", at(0)); err != nil {
+		t.Fatalf("SetOnline: %v", err)
+	}
+	if err := store.TouchPresence(ctx, "replica-a", at(time.Minute)); err != nil {
+		t.Fatalf("TouchPresence: %v", err)
+	}
+
+	found, err := store.FindPresence(ctx, []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("FindPresence: %v", err)
+	}
+	byUser := make(map[int]persistient.Presence)
+	for _, presence := range found {
+		byUser[presence.UserID] = presence
+	}
+	if len(found) != 2 || !byUser[1].Online || !byUser[2].Online {
+		t.Fatalf("FindPresence: got %+v", found)
+	}
+	if !byUser[1].LastSeen.Equal(at(time.Minute)) || !byUser[2].LastSeen.Equal(at(0)) {
+		t.Errorf("TouchPresence only refreshes the users of the replica: %+v", found)
+	}
+
+	if err := store.SetOffline(ctx, 1, "replica-b", at(2*time.Minute), at(2*time.Minute)); err != nil {
+		t.Fatalf("SetOffline: %v", err)
+	}
+	if err := store.SetOffline(ctx, 2, "replica-b", at(2*time.Minute), at(2*time.Minute)); err != nil {
+		t.Fatalf("SetOffline: %v", err)
+	}
+	if err := store.SetPresenceHidden(ctx, 3, true, at(3*time.Minute)); err != nil {
+		t.Fatalf("SetPresenceHidden: %v", err)
+	}
+
+	changed, err := store.FindPresenceChanges(ctx, at(time.Minute))
+	if err != nil {
+		t.Fatalf("FindPresenceChanges: %v", err)
+	}
+	byUser = make(map[int]persistient.Presence)
+	for _, presence := range changed {
+		byUser[presence.UserID] = presence
+	}
+	if _, seen := byUser[1]; seen || len(changed) != 2 {
+		t.Fatalf("FindPresenceChanges: got %+v, want users 2 and 3", changed)
+	}
+	if byUser[2].Online || !byUser[2].LastSeen.Equal(at(2*time.Minute)) {
+		t.Errorf("user 2 not taken offline by its replica: %+v", byUser[2])
+	}
+	if !byUser[3].Hidden || byUser[3].Online {
+		t.Errorf("hidden user 3: %+v", byUser[3])
+	}
+}
+
+func testPresenceReplicas(t *testing.T, store Store) {
+	ctx := context.Background()
+	find := func() persistient.Presence {
+		t.Helper()
+		found, err := store.FindPresence(ctx, []int{1})
+		if err != nil || len(found) != 1 {
+			t.Fatalf("FindPresence: got %+v, %v", found, err)
+		}
+		return found[0]
+	}
+	for _, replica := range []string{"replica-a", "replica-b", "replica-a"} {
+		if err := store.SetOnline(ctx, 1, replica, at(time.Minute)); err != nil {
+			t.Fatalf("SetOnline: %v", err)
+		}
+	}
+	if err := store.SetOnline(ctx, 1, "replica-b", at(2*time.Minute)); err != nil {
+		t.Fatalf("SetOnline: %v", err)
+	}
+	presence := find()
+	sort.Strings(presence.Replicas)
+	if !presence.Online || fmt.Sprint(presence.Replicas) != "[replica-a replica-b]" {
+		t.Fatalf("online on two replicas: got %+v", presence)
+	}
+	if !presence.Since.Equal(at(time.Minute)) || !presence.UpdatedAt.Equal(at(time.Minute)) {
+		t.Errorf("another replica changed since or updatedAt of an online user: %+v", presence)
+	}
+
+	if err := store.SetOffline(ctx, 1, "replica-a", at(3*time.Minute), at(3*time.Minute)); err != nil {
+		t.Fatalf("SetOffline: %v", err)
+	}
+	if presence = find(); !presence.Online || fmt.Sprint(presence.Replicas) != "[replica-b]" {
+		t.Fatalf("offline on one of two replicas: got %+v", presence)
+	}
+	if err := store.TouchPresence(ctx, "replica-a", at(4*time.Minute)); err != nil {
+		t.Fatalf("TouchPresence: %v", err)
+	}
+	if presence = find(); !presence.LastSeen.Equal(at(2 * time.Minute)) {
+		t.Errorf("a replica the user left refreshed last seen: %+v", presence)
+	}
+
+	if err := store.SetOffline(ctx, 1, "replica-b", at(5*time.Minute), at(6*time.Minute)); err != nil {
+		t.Fatalf("SetOffline: %v", err)
+	}
+	presence = find()
+	if presence.Online || len(presence.Replicas) != 0 || !presence.LastSeen.Equal(at(5*time.Minute)) ||
+		!presence.UpdatedAt.Equal(at(6*time.Minute)) {
+		t.Errorf("offline on the last replica: got %+v", presence)
+	}
+	if err := store.SetOffline(ctx, 1, "replica-b", at(7*time.Minute), at(7*time.Minute)); err != nil {
+		t.Fatalf("SetOffline: %v", err)
+	}
+	if presence = find(); !presence.UpdatedAt.Equal(at(6 * time.Minute)) {
+		t.Errorf("a replica the user already left changed the record: %+v", presence)
+	}
+}
+
+func testReceipts(t *testing.T, store Store) {
+	ctx := context.Background()
+	err := store.ExpectReceipts(ctx,
+		persistient.Receipt{MessageKey: "direct", SenderID: 1, ReceiverID: 2, CreatedAt: at(0)},
+		persistient.Receipt{MessageKey: "event", SenderID: 1, ReceiverID: 2, EventID: 7, CreatedAt: at(time.Second)},
+		persistient.Receipt{MessageKey: "event", SenderID: 1, ReceiverID: 3, EventID: 7, CreatedAt: at(time.Second)})
+	if err != nil {
+		t.Fatalf("ExpectReceipts: %v", err)
+	}
+
+	delivered, err := store.RecordDelivered(ctx, 2, []string{"direct", "event", "unknown"}, at(time.Minute))
+	if err != nil || len(delivered) != 2 {
+		t.Fatalf("RecordDelivered: got %+v, %v", delivered, err)
+	}
+	delivered, err = store.RecordDelivered(ctx, 2, []string{"direct"}, at(2*time.Minute))
+	if err != nil || len(delivered) != 0 {
+		t.Errorf("RecordDelivered twice returns the receipt again: %+v, %v", delivered, err)
+	}
+
+	read, err := store.RecordRead(ctx, ReadQuery{UserID: 3, EventID: 7}, at(3*time.Minute))
+	if err != nil || len(read) != 1 || read[0].MessageKey != "event" {
+		t.Fatalf("RecordRead: got %+v, %v", read, err)
+	}
+	if !read[0].DeliveredAt.Equal(at(3*time.Minute)) || !read[0].ReadAt.Equal(at(3*time.Minute)) {
+		t.Errorf("a read message is delivered too: %+v", read[0])
+	}
+	read, err = store.RecordRead(ctx, ReadQuery{UserID: 2, PeerID: 1, Until: at(-time.Second)}, at(3*time.Minute))
+	if err != nil || len(read) != 0 {
+		t.Errorf("RecordRead until before the message: %+v, %v", read, err)
+	}
+
+	found, err := store.FindReceipts(ctx, 1, []string{"event"})
+	if err != nil || len(found) != 2 {
+		t.Fatalf("FindReceipts: got %+v, %v", found, err)
+	}
+	if others, err := store.FindReceipts(ctx, 2, []string{"event"}); err != nil || len(others) != 0 {
+		t.Errorf("FindReceipts of another sender: %+v, %v", others, err)
+	}
+
+	counts, err := store.CountReceipts(ctx, []string{"direct", "event"})
+	if err != nil {
+		t.Fatalf("CountReceipts: %v", err)
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].MessageKey < counts[j].MessageKey })
+	want := []ReceiptCount{{MessageKey: "direct", Receivers: 1, Delivered: 1}, {MessageKey: "event", Receivers: 2, Delivered: 2, Read: 1}}
+	if fmt.Sprint(counts) != fmt.Sprint(want) {
+		t.Errorf("CountReceipts: got %v, want %v", counts, want)
+	}
+}
+
+// testConcurrentReceipts records the same receipts delivered from several goroutines, each one is returned once
+func testConcurrentReceipts(t *testing.T, store Store) {
+	ctx := context.Background()
+	const receivers, callers = 20, 4
+	keys := make([]string, 0, receivers)
+	for receiverID := 1; receiverID <= receivers; receiverID++ {
+		key := fmt.Sprintf("key-%d", receiverID)
+		keys = append(keys, key)
+		if err := store.ExpectReceipts(ctx, persistient.Receipt{MessageKey: key, SenderID: 100, ReceiverID: 7, CreatedAt: at(0)}); err != nil {
+			t.Fatalf("ExpectReceipts: %v", err)
+		}
+	}
+
+	var mutex sync.Mutex
+	var wait sync.WaitGroup
+	returned := make(map[string]int)
+	for caller := 0; caller < callers; caller++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			delivered, err := store.RecordDelivered(ctx, 7, keys, at(time.Minute))
+			if err != nil {
+				t.Errorf("RecordDelivered: %v", err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, receipt := range delivered {
+				returned[receipt.MessageKey]++
+			}
+		}()
+	}
+	wait.Wait()
+
+	for _, key := range keys {
+		if returned[key] != 1 {
+			t.Errorf("receipt %s returned %d times, want once", key, returned[key])
+		}
+	}
+}
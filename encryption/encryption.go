@@ -0,0 +1,162 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"partyfy-message-service/config"
+)
+
+const dataKeySize = 32
+
+// Keyring holds the master keys by their ID. New data keys are always wrapped with the active one,
+// the others are kept to open documents written before a rotation
+type Keyring struct {
+	activeID string
+	keys     map[string][]byte
+}
+
+// Sealed is a value encrypted with its own data key. The data key is stored wrapped by the master key KeyID
+type Sealed struct {
+	KeyID      string
+	WrappedKey []byte
+	Ciphertext []byte
+}
+
+// LoadKeyring reads the master keys from the key file or, when no file is set, from the environment variable.
+// Both hold a JSON object mapping key IDs to base64 encoded 256 bit keys
+func LoadKeyring(encryptionConfig config.Encryption) (*Keyring, error) {
+
+	var raw []byte
+	var err error
+	switch {
+	case encryptionConfig.KeyFile != "":
+		raw, err = ioutil.ReadFile(encryptionConfig.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read key file: %v", err)
+		}
+	case encryptionConfig.KeyEnv != "":
+		raw = []byte(os.Getenv(encryptionConfig.KeyEnv))
+		if len(raw) == 0 {
+			return nil, fmt.Errorf("environment variable %s is empty", encryptionConfig.KeyEnv)
+		}
+	default:
+		return nil, errors.New("neither key_file nor key_env is set")
+	}
+
+	var encodedKeys map[string]string
+	if err = json.Unmarshal(raw, &encodedKeys); err != nil {
+		return nil, fmt.Errorf("unable to decode master keys: %v", err)
+	}
+
+	keyring := &Keyring{activeID: encryptionConfig.ActiveKeyID, keys: make(map[string][]byte, len(encodedKeys))}
+	for keyID, encodedKey := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("master key %s is not valid base64: %v", keyID, err)
+		}
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("master key %s must be %d bytes long", keyID, dataKeySize)
+		}
+		keyring.keys[keyID] = key
+		if encryptionConfig.ActiveKeyID == "" && len(encodedKeys) == 1 {
+			keyring.activeID = keyID
+		}
+	}
+	if keyring.keys[keyring.activeID] == nil {
+		return nil, fmt.Errorf("active master key %q is not in the keyring", keyring.activeID)
+	}
+	return keyring, nil
+}
+
+func (keyring *Keyring) ActiveKeyID() string {
+	return keyring.activeID
+}
+
+// Seal encrypts the plaintext with a fresh data key and wraps that key with the active master key
+func (keyring *Keyring) Seal(plaintext []byte) (Sealed, error) {
+
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return Sealed{}, err
+	}
+	ciphertext, err := seal(dataKey, plaintext)
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrappedKey, err := seal(keyring.keys[keyring.activeID], dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+	return Sealed{KeyID: keyring.activeID, WrappedKey: wrappedKey, Ciphertext: ciphertext}, nil
+}
+
+// Open unwraps the data key of the sealed value and decrypts it
+func (keyring *Keyring) Open(sealed Sealed) ([]byte, error) {
+	dataKey, err := keyring.unwrap(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataKey, sealed.Ciphertext)
+}
+
+// Rewrap wraps the data key of the sealed value with the active master key. The ciphertext is left untouched
+func (keyring *Keyring) Rewrap(sealed Sealed) (Sealed, error) {
+	dataKey, err := keyring.unwrap(sealed)
+	if err != nil {
+		return Sealed{}, err
+	}
+	wrappedKey, err := seal(keyring.keys[keyring.activeID], dataKey)
+	if err != nil {
+		return Sealed{}, err
+	}
+	return Sealed{KeyID: keyring.activeID, WrappedKey: wrappedKey, Ciphertext: sealed.Ciphertext}, nil
+}
+
+func (keyring *Keyring) unwrap(sealed Sealed) ([]byte, error) {
+	masterKey := keyring.keys[sealed.KeyID]
+	if masterKey == nil {
+		return nil, fmt.Errorf("unknown master key %q", sealed.KeyID)
+	}
+	return open(masterKey, sealed.WrappedKey)
+}
+
+// seal encrypts with AES-GCM and prepends the random nonce to the result
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,103 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	LivenessPath  = "/healthz"
+	ReadinessPath = "/readyz"
+	checkTimeout  = 2 * time.Second
+)
+
+// Check probes one dependency. The service is not ready while a critical check fails,
+// a failing non-critical check is only reported
+type Check struct {
+	Name     string
+	Critical bool
+	Probe    func(ctx context.Context) error
+}
+
+// Result is the outcome of a check as written in the readiness body
+type Result struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"` //'up' or 'down'
+	Critical   bool   `json:"critical"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// Report is the readiness body. Status is 'ready' or 'not_ready'
+type Report struct {
+	Status string   `json:"status"`
+	Checks []Result `json:"checks"`
+}
+
+// LivenessHandler answers as long as the process serves HTTP, dependencies are not checked
+func LivenessHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"alive"}`))
+	})
+}
+
+// ReadinessHandler runs every check concurrently and answers 503 when a critical one fails
+func ReadinessHandler(checks ...Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := Run(r.Context(), checks...)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if report.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(report)
+	})
+}
+
+// Run probes the dependencies, each one with its own timeout
+func Run(ctx context.Context, checks ...Check) Report {
+	results := make([]Result, len(checks))
+	var waitGroup sync.WaitGroup
+	for i, check := range checks {
+		waitGroup.Add(1)
+		go func(i int, check Check) {
+			defer waitGroup.Done()
+			results[i] = run(ctx, check)
+		}(i, check)
+	}
+	waitGroup.Wait()
+
+	report := Report{Status: "ready", Checks: results}
+	for _, result := range results {
+		if result.Critical && result.Status != "up" {
+			report.Status = "not_ready"
+		}
+	}
+	return report
+}
+
+func run(ctx context.Context, check Check) Result {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() { done <- check.Probe(ctx) }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	result := Result{Name: check.Name, Status: "up", Critical: check.Critical, DurationMs: time.Since(start).Milliseconds()}
+	if err != nil {
+		result.Status = "down"
+		result.Error = err.Error()
+	}
+	return result
+}
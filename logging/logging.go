@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"log/slog"
+	"net/url"
+	"os"
+	"partyfy-message-service/config"
+	"strings"
+	"sync/atomic"
+)
+
+// Field names shared by every log line so a connection, a message or a Kafka record can be followed across components
+const (
+	UserID       = "user_id"
+	ConnectionID = "connection_id"
+	EventID      = "event_id"
+	MessageID    = "message_id"
+	Topic        = "topic"
+	Partition    = "partition"
+	Offset       = "offset"
+	TraceID      = "trace_id"
+	Error        = "error"
+)
+
+const redacted = "[redacted]"
+
+// secretKeys are never written, whatever the configuration
+var secretKeys = map[string]bool{"token": true, "password": true, "secret": true, "authorization": true}
+
+// uriKeys keep the URI but lose its password
+var uriKeys = map[string]bool{"uri": true, "url": true}
+
+// bodyKeys hold message contents, written only when Logging.log_bodies is set
+var bodyKeys = map[string]bool{"body": true, "payload": true}
+
+var (
+	level      = new(slog.LevelVar)
+	logBodies  atomic.Bool
+	lastFormat atomic.Value
+)
+
+// Setup makes the configured logger the default of slog and of the standard log package
+func Setup(loggingConfig config.Logging) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(loggingConfig.Level)); err == nil {
+		level.Set(parsed)
+	}
+	logBodies.Store(loggingConfig.LogBodies)
+	if lastFormat.Load() == loggingConfig.Format {
+		return
+	}
+	lastFormat.Store(loggingConfig.Format)
+
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var handler slog.Handler
+	if loggingConfig.Format == "logfmt" {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// ApplyConfig switches the level, the format and the body redaction without a restart
+func ApplyConfig(previous config.GlobalConfig, current config.GlobalConfig) {
+	if previous.ConnectionsConfig.Logging == current.ConnectionsConfig.Logging {
+		return
+	}
+	Setup(current.ConnectionsConfig.Logging)
+	loggingConfig := current.ConnectionsConfig.Logging
+	slog.Info("Logging settings changed", "log_level", loggingConfig.Level, "log_format", loggingConfig.Format, "log_bodies", loggingConfig.LogBodies)
+}
+
+// Err is the attribute every failure is logged with
+func Err(err error) slog.Attr {
+	return slog.Any(Error, err)
+}
+
+// redactURI hides the password of the URI and the values of query parameters named like secrets
+func redactURI(raw string) string {
+	parsed, err := url.Parse(raw)
+	if err == nil && parsed.RawQuery != "" {
+		query := parsed.Query()
+		for name := range query {
+			if secretKeys[strings.ToLower(name)] {
+				query.Set(name, redacted)
+			}
+		}
+		parsed.RawQuery = query.Encode()
+		raw = parsed.String()
+	}
+	return config.RedactURI(raw)
+}
+
+func redact(groups []string, attr slog.Attr) slog.Attr {
+	key := strings.ToLower(attr.Key)
+	switch {
+	case secretKeys[key]:
+		return slog.String(attr.Key, redacted)
+	case uriKeys[key]:
+		return slog.String(attr.Key, redactURI(attr.Value.String()))
+	case bodyKeys[key] && !logBodies.Load():
+		return slog.String(attr.Key, redacted)
+	}
+	return attr
+}
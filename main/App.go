@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/db"
+	"partyfy-message-service/health"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/queue"
+	"partyfy-message-service/rest"
+	"partyfy-message-service/room"
+	"partyfy-message-service/tracing"
+)
+
+// component is a part of the application started and stopped by App
+type component interface {
+	Start(ctx context.Context) error
+	Close() error
+}
+
+// App wires the components together. Nothing connects anywhere before Start
+type App struct {
+	config     *config.Holder
+	store      db.Store
+	events     *rest.Client
+	room       *room.Room
+	consumer   *queue.Consumer
+	components []component
+	started    int
+}
+
+func NewApp(configHolder *config.Holder) (*App, error) {
+
+	connectionsConfig := configHolder.Get().ConnectionsConfig
+	tracer := tracing.NewProvider(configHolder.Get())
+	store, err := db.NewStore(connectionsConfig.Storage)
+	if err != nil {
+		return nil, err
+	}
+	events := rest.NewClient(connectionsConfig.EventProcessor)
+	connectionsRoom := room.NewRoom(configHolder, store, events)
+	admin := room.NewAdminServer(connectionsRoom)
+	consumer := queue.NewConsumer(configHolder, connectionsRoom.ProcessIncomingRecord)
+
+	metrics.RegisterUnsentBacklog(store.CountUnsent)
+	admin.Handle(health.LivenessPath, health.LivenessHandler())
+	admin.Handle(health.ReadinessPath, health.ReadinessHandler(
+		health.Check{Name: "storage", Critical: true, Probe: store.Ping},
+		health.Check{Name: "kafka_consumer_group", Critical: true, Probe: consumer.Check},
+		// messages for events are stored when the member list can not be fetched, so this one only degrades the service
+		health.Check{Name: "event_processor", Critical: false, Probe: events.Check},
+	))
+
+	configHolder.Subscribe(logging.ApplyConfig)
+	configHolder.Subscribe(events.ApplyConfig)
+	configHolder.Subscribe(consumer.ApplyConfig)
+
+	return &App{
+		config:   configHolder,
+		store:    store,
+		events:   events,
+		room:     connectionsRoom,
+		consumer: consumer,
+		// Start order: a component only depends on the ones before it
+		components: []component{tracer, store, events, connectionsRoom, admin, consumer},
+	}, nil
+}
+
+// Start starts the components in order. When one fails the already started ones are closed
+func (app *App) Start(ctx context.Context) error {
+	for _, c := range app.components {
+		if err := c.Start(ctx); err != nil {
+			_ = app.Close()
+			return err
+		}
+		app.started++
+	}
+	return nil
+}
+
+// Close stops the started components in reverse order
+func (app *App) Close() error {
+	var firstErr error
+	for ; app.started > 0; app.started-- {
+		if err := app.components[app.started-1].Close(); err != nil {
+			slog.Error("Error while closing application component", logging.Err(err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
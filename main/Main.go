@@ -1,32 +1,66 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
-	"partyfy-message-service/room"
-	"sync"
+	"log/slog"
+	"os"
+	"os/signal"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"syscall"
 )
 
 func main() {
 
-	var wg sync.WaitGroup
-	log.Print("Starting application...")
+	configPath := flag.String("config", "", "path of the JSON, YAML or TOML configuration file; "+config.PathEnv+" is used when empty")
+	printConfig := flag.Bool("print-config", false, "print the effective configuration with secrets redacted and exit")
+	flag.Parse()
 
-	wg.Add(1)
-	go start(&wg)
+	configHolder, err := config.NewHolder(*configPath)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if *printConfig {
+		redacted, _ := json.MarshalIndent(configHolder.Get().Redacted(), "", "  ")
+		fmt.Println(string(redacted))
+		return
+	}
 
-	log.Println("Application started")
-	wg.Wait()
-	log.Print("Program finished")
+	logging.Setup(configHolder.Get().ConnectionsConfig.Logging)
+	slog.Info("Starting application...")
+	app, err := NewApp(configHolder)
+	if err != nil {
+		fatal("Unable to create application", err)
+	}
+	if err = app.Start(context.Background()); err != nil {
+		fatal("Unable to start application", err)
+	}
+	slog.Info("Application started")
 
-}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for received := range signals {
+		if received == syscall.SIGHUP {
+			// Reload logs the outcome, a rejected reload keeps the running configuration
+			_ = configHolder.Reload()
+			continue
+		}
+		slog.Info("Stopping application...", "signal", received.String())
+		break
+	}
 
-func start(group *sync.WaitGroup) {
+	if err = app.Close(); err != nil {
+		slog.Error("Application stopped with error", logging.Err(err))
+	}
+	slog.Info("Program finished")
 
-	defer group.Done()
-	connectionsRoom := room.NewRoomFromConfig(group)
-	group.Add(1)
-	go connectionsRoom.InitKafkaConnection()
-	group.Add(1)
-	go connectionsRoom.InitClientConnectionsHandler()
+}
 
+func fatal(message string, err error) {
+	slog.Error(message, logging.Err(err))
+	os.Exit(1)
 }
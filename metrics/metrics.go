@@ -0,0 +1,167 @@
+package metrics
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+	"partyfy-message-service/logging"
+	"time"
+)
+
+const namespace = "partyfy"
+
+// countTimeout bounds the count of unsent messages, so that a slow store does not hold the scrape
+const countTimeout = 5 * time.Second
+
+var (
+	ConnectedClients = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "connected_clients",
+		Help:      "Client sockets currently open.",
+	})
+	ConnectionsAccepted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_accepted_total",
+		Help:      "Client connections accepted.",
+	})
+	ConnectionsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_rejected_total",
+		Help:      "Client connections refused, by reason.",
+	}, []string{"reason"})
+	MessagesRouted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_routed_total",
+		Help:      "Messages routed to a user, by message channel.",
+	}, []string{"channel"})
+	KafkaRecords = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "kafka_records_total",
+		Help:      "Records consumed from Kafka, by topic.",
+	}, []string{"topic"})
+	KafkaConsumerLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "kafka_consumer_lag",
+		Help:      "Records not consumed yet, by topic and partition.",
+	}, []string{"topic", "partition"})
+	InboundRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "inbound_messages_rejected_total",
+		Help:      "Client messages refused, by reason: user_rate, event_rate, muted, too_large or the error code of an authorization failure.",
+	}, []string{"reason"})
+	SenderMutes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "sender_mutes_total",
+		Help:      "Clients muted for flooding.",
+	})
+	ClientRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "client_requests_total",
+		Help:      "Requests of clients over their socket, by frame type and outcome: ok or the error code.",
+	}, []string{"type", "outcome"})
+	PresenceNotifications = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "presence_notifications_total",
+		Help:      "Presence changes pushed to clients.",
+	})
+	OutboundOverflows = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbound_queue_overflows_total",
+		Help:      "Messages that found the outbound queue of their connection full, by overflow policy.",
+	}, []string{"policy"})
+	OutboundDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "outbound_messages_dropped_total",
+		Help:      "Ephemeral messages dropped from full outbound queues, or expired before they were written.",
+	})
+	DeliveryLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_latency_seconds",
+		Help:      "Time from the Kafka record timestamp to the socket write.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	})
+	StoreDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "store_operation_duration_seconds",
+		Help:      "Duration of message store operations, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	StoreErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "store_errors_total",
+		Help:      "Failed message store operations, by operation.",
+	}, []string{"operation"})
+	EventProcessorDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "event_processor_request_duration_seconds",
+		Help:      "Duration of Main Event Processor requests, by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	EventProcessorErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_processor_errors_total",
+		Help:      "Failed Main Event Processor requests, by operation.",
+	}, []string{"operation"})
+)
+
+var registry = newRegistry()
+
+func newRegistry() *prometheus.Registry {
+	created := prometheus.NewRegistry()
+	created.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		ConnectedClients,
+		ConnectionsAccepted,
+		ConnectionsRejected,
+		MessagesRouted,
+		InboundRejected,
+		SenderMutes,
+		ClientRequests,
+		PresenceNotifications,
+		OutboundOverflows,
+		OutboundDropped,
+		KafkaRecords,
+		KafkaConsumerLag,
+		DeliveryLatency,
+		StoreDuration,
+		StoreErrors,
+		EventProcessorDuration,
+		EventProcessorErrors,
+	)
+	return created
+}
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// RegisterUnsentBacklog exposes the number of messages waiting in the store for their receiver.
+// count is called on every scrape, with a deadline of countTimeout
+func RegisterUnsentBacklog(count func(ctx context.Context) (int64, error)) {
+	registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "unsent_messages",
+		Help:      "Messages stored for receivers that did not get them yet.",
+	}, func() float64 {
+		ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+		defer cancel()
+		unsent, err := count(ctx)
+		if err != nil {
+			slog.Error("Unable to count unsent messages", logging.Err(err))
+			return -1
+		}
+		return float64(unsent)
+	}))
+}
+
+// ObserveDuration records the time since start in the histogram and counts the error, if any
+func ObserveDuration(duration *prometheus.HistogramVec, errors *prometheus.CounterVec, operation string, start time.Time, err error) {
+	duration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	if err != nil {
+		errors.WithLabelValues(operation).Inc()
+	}
+}
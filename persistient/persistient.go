@@ -1,5 +1,7 @@
 package persistient
 
+import "time"
+
 type EventMessage struct {
 	Channel    string      `json:"channel" bson:"channel"` //'event-updated' for example
 	EventID    int64       `json:"eventID" bson:"eventID"`
@@ -8,4 +10,50 @@ type EventMessage struct {
 	IsSent     bool        `json:"-" bson:"isSent"`
 	Body       interface{} `json:"body" `
 	ID         interface{} `json:"_id" bson:"-"`
+	KeyID      string      `json:"-" bson:"keyID,omitempty"` //master key wrapping the data key of an encrypted body
+	WrappedKey []byte      `json:"-" bson:"wrappedKey,omitempty"`
+	Ciphertext []byte      `json:"-" bson:"ciphertext,omitempty"`
+	RecordTime time.Time   `json:"-" bson:"-"`                 //timestamp of the Kafka record the message comes from, for the delivery latency
+	TraceID    string      `json:"-" bson:"traceID,omitempty"` //trace the message was routed in, hex encoded
+	SpanID     string      `json:"-" bson:"spanID,omitempty"`  //span that routed the message, delivery continues the trace from it
+	Ephemeral  bool        `json:"-" bson:"-"`                 //worthless once late, never stored when it can not be delivered
+	ExpiresAt  time.Time   `json:"-" bson:"-"`                 //an ephemeral message still queued at that time is dropped
+	Copy       bool        `json:"-" bson:"-"`                 //routed to another connection of a receiver that has several, never stored
+	Reply      string      `json:"-" bson:"-"`                 //frame type when the server replies to a client frame, empty for routed messages
+	RequestID  string      `json:"-" bson:"-"`                 //ID of the client frame replied to
+	CreatedAt  time.Time   `json:"createdAt" bson:"createdAt"` //when the message was routed, history is ordered by it
+	IsRead     bool        `json:"-" bson:"isRead"`            //marked read by the receiver
+	// MessageKey is shared by the copies of a client message for its receivers, receipts refer to it
+	MessageKey string `json:"messageKey,omitempty" bson:"messageKey,omitempty"`
+}
+
+type AuditRecord struct {
+	Action     string    `json:"action" bson:"action"` //'export' or 'erase'
+	UserID     int       `json:"userID" bson:"userID"`
+	Requester  string    `json:"requester" bson:"requester"`
+	Deleted    int64     `json:"deleted" bson:"deleted"`
+	Anonymized int64     `json:"anonymized" bson:"anonymized"`
+	Time       time.Time `json:"time" bson:"time"`
+}
+
+// Presence is the connection state of a user, shared by the replicas through the store
+type Presence struct {
+	UserID    int       `json:"userID" bson:"userID"`
+	Online    bool      `json:"online" bson:"online"`
+	Replicas  []string  `json:"replicas" bson:"replicas"`   //replicas holding connections of the user, online while any is left
+	Since     time.Time `json:"since" bson:"since"`         //when the user came online
+	LastSeen  time.Time `json:"lastSeen" bson:"lastSeen"`   //last time the user was known connected, refreshed by the heartbeat of their replicas
+	Hidden    bool      `json:"hidden" bson:"hidden"`       //the user hides their presence from the others
+	UpdatedAt time.Time `json:"updatedAt" bson:"updatedAt"` //last change of Online or Hidden, replicas look for changes by it
+}
+
+// Receipt tells whether a receiver of a client message got it and read it, one per receiver
+type Receipt struct {
+	MessageKey  string    `json:"messageKey" bson:"messageKey"`
+	SenderID    int       `json:"senderID" bson:"senderID"`
+	ReceiverID  int       `json:"receiverID" bson:"receiverID"`
+	EventID     int64     `json:"eventID" bson:"eventID"`
+	CreatedAt   time.Time `json:"createdAt" bson:"createdAt"`     //when the message was routed, read marks select by it
+	DeliveredAt time.Time `json:"deliveredAt" bson:"deliveredAt"` //zero until the receiver acknowledged the message
+	ReadAt      time.Time `json:"readAt" bson:"readAt"`           //zero until the receiver marked the message read
 }
@@ -0,0 +1,75 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Subprotocols of the encodings of the envelope. Subprotocol alone stands for JSON, as before encodings
+// could be negotiated
+const (
+	SubprotocolJSON     = Subprotocol + ".json"
+	SubprotocolMsgpack  = Subprotocol + ".msgpack"
+	SubprotocolProtobuf = Subprotocol + ".protobuf"
+)
+
+// Codec converts the frames of a connection between JSON, which the service works with, and the encoding
+// the client negotiated. Binary codecs are written in binary WebSocket messages
+type Codec interface {
+	Name() string
+	Binary() bool
+	// Encode turns a JSON frame into the encoding of the codec
+	Encode(frame []byte) ([]byte, error)
+	// Decode turns a frame of the client into JSON
+	Decode(data []byte) ([]byte, error)
+}
+
+// JSON is the codec of the JSON encoding, and of the connections that did not negotiate any
+var JSON Codec = jsonCodec{}
+
+var codecs = map[string]Codec{
+	Subprotocol:         JSON,
+	SubprotocolJSON:     JSON,
+	SubprotocolMsgpack:  msgpackCodec{},
+	SubprotocolProtobuf: protobufCodec{},
+}
+
+// Subprotocols lists the subprotocols the server accepts by preference, the most compact encodings first
+func Subprotocols() []string {
+	return []string{SubprotocolProtobuf, SubprotocolMsgpack, SubprotocolJSON, Subprotocol}
+}
+
+// CodecFor returns the codec of a negotiated subprotocol, false when the client speaks the legacy frames
+func CodecFor(subprotocol string) (Codec, bool) {
+	codec, found := codecs[subprotocol]
+	return codec, found
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Encode(frame []byte) ([]byte, error) {
+	return frame, nil
+}
+
+func (jsonCodec) Decode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+// decodeJSON reads a JSON document keeping its numbers as they were written
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
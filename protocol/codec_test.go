@@ -0,0 +1,268 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// frames holds a frame of every type, as the service writes them in JSON
+var frames = map[string]string{
+	TypeSend:             `{"v":1,"type":"send","id":"s1","data":{"receiverID":9,"body":{"text":"hi","n":-3,"f":1.5,"big":12345678901}}}`,
+	TypeSend + " event":  `{"v":1,"type":"send","data":{"eventID":100,"body":"to the event"}}`,
+	TypeAck:              `{"v":1,"type":"ack","id":"a1","data":{"messageKeys":["0f3a","b7c2"]}}`,
+	TypeSubscribe:        `{"v":1,"type":"subscribe","id":"sub1","data":{}}`,
+	TypeSignal:           `{"v":1,"type":"signal","data":{"eventID":100,"kind":"typing","active":true}}`,
+	TypeHistory:          `{"v":1,"type":"history","id":"h1","data":{"userID":9,"before":"2026-10-19T08:00:00Z","limit":20}}`,
+	TypeMarkRead:         `{"v":1,"type":"mark_read","id":"m1","data":{"eventID":100,"until":"2026-10-19T08:00:00Z"}}`,
+	TypeUnreadCounts:     `{"v":1,"type":"unread_counts","id":"u1"}`,
+	TypeReceipts:         `{"v":1,"type":"receipts","id":"r1","data":{"messageKeys":["0f3a"]}}`,
+	TypePresence:         `{"v":1,"type":"presence","id":"p1","data":{"userIDs":[8,9]}}`,
+	TypePresenceSettings: `{"v":1,"type":"presence_settings","id":"ps1","data":{"hidden":true}}`,
+	TypePing:             `{"v":1,"type":"ping","id":"ping1"}`,
+	TypeMessage:          `{"v":1,"type":"message","data":{"_id":"6530f1c2a4","channel":"message","eventID":100,"senderID":8,"receiverID":9,"body":{"text":"hi","tags":["a",null,true]},"createdAt":"2026-10-19T08:00:00.123456789Z","messageKey":"0f3a"}}`,
+	TypeAccepted:         `{"v":1,"type":"accepted","id":"s1","data":{"messageKey":"0f3a"}}`,
+	TypeResult:           `{"v":1,"type":"result","id":"u1","data":{"counts":[{"userID":9,"count":2},{"eventID":100,"count":12}]}}`,
+	TypePong:             `{"v":1,"type":"pong","id":"ping1"}`,
+	TypeError:            `{"v":1,"type":"error","id":"s1","error":{"code":"rate_limited","message":"Too many messages","retry_after":3}}`,
+}
+
+// liveMessage is a message frame that was routed live, protobuf leaves out its zero fields as proto3 does
+const (
+	liveMessage         = `{"v":1,"type":"message","data":{"_id":null,"channel":"presence","eventID":0,"senderID":8,"receiverID":9,"body":{"userID":8,"online":false},"createdAt":"2026-10-19T08:00:00Z"}}`
+	liveMessageProtobuf = `{"v":1,"type":"message","data":{"channel":"presence","senderID":8,"receiverID":9,"body":{"userID":8,"online":false},"createdAt":"2026-10-19T08:00:00Z"}}`
+)
+
+func binaryCodecs(t testing.TB) []Codec {
+	var found []Codec
+	for _, subprotocol := range Subprotocols() {
+		if codec, ok := CodecFor(subprotocol); ok && codec.Binary() {
+			found = append(found, codec)
+		}
+	}
+	if len(found) != 2 {
+		t.Fatalf("binary codecs: got %d, want msgpack and protobuf", len(found))
+	}
+	return found
+}
+
+// sameJSON tells whether two documents hold the same values, whatever the order of their keys
+func sameJSON(t testing.TB, got []byte, want []byte) bool {
+	gotValue, err := decodeJSON(got)
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", got, err)
+	}
+	wantValue, err := decodeJSON(want)
+	if err != nil {
+		t.Fatalf("invalid JSON %s: %v", want, err)
+	}
+	return reflect.DeepEqual(gotValue, wantValue)
+}
+
+func TestCodecsRoundTripEveryFrameType(t *testing.T) {
+	for _, codec := range binaryCodecs(t) {
+		for name, frame := range frames {
+			t.Run(codec.Name()+"/"+name, func(t *testing.T) {
+				encoded, err := codec.Encode([]byte(frame))
+				if err != nil {
+					t.Fatalf("Encode: %v", err)
+				}
+				decoded, err := codec.Decode(encoded)
+				if err != nil {
+					t.Fatalf("Decode: %v", err)
+				}
+				if !sameJSON(t, decoded, []byte(frame)) {
+					t.Errorf("round trip changed the frame\n got %s\nwant %s", decoded, frame)
+				}
+			})
+		}
+
+		want := liveMessage
+		if codec.Name() == "protobuf" {
+			want = liveMessageProtobuf
+		}
+		encoded, err := codec.Encode([]byte(liveMessage))
+		if err != nil {
+			t.Fatalf("%s: Encode of a live message: %v", codec.Name(), err)
+		}
+		if decoded, err := codec.Decode(encoded); err != nil || !sameJSON(t, decoded, []byte(want)) {
+			t.Errorf("%s: live message decoded as %s, %v, want %s", codec.Name(), decoded, err, want)
+		}
+	}
+}
+
+func TestJSONCodecKeepsFrames(t *testing.T) {
+	for name, frame := range frames {
+		encoded, err := JSON.Encode([]byte(frame))
+		if err != nil || string(encoded) != frame {
+			t.Errorf("%s: Encode got %s, %v", name, encoded, err)
+		}
+		decoded, err := JSON.Decode([]byte(frame))
+		if err != nil || string(decoded) != frame {
+			t.Errorf("%s: Decode got %s, %v", name, decoded, err)
+		}
+	}
+}
+
+func TestCodecsRefuseMalformedFrames(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		name  string
+		data  []byte
+	}{
+		{msgpackCodec{}, "truncated string", []byte{0xa5, 'h', 'i'}},
+		{msgpackCodec{}, "array longer than the frame", []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{msgpackCodec{}, "map key that is no string", []byte{0x81, 0x01, 0x02}},
+		{msgpackCodec{}, "trailing data", []byte{0xc0, 0xc0}},
+		{msgpackCodec{}, "unsupported type", []byte{0xc1}},
+		{msgpackCodec{}, "nested too deeply", bytes.Repeat([]byte{0x91}, maxDepth+2)},
+		{protobufCodec{}, "truncated tag", []byte{0x80}},
+		{protobufCodec{}, "truncated string", []byte{0x12, 0x05, 's'}},
+		{protobufCodec{}, "data that is no JSON", protowire.AppendBytes(protowire.AppendTag(nil, envelopeData, protowire.BytesType), []byte("{"))},
+		{protobufCodec{}, "retry_after out of range", protowire.AppendBytes(protowire.AppendTag(nil, envelopeError, protowire.BytesType),
+			protowire.AppendVarint(protowire.AppendTag(nil, errorRetryAfter, protowire.VarintType), 1<<40))},
+	}
+	for _, test := range tests {
+		if decoded, err := test.codec.Decode(test.data); err == nil {
+			t.Errorf("%s %s: decoded as %s", test.codec.Name(), test.name, decoded)
+		}
+	}
+}
+
+// FuzzDecode feeds both binary codecs with arbitrary frames: they must not panic, and what they decode must be
+// JSON that encodes again into a frame decoding the same. Protobuf only keeps the fields of v1.proto in send and
+// message frames, the others are dropped by the first round trip and it must not change the frame after that
+func FuzzDecode(f *testing.F) {
+	codecs := binaryCodecs(f)
+	for _, frame := range frames {
+		for _, codec := range codecs {
+			encoded, err := codec.Encode([]byte(frame))
+			if err != nil {
+				f.Fatalf("%s: %v", codec.Name(), err)
+			}
+			f.Add(encoded)
+		}
+	}
+	// Numbers msgpack once changed: an integer above the range of int64 and a negative zero
+	f.Add([]byte{0xcf, 0xcf, 0x30, 0x30, 0x30, 0x30, 0x30, 0x30, 0x30})
+	f.Add([]byte{0xcb, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, codec := range codecs {
+			decoded, err := codec.Decode(data)
+			if err != nil {
+				continue
+			}
+			if !json.Valid(decoded) {
+				t.Fatalf("%s decoded invalid JSON %q", codec.Name(), decoded)
+			}
+			if codec.Name() == "protobuf" {
+				if decoded = roundTrip(t, codec, decoded); decoded == nil {
+					continue
+				}
+			}
+			if again := roundTrip(t, codec, decoded); again != nil && !sameJSON(t, again, decoded) {
+				t.Fatalf("%s: round trip changed the frame\n got %s\nwant %s", codec.Name(), again, decoded)
+			}
+		}
+	})
+}
+
+// roundTrip encodes a frame and decodes it again, nil when the codec does not encode it
+func roundTrip(t *testing.T, codec Codec, frame []byte) []byte {
+	encoded, err := codec.Encode(frame)
+	if err != nil {
+		return nil
+	}
+	decoded, err := codec.Decode(encoded)
+	if err != nil {
+		t.Fatalf("%s: frame it encoded does not decode: %v\n%s", codec.Name(), err, frame)
+	}
+	return decoded
+}
+
+// protoField is a field of v1.proto as the codec writes it
+type protoField struct {
+	number protowire.Number
+	kind   protowire.Type
+}
+
+var protoFieldPattern = regexp.MustCompile(`^\s*(\w+)\s+(\w+)\s*=\s*(\d+);`)
+var protoMessagePattern = regexp.MustCompile(`^message (\w+) \{`)
+
+// TestProtobufCodecMatchesProto checks the field numbers of the codec against v1.proto, so that the two
+// can not drift apart
+func TestProtobufCodecMatchesProto(t *testing.T) {
+	codec := map[string]protoField{
+		"Envelope.v":          {envelopeVersion, protowire.VarintType},
+		"Envelope.type":       {envelopeType, protowire.BytesType},
+		"Envelope.id":         {envelopeID, protowire.BytesType},
+		"Envelope.send":       {envelopeSend, protowire.BytesType},
+		"Envelope.message":    {envelopeMessage, protowire.BytesType},
+		"Envelope.data":       {envelopeData, protowire.BytesType},
+		"Envelope.error":      {envelopeError, protowire.BytesType},
+		"Send.receiver_id":    {sendReceiverID, protowire.VarintType},
+		"Send.event_id":       {sendEventID, protowire.VarintType},
+		"Send.body":           {sendBody, protowire.BytesType},
+		"Message.id":          {messageID, protowire.BytesType},
+		"Message.channel":     {messageChannel, protowire.BytesType},
+		"Message.event_id":    {messageEventID, protowire.VarintType},
+		"Message.sender_id":   {messageSenderID, protowire.VarintType},
+		"Message.receiver_id": {messageReceiverID, protowire.VarintType},
+		"Message.body":        {messageBody, protowire.BytesType},
+		"Message.created_at":  {messageCreatedAt, protowire.VarintType},
+		"Message.message_key": {messageMessageKey, protowire.BytesType},
+		"Error.code":          {errorCode, protowire.BytesType},
+		"Error.message":       {errorMessage, protowire.BytesType},
+		"Error.retry_after":   {errorRetryAfter, protowire.VarintType},
+	}
+
+	file, err := os.Open("v1.proto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	proto := make(map[string]protoField)
+	var message string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := protoMessagePattern.FindStringSubmatch(scanner.Text()); match != nil {
+			message = match[1]
+			continue
+		}
+		match := protoFieldPattern.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+		number, _ := strconv.Atoi(match[3])
+		kind := protowire.BytesType
+		switch match[1] {
+		case "int32", "int64", "uint32", "uint64", "bool":
+			kind = protowire.VarintType
+		}
+		proto[message+"."+match[2]] = protoField{protowire.Number(number), kind}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, field := range proto {
+		written, found := codec[name]
+		if !found {
+			t.Errorf("%s = %d is not handled by the codec", name, field.number)
+		} else if written != field {
+			t.Errorf("%s: codec writes %+v, v1.proto declares %+v", name, written, field)
+		}
+	}
+	for name := range codec {
+		if _, found := proto[name]; !found {
+			t.Errorf("%s is written by the codec but missing from v1.proto", name)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of the documents decoded from clients
+const maxDepth = 64
+
+var errTruncated = errors.New("msgpack: unexpected end of data")
+
+// msgpackCodec encodes the envelope as MessagePack, with the same fields as its JSON form. Map keys are
+// strings, binary values are read as strings
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Encode(frame []byte) ([]byte, error) {
+	value, err := decodeJSON(frame)
+	if err != nil {
+		return nil, err
+	}
+	return appendMsgpack(make([]byte, 0, len(frame)), value)
+}
+
+func (msgpackCodec) Decode(data []byte) ([]byte, error) {
+	reader := msgpackReader{data: data}
+	value, err := reader.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if reader.offset != len(data) {
+		return nil, errors.New("msgpack: trailing data after the frame")
+	}
+	return json.Marshal(value)
+}
+
+func appendMsgpack(out []byte, value interface{}) ([]byte, error) {
+	switch value := value.(type) {
+	case nil:
+		return append(out, 0xc0), nil
+	case bool:
+		if value {
+			return append(out, 0xc3), nil
+		}
+		return append(out, 0xc2), nil
+	case json.Number:
+		// -0 stays a float, an integer would lose its sign
+		if integer, err := value.Int64(); err == nil && value != "-0" {
+			return appendMsgpackInt(out, integer), nil
+		}
+		if unsigned, err := strconv.ParseUint(string(value), 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(append(out, 0xcf), unsigned), nil
+		}
+		float, err := value.Float64()
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, 0xcb)
+		return binary.BigEndian.AppendUint64(out, math.Float64bits(float)), nil
+	case string:
+		return appendMsgpackString(out, value), nil
+	case []interface{}:
+		out = appendMsgpackLength(out, len(value), 0x90, 0xdc)
+		for _, item := range value {
+			var err error
+			if out, err = appendMsgpack(out, item); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out = appendMsgpackLength(out, len(value), 0x80, 0xde)
+		for _, key := range keys {
+			out = appendMsgpackString(out, key)
+			var err error
+			if out, err = appendMsgpack(out, value[key]); err != nil {
+				return nil, err
+			}
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("msgpack: unsupported value %T", value)
+}
+
+func appendMsgpackInt(out []byte, value int64) []byte {
+	switch {
+	case value >= 0 && value <= 0x7f:
+		return append(out, byte(value))
+	case value < 0 && value >= -32:
+		return append(out, byte(value))
+	case value >= math.MinInt32 && value <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(out, 0xd2), uint32(value))
+	}
+	return binary.BigEndian.AppendUint64(append(out, 0xd3), uint64(value))
+}
+
+func appendMsgpackString(out []byte, value string) []byte {
+	switch length := len(value); {
+	case length < 32:
+		out = append(out, 0xa0|byte(length))
+	case length <= math.MaxUint8:
+		out = append(out, 0xd9, byte(length))
+	case length <= math.MaxUint16:
+		out = binary.BigEndian.AppendUint16(append(out, 0xda), uint16(length))
+	default:
+		out = binary.BigEndian.AppendUint32(append(out, 0xdb), uint32(length))
+	}
+	return append(out, value...)
+}
+
+// appendMsgpackLength writes the header of an array or a map: fix is the prefix of the short form, wide the
+// one of the 16 bits length, the 32 bits one follows it
+func appendMsgpackLength(out []byte, length int, fix byte, wide byte) []byte {
+	switch {
+	case length < 16:
+		return append(out, fix|byte(length))
+	case length <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(out, wide), uint16(length))
+	}
+	return binary.BigEndian.AppendUint32(append(out, wide+1), uint32(length))
+}
+
+type msgpackReader struct {
+	data   []byte
+	offset int
+}
+
+func (reader *msgpackReader) next(count int) ([]byte, error) {
+	if count < 0 || len(reader.data)-reader.offset < count {
+		return nil, errTruncated
+	}
+	read := reader.data[reader.offset : reader.offset+count]
+	reader.offset += count
+	return read, nil
+}
+
+func (reader *msgpackReader) uint(size int) (uint64, error) {
+	read, err := reader.next(size)
+	if err != nil {
+		return 0, err
+	}
+	var value uint64
+	for _, b := range read {
+		value = value<<8 | uint64(b)
+	}
+	return value, nil
+}
+
+func (reader *msgpackReader) value(depth int) (interface{}, error) {
+	if depth > maxDepth {
+		return nil, errors.New("msgpack: frame is nested too deeply")
+	}
+	read, err := reader.next(1)
+	if err != nil {
+		return nil, err
+	}
+	switch prefix := read[0]; {
+	case prefix <= 0x7f:
+		return int64(prefix), nil
+	case prefix >= 0xe0:
+		return int64(int8(prefix)), nil
+	case prefix&0xe0 == 0xa0:
+		return reader.string(int(prefix & 0x1f))
+	case prefix&0xf0 == 0x90:
+		return reader.array(int(prefix&0x0f), depth)
+	case prefix&0xf0 == 0x80:
+		return reader.object(int(prefix&0x0f), depth)
+	case prefix == 0xc0:
+		return nil, nil
+	case prefix == 0xc2:
+		return false, nil
+	case prefix == 0xc3:
+		return true, nil
+	case prefix == 0xca:
+		bits, err := reader.uint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case prefix == 0xcb:
+		bits, err := reader.uint(8)
+		return math.Float64frombits(bits), err
+	case prefix >= 0xcc && prefix <= 0xcf:
+		value, err := reader.uint(1 << (prefix - 0xcc))
+		if value > math.MaxInt64 {
+			return json.Number(strconv.FormatUint(value, 10)), err
+		}
+		return int64(value), err
+	case prefix >= 0xd0 && prefix <= 0xd3:
+		size := 1 << (prefix - 0xd0)
+		value, err := reader.uint(size)
+		shift := 64 - 8*size
+		return int64(value<<shift) >> shift, err
+	case prefix >= 0xd9 && prefix <= 0xdb:
+		length, err := reader.uint(1 << (prefix - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return reader.string(int(length))
+	case prefix >= 0xc4 && prefix <= 0xc6:
+		length, err := reader.uint(1 << (prefix - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return reader.string(int(length))
+	case prefix == 0xdc || prefix == 0xdd:
+		length, err := reader.uint(2 << (prefix - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return reader.array(int(length), depth)
+	case prefix == 0xde || prefix == 0xdf:
+		length, err := reader.uint(2 << (prefix - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return reader.object(int(length), depth)
+	}
+	return nil, fmt.Errorf("msgpack: unsupported type 0x%02x", read[0])
+}
+
+func (reader *msgpackReader) string(length int) (string, error) {
+	read, err := reader.next(length)
+	return string(read), err
+}
+
+func (reader *msgpackReader) array(length int, depth int) ([]interface{}, error) {
+	// Every item takes a byte at least, longer arrays are truncated
+	if length > len(reader.data)-reader.offset {
+		return nil, errTruncated
+	}
+	items := make([]interface{}, 0, length)
+	for i := 0; i < length; i++ {
+		item, err := reader.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (reader *msgpackReader) object(length int, depth int) (map[string]interface{}, error) {
+	if length > len(reader.data)-reader.offset {
+		return nil, errTruncated
+	}
+	object := make(map[string]interface{}, length)
+	for i := 0; i < length; i++ {
+		key, err := reader.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		name, ok := key.(string)
+		if !ok {
+			return nil, fmt.Errorf("msgpack: map keys must be strings, got %T", key)
+		}
+		if object[name], err = reader.value(depth + 1); err != nil {
+			return nil, err
+		}
+	}
+	return object, nil
+}
@@ -0,0 +1,300 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/protobuf/encoding/protowire"
+	"math"
+	"time"
+)
+
+// Field numbers of v1.proto
+const (
+	envelopeVersion = 1
+	envelopeType    = 2
+	envelopeID      = 3
+	envelopeSend    = 4
+	envelopeMessage = 5
+	envelopeData    = 6
+	envelopeError   = 7
+
+	sendReceiverID = 1
+	sendEventID    = 2
+	sendBody       = 3
+
+	messageID         = 1
+	messageChannel    = 2
+	messageEventID    = 3
+	messageSenderID   = 4
+	messageReceiverID = 5
+	messageBody       = 6
+	messageCreatedAt  = 7
+	messageMessageKey = 8
+
+	errorCode       = 1
+	errorMessage    = 2
+	errorRetryAfter = 3
+)
+
+// protobufCodec encodes the envelope as the Envelope message of v1.proto. Send and message frames have typed
+// fields, the data of the other frames and the bodies of messages stay JSON
+type protobufCodec struct{}
+
+// wireMessage is the data of message and send frames as it is written in JSON
+type wireMessage struct {
+	ID         json.RawMessage `json:"_id,omitempty"`
+	Channel    string          `json:"channel,omitempty"`
+	EventID    int64           `json:"eventID,omitempty"`
+	SenderID   int             `json:"senderID,omitempty"`
+	ReceiverID int             `json:"receiverID,omitempty"`
+	Body       json.RawMessage `json:"body"`
+	CreatedAt  *time.Time      `json:"createdAt,omitempty"`
+	MessageKey string          `json:"messageKey,omitempty"`
+}
+
+type wireEnvelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+func (protobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (protobufCodec) Binary() bool {
+	return true
+}
+
+func (protobufCodec) Encode(frame []byte) ([]byte, error) {
+	var envelope wireEnvelope
+	if err := json.Unmarshal(frame, &envelope); err != nil {
+		return nil, err
+	}
+	out := appendVarintField(nil, envelopeVersion, uint64(envelope.Version))
+	out = appendStringField(out, envelopeType, envelope.Type)
+	out = appendStringField(out, envelopeID, envelope.ID)
+	switch {
+	case len(envelope.Data) == 0 || string(envelope.Data) == "null":
+	case envelope.Type == TypeMessage || envelope.Type == TypeSend:
+		var message wireMessage
+		if err := json.Unmarshal(envelope.Data, &message); err != nil {
+			return nil, err
+		}
+		if envelope.Type == TypeSend {
+			out = protowire.AppendTag(out, envelopeSend, protowire.BytesType)
+			out = protowire.AppendBytes(out, encodeSend(message))
+		} else {
+			out = protowire.AppendTag(out, envelopeMessage, protowire.BytesType)
+			out = protowire.AppendBytes(out, encodeMessage(message))
+		}
+	default:
+		out = protowire.AppendTag(out, envelopeData, protowire.BytesType)
+		out = protowire.AppendBytes(out, envelope.Data)
+	}
+	if envelope.Error != nil {
+		var encoded []byte
+		encoded = appendStringField(encoded, errorCode, envelope.Error.Code)
+		encoded = appendStringField(encoded, errorMessage, envelope.Error.Message)
+		encoded = appendVarintField(encoded, errorRetryAfter, uint64(envelope.Error.RetryAfter))
+		out = protowire.AppendTag(out, envelopeError, protowire.BytesType)
+		out = protowire.AppendBytes(out, encoded)
+	}
+	return out, nil
+}
+
+func encodeSend(message wireMessage) []byte {
+	out := appendVarintField(nil, sendReceiverID, uint64(message.ReceiverID))
+	out = appendVarintField(out, sendEventID, uint64(message.EventID))
+	return appendBytesField(out, sendBody, message.Body)
+}
+
+func encodeMessage(message wireMessage) []byte {
+	var out []byte
+	if id, err := decodeJSON(message.ID); err == nil && id != nil {
+		out = appendStringField(out, messageID, fmt.Sprint(id))
+	}
+	out = appendStringField(out, messageChannel, message.Channel)
+	out = appendVarintField(out, messageEventID, uint64(message.EventID))
+	out = appendVarintField(out, messageSenderID, uint64(message.SenderID))
+	out = appendVarintField(out, messageReceiverID, uint64(message.ReceiverID))
+	out = appendBytesField(out, messageBody, message.Body)
+	if message.CreatedAt != nil && message.CreatedAt.Year() > 1677 && message.CreatedAt.Year() < 2262 {
+		out = appendVarintField(out, messageCreatedAt, uint64(message.CreatedAt.UnixNano()))
+	}
+	return appendStringField(out, messageMessageKey, message.MessageKey)
+}
+
+func (protobufCodec) Decode(data []byte) ([]byte, error) {
+	var envelope wireEnvelope
+	err := readFields(data, func(number protowire.Number, value uint64, bytes []byte) error {
+		var err error
+		switch number {
+		case envelopeVersion:
+			envelope.Version = int(value)
+		case envelopeType:
+			envelope.Type = string(bytes)
+		case envelopeID:
+			envelope.ID = string(bytes)
+		case envelopeSend:
+			envelope.Data, err = decodeSend(bytes)
+		case envelopeMessage:
+			envelope.Data, err = decodeMessage(bytes)
+		case envelopeData:
+			// Null data is left out, as in the JSON envelope
+			if envelope.Data, err = jsonBytes(bytes); string(envelope.Data) == "null" {
+				envelope.Data = nil
+			}
+		case envelopeError:
+			envelope.Error, err = decodeError(bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+func decodeSend(data []byte) (json.RawMessage, error) {
+	var message wireMessage
+	err := readFields(data, func(number protowire.Number, value uint64, bytes []byte) error {
+		var err error
+		switch number {
+		case sendReceiverID:
+			message.ReceiverID = int(int32(value))
+		case sendEventID:
+			message.EventID = int64(value)
+		case sendBody:
+			message.Body, err = jsonBytes(bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(message)
+}
+
+func decodeMessage(data []byte) (json.RawMessage, error) {
+	var message wireMessage
+	err := readFields(data, func(number protowire.Number, value uint64, bytes []byte) error {
+		var err error
+		switch number {
+		case messageID:
+			message.ID, err = json.Marshal(string(bytes))
+		case messageChannel:
+			message.Channel = string(bytes)
+		case messageEventID:
+			message.EventID = int64(value)
+		case messageSenderID:
+			message.SenderID = int(int32(value))
+		case messageReceiverID:
+			message.ReceiverID = int(int32(value))
+		case messageBody:
+			message.Body, err = jsonBytes(bytes)
+		case messageCreatedAt:
+			createdAt := time.Unix(0, int64(value)).UTC()
+			message.CreatedAt = &createdAt
+		case messageMessageKey:
+			message.MessageKey = string(bytes)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(message)
+}
+
+func decodeError(data []byte) (*Error, error) {
+	decoded := &Error{}
+	err := readFields(data, func(number protowire.Number, value uint64, bytes []byte) error {
+		switch number {
+		case errorCode:
+			decoded.Code = string(bytes)
+		case errorMessage:
+			decoded.Message = string(bytes)
+		case errorRetryAfter:
+			if value > math.MaxInt32 {
+				return errors.New("protobuf: retry_after out of range")
+			}
+			decoded.RetryAfter = int(value)
+		}
+		return nil
+	})
+	return decoded, err
+}
+
+// readFields calls field for every field of a message with its varint value, or its bytes when it is
+// length delimited. Fixed size and unknown fields are skipped
+func readFields(data []byte, field func(number protowire.Number, value uint64, bytes []byte) error) error {
+	for len(data) > 0 {
+		number, kind, length := protowire.ConsumeTag(data)
+		if length < 0 {
+			return protowire.ParseError(length)
+		}
+		data = data[length:]
+		var value uint64
+		var bytes []byte
+		switch kind {
+		case protowire.VarintType:
+			value, length = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			bytes, length = protowire.ConsumeBytes(data)
+		default:
+			length = protowire.ConsumeFieldValue(number, kind, data)
+			if length < 0 {
+				return protowire.ParseError(length)
+			}
+			data = data[length:]
+			continue
+		}
+		if length < 0 {
+			return protowire.ParseError(length)
+		}
+		data = data[length:]
+		if err := field(number, value, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonBytes checks that a bytes field holds JSON, empty stands for null
+func jsonBytes(data []byte) (json.RawMessage, error) {
+	if len(data) == 0 {
+		return json.RawMessage("null"), nil
+	}
+	if !json.Valid(data) {
+		return nil, errors.New("protobuf: field is not valid JSON")
+	}
+	return json.RawMessage(data), nil
+}
+
+func appendVarintField(out []byte, number protowire.Number, value uint64) []byte {
+	if value == 0 {
+		return out
+	}
+	out = protowire.AppendTag(out, number, protowire.VarintType)
+	return protowire.AppendVarint(out, value)
+}
+
+func appendStringField(out []byte, number protowire.Number, value string) []byte {
+	if value == "" {
+		return out
+	}
+	out = protowire.AppendTag(out, number, protowire.BytesType)
+	return protowire.AppendString(out, value)
+}
+
+func appendBytesField(out []byte, number protowire.Number, value []byte) []byte {
+	if len(value) == 0 || string(value) == "null" {
+		return out
+	}
+	out = protowire.AppendTag(out, number, protowire.BytesType)
+	return protowire.AppendBytes(out, value)
+}
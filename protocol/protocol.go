@@ -0,0 +1,253 @@
+package protocol
+
+import (
+	_ "embed"
+	"encoding/json"
+	"partyfy-message-service/persistient"
+	"time"
+)
+
+const (
+	// Version is the version of the envelope, carried in the "v" field of every frame
+	Version = 1
+	// Subprotocol is negotiated by the clients that speak in envelopes, the others get the legacy frames
+	Subprotocol = "partyfy.v1"
+)
+
+// Types of the frames clients send. Subscribe is reserved, it is answered with an unsupported_type error for now
+const (
+	TypeSend         = "send"
+	TypeAck          = "ack"
+	TypeSubscribe    = "subscribe"
+	TypeSignal       = "signal"
+	TypeHistory      = "history"
+	TypeMarkRead     = "mark_read"
+	TypeUnreadCounts = "unread_counts"
+	TypeReceipts     = "receipts"
+	TypePresence     = "presence"
+	// TypePresenceSettings sets whether the user hides their presence
+	TypePresenceSettings = "presence_settings"
+	TypePing             = "ping"
+)
+
+// Types of the frames the server sends
+const (
+	TypeMessage  = "message"
+	TypeAccepted = "accepted"
+	TypeResult   = "result"
+	TypePong     = "pong"
+	TypeError    = "error"
+)
+
+// Codes of the errors sent to clients
+const (
+	ErrInvalidFrame             = "invalid_frame"
+	ErrUnsupportedType          = "unsupported_type"
+	ErrInvalidTarget            = "invalid_target"
+	ErrRateLimited              = "rate_limited"
+	ErrEventRateLimited         = "event_rate_limited"
+	ErrMuted                    = "muted"
+	ErrNotEventMember           = "not_event_member"
+	ErrDirectMessageDenied      = "direct_message_denied"
+	ErrAuthorizationUnavailable = "authorization_unavailable"
+	ErrUnavailable              = "unavailable"
+)
+
+// Envelope is a frame of the protocol. ID correlates the replies of the server with the client frame
+type Envelope struct {
+	Version int             `json:"v"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Data    json.RawMessage `json:"data,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+}
+
+// Error tells a client why its frame was refused. RetryAfter is set when it may send again after that many seconds
+type Error struct {
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// SendData is the data of a send frame, exactly one of ReceiverID and EventID is set
+type SendData struct {
+	ReceiverID int         `json:"receiverID,omitempty"`
+	EventID    int64       `json:"eventID,omitempty"`
+	Body       interface{} `json:"body"`
+}
+
+// AcceptedData is the data of the accepted reply to a send frame. MessageKey identifies the message in its receipts
+type AcceptedData struct {
+	MessageKey string `json:"messageKey"`
+}
+
+// Kinds of the ephemeral signals
+const (
+	SignalTyping  = "typing"
+	SignalViewing = "viewing"
+)
+
+// SignalData is the data of a signal frame: the sender starts or stops typing, viewing... in the conversation
+// with ReceiverID or in the chat of EventID. Exactly one of them is set
+type SignalData struct {
+	ReceiverID int    `json:"receiverID,omitempty"`
+	EventID    int64  `json:"eventID,omitempty"`
+	Kind       string `json:"kind"`
+	Active     bool   `json:"active"`
+}
+
+// Signal is the body of the messages of the signal channel. The receiver drops an active signal at ExpiresAt
+// unless the sender repeats it
+type Signal struct {
+	Kind      string    `json:"kind"`
+	Active    bool      `json:"active"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// HistoryData is the data of a history frame: the direct conversation with UserID or the chat of EventID,
+// newest first, from Before when it is set
+type HistoryData struct {
+	UserID  int       `json:"userID,omitempty"`
+	EventID int64     `json:"eventID,omitempty"`
+	Before  time.Time `json:"before"`
+	Limit   int       `json:"limit,omitempty"`
+}
+
+// HistoryResult answers a history frame. Next is the before of the next page, unset on the last one
+type HistoryResult struct {
+	Messages []persistient.EventMessage `json:"messages"`
+	Next     *time.Time                 `json:"next,omitempty"`
+}
+
+// MarkReadData is the data of a mark_read frame: the messages received from UserID or in the chat of EventID,
+// up to Until when it is set
+type MarkReadData struct {
+	UserID  int       `json:"userID,omitempty"`
+	EventID int64     `json:"eventID,omitempty"`
+	Until   time.Time `json:"until"`
+}
+
+// MarkReadResult answers a mark_read frame with the number of messages that were not read yet
+type MarkReadResult struct {
+	Updated int64 `json:"updated"`
+}
+
+// UnreadCount is the number of unread messages in the chat of EventID, or from UserID
+type UnreadCount struct {
+	UserID  int   `json:"userID,omitempty"`
+	EventID int64 `json:"eventID,omitempty"`
+	Count   int64 `json:"count"`
+}
+
+// UnreadCountsResult answers an unread_counts frame
+type UnreadCountsResult struct {
+	Counts []UnreadCount `json:"counts"`
+}
+
+// AckData is the data of an ack frame: the messageKey of the messages the client got
+type AckData struct {
+	MessageKeys []string `json:"messageKeys"`
+}
+
+// AckResult answers an ack frame with the number of messages that were not acknowledged yet
+type AckResult struct {
+	Delivered int `json:"delivered"`
+}
+
+// Statuses of the receipts
+const (
+	ReceiptDelivered = "delivered"
+	ReceiptRead      = "read"
+)
+
+// ReceiptsData is the data of a receipts frame: the messageKey of messages the client sent
+type ReceiptsData struct {
+	MessageKeys []string `json:"messageKeys"`
+}
+
+// ReceiptsResult answers a receipts frame. Messages the client did not send are left out
+type ReceiptsResult struct {
+	Receipts []Receipts `json:"receipts"`
+}
+
+// Receipts sums up how many receivers of a message got it and read it, "read by 12" in an event chat. Users
+// details it per receiver, it is only set in the result of a receipts frame
+type Receipts struct {
+	MessageKey string        `json:"messageKey"`
+	Receivers  int64         `json:"receivers"`
+	Delivered  int64         `json:"delivered"`
+	Read       int64         `json:"read"`
+	Users      []UserReceipt `json:"users,omitempty"`
+}
+
+// UserReceipt tells when a receiver got a message and read it
+type UserReceipt struct {
+	UserID      int        `json:"userID"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+	ReadAt      *time.Time `json:"readAt,omitempty"`
+}
+
+// ReceiptUpdate is the body of the messages of the receipt channel, pushed to the sender when UserID got or read
+// some of their messages
+type ReceiptUpdate struct {
+	UserID   int        `json:"userID"`
+	EventID  int64      `json:"eventID,omitempty"`
+	Status   string     `json:"status"`
+	At       time.Time  `json:"at"`
+	Receipts []Receipts `json:"receipts"`
+}
+
+// PresenceData is the data of a presence frame: the users of UserIDs, or every member of EventID
+type PresenceData struct {
+	UserIDs []int `json:"userIDs,omitempty"`
+	EventID int64 `json:"eventID,omitempty"`
+}
+
+// Presence tells whether a user is connected, since when, and when they were last seen. It is also the body
+// of the messages of the presence channel, pushed when a user the client knows comes online or goes offline
+type Presence struct {
+	UserID   int        `json:"userID"`
+	Online   bool       `json:"online"`
+	Since    *time.Time `json:"since,omitempty"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+// PresenceResult answers a presence frame. Users the client may not write to are left out
+type PresenceResult struct {
+	Users []Presence `json:"users"`
+}
+
+// PresenceSettingsData is the data of a presence_settings frame. Hidden users look offline to the others
+type PresenceSettingsData struct {
+	Hidden bool `json:"hidden"`
+}
+
+// PresenceSettingsResult answers a presence_settings frame with the setting in force
+type PresenceSettingsResult struct {
+	Hidden bool `json:"hidden"`
+}
+
+//go:embed v1.schema.json
+var Schema []byte
+
+var clientFrames = mustValidator(Schema)
+
+func mustValidator(schema []byte) *Validator {
+	validator, err := NewValidator(schema)
+	if err != nil {
+		panic(err)
+	}
+	return validator
+}
+
+// Decode validates a client frame against the schema and decodes it
+func Decode(raw []byte) (*Envelope, error) {
+	if err := clientFrames.Validate(raw); err != nil {
+		return nil, err
+	}
+	var envelope Envelope
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
@@ -0,0 +1,220 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Validator checks JSON documents against a schema. It supports the part of JSON Schema the protocol
+// uses: type, const, enum, required, properties, additionalProperties, items, minItems, maxItems, minimum,
+// maximum, minLength, maxLength, allOf, oneOf, if/then and local $ref
+type Validator struct {
+	root map[string]interface{}
+}
+
+func NewValidator(document []byte) (*Validator, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(document, &root); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return &Validator{root: root}, nil
+}
+
+// Validate returns the first violation of the schema found in raw, nil when it conforms
+func (validator *Validator) Validate(raw []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return fmt.Errorf("invalid JSON: %v", err)
+	}
+	return validator.check(validator.root, value, "")
+}
+
+func (validator *Validator) check(node map[string]interface{}, value interface{}, path string) error {
+
+	if ref, ok := node["$ref"].(string); ok {
+		target, err := validator.resolve(ref)
+		if err != nil {
+			return err
+		}
+		return validator.check(target, value, path)
+	}
+
+	if expected, ok := node["type"].(string); ok && !hasType(value, expected) {
+		return violation(path, "must be of type "+expected)
+	}
+	if expected, ok := node["const"]; ok && !reflect.DeepEqual(value, expected) {
+		return violation(path, fmt.Sprintf("must be %v", expected))
+	}
+	if enum, ok := node["enum"].([]interface{}); ok && !inEnum(value, enum) {
+		return violation(path, fmt.Sprintf("must be one of %v", enum))
+	}
+
+	switch typed := value.(type) {
+	case map[string]interface{}:
+		if err := validator.checkObject(node, typed, path); err != nil {
+			return err
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(typed))
+		if limit, ok := node["minLength"].(float64); ok && length < limit {
+			return violation(path, fmt.Sprintf("must be at least %v characters long", limit))
+		}
+		if limit, ok := node["maxLength"].(float64); ok && length > limit {
+			return violation(path, fmt.Sprintf("must be at most %v characters long", limit))
+		}
+	case []interface{}:
+		if err := validator.checkArray(node, typed, path); err != nil {
+			return err
+		}
+	case float64:
+		if limit, ok := node["minimum"].(float64); ok && typed < limit {
+			return violation(path, fmt.Sprintf("must be at least %v", limit))
+		}
+		if limit, ok := node["maximum"].(float64); ok && typed > limit {
+			return violation(path, fmt.Sprintf("must be at most %v", limit))
+		}
+	}
+
+	if all, ok := node["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := validator.check(asNode(sub), value, path); err != nil {
+				return err
+			}
+		}
+	}
+	if one, ok := node["oneOf"].([]interface{}); ok {
+		matches := 0
+		for _, sub := range one {
+			if validator.check(asNode(sub), value, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return violation(path, fmt.Sprintf("must match exactly one of %d alternatives, matches %d", len(one), matches))
+		}
+	}
+	if condition, ok := node["if"].(map[string]interface{}); ok && validator.check(condition, value, path) == nil {
+		if then, ok := node["then"].(map[string]interface{}); ok {
+			return validator.check(then, value, path)
+		}
+	}
+	return nil
+}
+
+func (validator *Validator) checkObject(node map[string]interface{}, object map[string]interface{}, path string) error {
+	if required, ok := node["required"].([]interface{}); ok {
+		for _, name := range required {
+			if _, present := object[name.(string)]; !present {
+				return violation(path+"/"+name.(string), "is required")
+			}
+		}
+	}
+	properties, _ := node["properties"].(map[string]interface{})
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, declared := properties[name]
+		if !declared {
+			if additional, ok := node["additionalProperties"].(bool); ok && !additional {
+				return violation(path+"/"+name, "is not allowed")
+			}
+			continue
+		}
+		if err := validator.check(asNode(sub), object[name], path+"/"+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (validator *Validator) checkArray(node map[string]interface{}, array []interface{}, path string) error {
+	length := float64(len(array))
+	if limit, ok := node["minItems"].(float64); ok && length < limit {
+		return violation(path, fmt.Sprintf("must have at least %v items", limit))
+	}
+	if limit, ok := node["maxItems"].(float64); ok && length > limit {
+		return violation(path, fmt.Sprintf("must have at most %v items", limit))
+	}
+	if items, ok := node["items"]; ok {
+		for i, item := range array {
+			if err := validator.check(asNode(items), item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve finds the schema a local reference such as "#/$defs/send" points to
+func (validator *Validator) resolve(ref string) (map[string]interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported schema reference %q", ref)
+	}
+	node := validator.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		next, ok := node[part].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolved schema reference %q", ref)
+		}
+		node = next
+	}
+	return node, nil
+}
+
+func hasType(value interface{}, expected string) bool {
+	switch expected {
+	case "object":
+		_, ok := value.(map[string]interface{})
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == float64(int64(number))
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return false
+}
+
+func inEnum(value interface{}, enum []interface{}) bool {
+	for _, allowed := range enum {
+		if reflect.DeepEqual(value, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// asNode returns the schema of a subschema position, the empty schema accepts everything
+func asNode(sub interface{}) map[string]interface{} {
+	node, _ := sub.(map[string]interface{})
+	if node == nil {
+		return map[string]interface{}{}
+	}
+	return node
+}
+
+func violation(path string, problem string) error {
+	if path == "" {
+		path = "/"
+	}
+	return fmt.Errorf("%s %s", path, problem)
+}
@@ -0,0 +1,166 @@
+package protocol
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestClientFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame string
+		// violation is a part of the error, empty when the frame is valid
+		violation string
+	}{
+		{"send to a user", `{"v":1,"type":"send","id":"s1","data":{"receiverID":9,"body":{"text":"hi"}}}`, ""},
+		{"send to an event", `{"v":1,"type":"send","data":{"eventID":100,"body":"hi"}}`, ""},
+		{"send with a null body", `{"v":1,"type":"send","data":{"receiverID":9,"body":null}}`, ""},
+		{"send without data", `{"v":1,"type":"send"}`, "/data is required"},
+		{"send without body", `{"v":1,"type":"send","data":{"receiverID":9}}`, "/data/body is required"},
+		{"send to a user and an event", `{"v":1,"type":"send","data":{"receiverID":9,"eventID":100,"body":"hi"}}`, "/data must match exactly one"},
+		{"send to nobody", `{"v":1,"type":"send","data":{"body":"hi"}}`, "/data must match exactly one"},
+		{"send to user 0", `{"v":1,"type":"send","data":{"receiverID":0,"body":"hi"}}`, "/data/receiverID must be at least 1"},
+		{"send to a fractional user", `{"v":1,"type":"send","data":{"receiverID":1.5,"body":"hi"}}`, "/data/receiverID must be of type integer"},
+		{"send with an unknown field", `{"v":1,"type":"send","data":{"receiverID":9,"body":"hi","channel":"x"}}`, "/data/channel is not allowed"},
+
+		{"ack", `{"v":1,"type":"ack","data":{"messageKeys":["0f3a"]}}`, ""},
+		{"ack without keys", `{"v":1,"type":"ack","data":{"messageKeys":[]}}`, "/data/messageKeys must have at least 1 items"},
+		{"ack of an empty key", `{"v":1,"type":"ack","data":{"messageKeys":[""]}}`, "/data/messageKeys/0 must be at least 1 characters long"},
+		{"ack of a number", `{"v":1,"type":"ack","data":{"messageKeys":[12]}}`, "/data/messageKeys/0 must be of type string"},
+		{"ack of too many keys", `{"v":1,"type":"ack","data":{"messageKeys":[` + strings.Repeat(`"k",`, 100) + `"k"]}}`, "/data/messageKeys must have at most 100 items"},
+
+		{"subscribe", `{"v":1,"type":"subscribe","data":{"channel":"x"}}`, ""},
+		{"subscribe without data", `{"v":1,"type":"subscribe"}`, ""},
+
+		{"signal", `{"v":1,"type":"signal","data":{"receiverID":9,"kind":"typing","active":false}}`, ""},
+		{"signal of an unknown kind", `{"v":1,"type":"signal","data":{"eventID":100,"kind":"dancing","active":true}}`, "/data/kind must be one of"},
+		{"signal without active", `{"v":1,"type":"signal","data":{"eventID":100,"kind":"viewing"}}`, "/data/active is required"},
+		{"signal with a string active", `{"v":1,"type":"signal","data":{"eventID":100,"kind":"viewing","active":"yes"}}`, "/data/active must be of type boolean"},
+
+		{"history of a conversation", `{"v":1,"type":"history","data":{"userID":9,"before":"2026-10-19T08:00:00Z","limit":100}}`, ""},
+		{"history of an event", `{"v":1,"type":"history","data":{"eventID":100}}`, ""},
+		{"history without target", `{"v":1,"type":"history","data":{}}`, "/data must match exactly one"},
+		{"history without data", `{"v":1,"type":"history"}`, "/data is required"},
+		{"history over the limit", `{"v":1,"type":"history","data":{"userID":9,"limit":101}}`, "/data/limit must be at most 100"},
+		{"history with a numeric before", `{"v":1,"type":"history","data":{"userID":9,"before":1}}`, "/data/before must be of type string"},
+
+		{"mark_read", `{"v":1,"type":"mark_read","data":{"userID":9,"until":"2026-10-19T08:00:00Z"}}`, ""},
+		{"mark_read without target", `{"v":1,"type":"mark_read","data":{"until":"2026-10-19T08:00:00Z"}}`, "/data must match exactly one"},
+		{"mark_read with an unknown field", `{"v":1,"type":"mark_read","data":{"eventID":100,"limit":3}}`, "/data/limit is not allowed"},
+
+		{"unread_counts", `{"v":1,"type":"unread_counts"}`, ""},
+		{"unread_counts with empty data", `{"v":1,"type":"unread_counts","data":{}}`, ""},
+		{"unread_counts with a field", `{"v":1,"type":"unread_counts","data":{"x":1}}`, "/data/x is not allowed"},
+
+		{"receipts", `{"v":1,"type":"receipts","data":{"messageKeys":["0f3a","b7c2"]}}`, ""},
+		{"receipts without keys", `{"v":1,"type":"receipts","data":{}}`, "/data/messageKeys is required"},
+
+		{"presence of users", `{"v":1,"type":"presence","data":{"userIDs":[8,9]}}`, ""},
+		{"presence of an event", `{"v":1,"type":"presence","data":{"eventID":100}}`, ""},
+		{"presence of nobody", `{"v":1,"type":"presence","data":{"userIDs":[]}}`, "/data/userIDs must have at least 1 items"},
+		{"presence of user 0", `{"v":1,"type":"presence","data":{"userIDs":[8,0]}}`, "/data/userIDs/1 must be at least 1"},
+
+		{"presence_settings", `{"v":1,"type":"presence_settings","data":{"hidden":true}}`, ""},
+		{"presence_settings without hidden", `{"v":1,"type":"presence_settings","data":{}}`, "/data/hidden is required"},
+
+		{"ping", `{"v":1,"type":"ping","id":"p1"}`, ""},
+		{"ping with data", `{"v":1,"type":"ping","data":{}}`, ""},
+
+		{"unknown version", `{"v":2,"type":"ping"}`, "/v must be 1"},
+		{"version as a string", `{"v":"1","type":"ping"}`, "/v must be 1"},
+		{"without version", `{"type":"ping"}`, "/v is required"},
+		{"without type", `{"v":1}`, "/type is required"},
+		{"server frame type", `{"v":1,"type":"message","data":{}}`, "/type must be one of"},
+		{"unknown field", `{"v":1,"type":"ping","error":{}}`, "/error is not allowed"},
+		{"ID too long", `{"v":1,"type":"ping","id":"` + strings.Repeat("x", 65) + `"}`, "/id must be at most 64 characters long"},
+		{"data that is no object", `{"v":1,"type":"ping","data":[]}`, "/data must be of type object"},
+		{"frame that is no object", `[1]`, "/ must be of type object"},
+		{"frame that is no JSON", `{"v":1,`, "invalid JSON"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := Decode([]byte(test.frame))
+			switch {
+			case test.violation == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case test.violation == "" && envelope == nil:
+				t.Errorf("no envelope decoded")
+			case test.violation != "" && err == nil:
+				t.Errorf("accepted, want %q", test.violation)
+			case test.violation != "" && !strings.Contains(err.Error(), test.violation):
+				t.Errorf("refused with %q, want %q", err, test.violation)
+			}
+		})
+	}
+}
+
+// serverFrames validates against the server frame of the schema
+func serverFrames(t *testing.T) *Validator {
+	var root map[string]interface{}
+	if err := json.Unmarshal(Schema, &root); err != nil {
+		t.Fatal(err)
+	}
+	document, err := json.Marshal(map[string]interface{}{"$ref": "#/$defs/serverFrame", "$defs": root["$defs"]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validator, err := NewValidator(document)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return validator
+}
+
+func TestServerFrames(t *testing.T) {
+	validator := serverFrames(t)
+	tests := []struct {
+		name      string
+		frame     string
+		violation string
+	}{
+		{"message", `{"v":1,"type":"message","data":{"_id":null,"channel":"message","eventID":0,"senderID":8,"receiverID":9,"body":"hi","createdAt":"2026-10-19T08:00:00Z","messageKey":"0f3a"}}`, ""},
+		{"message with a string sender", `{"v":1,"type":"message","data":{"senderID":"8"}}`, "/data/senderID must be of type integer"},
+		{"accepted", `{"v":1,"type":"accepted","id":"s1","data":{"messageKey":"0f3a"}}`, ""},
+		{"accepted with a numeric key", `{"v":1,"type":"accepted","data":{"messageKey":1}}`, "/data/messageKey must be of type string"},
+		{"history result", `{"v":1,"type":"result","data":{"messages":[{"channel":"message","body":"hi"}],"next":"2026-10-19T08:00:00Z"}}`, ""},
+		{"unread counts result", `{"v":1,"type":"result","data":{"counts":[{"userID":9,"count":2}]}}`, ""},
+		{"unread count without count", `{"v":1,"type":"result","data":{"counts":[{"userID":9}]}}`, "/data must match exactly one"},
+		{"receipts result", `{"v":1,"type":"result","data":{"receipts":[{"messageKey":"0f3a","receivers":2,"delivered":1,"read":0,"users":[{"userID":9,"deliveredAt":"2026-10-19T08:00:00Z"}]}]}}`, ""},
+		{"presence result", `{"v":1,"type":"result","data":{"users":[{"userID":9,"online":true,"since":"2026-10-19T08:00:00Z"}]}}`, ""},
+		{"presence settings result", `{"v":1,"type":"result","data":{"hidden":false}}`, ""},
+		{"unknown result", `{"v":1,"type":"result","data":{"answer":42}}`, "/data must match exactly one"},
+		{"pong", `{"v":1,"type":"pong","id":"p1"}`, ""},
+		{"error", `{"v":1,"type":"error","id":"s1","error":{"code":"rate_limited","message":"Too many messages","retry_after":3}}`, ""},
+		{"error of an unknown code", `{"v":1,"type":"error","error":{"code":"oops","message":"?"}}`, "/error/code must be one of"},
+		{"error without message", `{"v":1,"type":"error","error":{"code":"muted"}}`, "/error/message is required"},
+		{"error retrying at once", `{"v":1,"type":"error","error":{"code":"rate_limited","message":"Too many messages","retry_after":0}}`, "/error/retry_after must be at least 1"},
+		{"client frame type", `{"v":1,"type":"send"}`, "/type must be one of"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := validator.Validate([]byte(test.frame))
+			switch {
+			case test.violation == "" && err != nil:
+				t.Errorf("refused: %v", err)
+			case test.violation != "" && err == nil:
+				t.Errorf("accepted, want %q", test.violation)
+			case test.violation != "" && !strings.Contains(err.Error(), test.violation):
+				t.Errorf("refused with %q, want %q", err, test.violation)
+			}
+		})
+	}
+}
+
+func TestValidatorRefusesUnresolvedReferences(t *testing.T) {
+	validator, err := NewValidator([]byte(`{"$ref":"#/$defs/missing"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validator.Validate([]byte(`{}`)); err == nil || !strings.Contains(err.Error(), "unresolved schema reference") {
+		t.Errorf("got %v, want an unresolved reference", err)
+	}
+	if _, err := NewValidator([]byte(`[]`)); err == nil {
+		t.Errorf("schema that is no object accepted")
+	}
+}
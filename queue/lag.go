@@ -0,0 +1,97 @@
+package queue
+
+import (
+	"github.com/Shopify/sarama"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const lagPollInterval = 15 * time.Second
+
+// consumedOffsets remembers the offset of the last record processed in every partition
+type consumedOffsets struct {
+	mutex   sync.Mutex
+	offsets map[string]map[int32]int64 //topic -> partition -> offset
+}
+
+func (consumed *consumedOffsets) mark(msg *sarama.ConsumerMessage) {
+	consumed.mutex.Lock()
+	defer consumed.mutex.Unlock()
+	if consumed.offsets == nil {
+		consumed.offsets = make(map[string]map[int32]int64)
+	}
+	if consumed.offsets[msg.Topic] == nil {
+		consumed.offsets[msg.Topic] = make(map[int32]int64)
+	}
+	consumed.offsets[msg.Topic][msg.Partition] = msg.Offset
+}
+
+// get returns -1 when nothing was consumed from the partition yet
+func (consumed *consumedOffsets) get(topic string, partition int32) int64 {
+	consumed.mutex.Lock()
+	defer consumed.mutex.Unlock()
+	offset, ok := consumed.offsets[topic][partition]
+	if !ok {
+		return -1
+	}
+	return offset
+}
+
+// pollLag publishes the consumer lag of every partition until the consumer is closed.
+// Nothing is measured while KafkaConsumer.broker_urls is empty
+func (consumer *Consumer) pollLag() {
+	ticker := time.NewTicker(lagPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-consumer.stop:
+			return
+		case <-ticker.C:
+			kafkaConfig := consumer.configHolder.Get().ConnectionsConfig.KafkaServer
+			if len(kafkaConfig.BrokerUrls) > 0 {
+				consumer.measureLag(kafkaConfig)
+			}
+		}
+	}
+}
+
+func (consumer *Consumer) measureLag(kafkaConfig config.KafkaConsumer) {
+	clientConfig := sarama.NewConfig()
+	clientConfig.Version = kafkaVersion(kafkaConfig)
+	client, err := sarama.NewClient(kafkaConfig.BrokerUrls, clientConfig)
+	if err != nil {
+		slog.Warn("Unable to connect to Kafka brokers to measure consumer lag", logging.Err(err))
+		return
+	}
+	defer client.Close()
+
+	for _, topic := range kafkaConfig.Topics {
+		partitions, err := client.Partitions(topic)
+		if err != nil {
+			slog.Warn("Unable to get partitions of topic", logging.Topic, topic, logging.Err(err))
+			continue
+		}
+		for _, partition := range partitions {
+			newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+			if err != nil {
+				slog.Warn("Unable to get newest offset", logging.Topic, topic, logging.Partition, partition, logging.Err(err))
+				continue
+			}
+			consumed := consumer.consumed.get(topic, partition)
+			if consumed < 0 {
+				// nothing consumed yet in this partition, the lag is unknown
+				continue
+			}
+			lag := newest - consumed - 1
+			if lag < 0 {
+				lag = 0
+			}
+			metrics.KafkaConsumerLag.WithLabelValues(topic, strconv.Itoa(int(partition))).Set(float64(lag))
+		}
+	}
+}
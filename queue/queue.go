@@ -0,0 +1,165 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/Shopify/sarama"
+	"github.com/wvanbergen/kafka/consumergroup"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+const joinRetryInterval = time.Second
+
+// Handler processes a record consumed from Kafka
+type Handler func(msg *sarama.ConsumerMessage)
+
+// Consumer reads the configured topics as a member of the consumer group and passes every record to the handler
+type Consumer struct {
+	configHolder *config.Holder
+	handler      Handler
+	reload       chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+	consumed     consumedOffsets
+	joined       atomic.Bool
+}
+
+func NewConsumer(configHolder *config.Holder, handler Handler) *Consumer {
+	return &Consumer{
+		configHolder: configHolder,
+		handler:      handler,
+		reload:       make(chan struct{}, 1),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Start joins the consumer group in the background, joining is retried until it succeeds or the consumer is closed
+func (consumer *Consumer) Start(ctx context.Context) error {
+	slog.Info("Creating server connection...")
+	go consumer.run()
+	go consumer.pollLag()
+	return nil
+}
+
+// Close leaves the consumer group and waits for the record being processed
+func (consumer *Consumer) Close() error {
+	close(consumer.stop)
+	<-consumer.done
+	return nil
+}
+
+// Check fails while the consumer is not a member of the consumer group, e.g. during the join retries
+func (consumer *Consumer) Check(ctx context.Context) error {
+	if !consumer.joined.Load() {
+		return errors.New("not a member of the consumer group")
+	}
+	return nil
+}
+
+// ApplyConfig makes the consumer leave the group and join it again when the Kafka settings change, topics included.
+// The sockets are not touched
+func (consumer *Consumer) ApplyConfig(previous config.GlobalConfig, current config.GlobalConfig) {
+	if reflect.DeepEqual(previous.ConnectionsConfig.KafkaServer, current.ConnectionsConfig.KafkaServer) {
+		return
+	}
+	slog.Info("Kafka consumer settings changed, rejoining consumer group", "topics", current.ConnectionsConfig.KafkaServer.Topics)
+	select {
+	case consumer.reload <- struct{}{}:
+	default:
+	}
+}
+
+func (consumer *Consumer) run() {
+
+	defer close(consumer.done)
+
+	for {
+		cg := consumer.joinConsumerGroup()
+		if cg == nil {
+			return
+		}
+		consumer.joined.Store(true)
+		stopped := consumer.consumeMessagesFromQueue(cg)
+		consumer.joined.Store(false)
+		err := cg.Close()
+		if err != nil {
+			slog.Error("Error while closing queue consumer group", logging.Err(err))
+		}
+		if stopped {
+			return
+		}
+	}
+
+}
+
+// joinConsumerGroup joins with the Kafka settings of the moment, read again for every attempt so that a reload
+// during the retries applies to the next one at once. It returns nil when the consumer is closed before it could join
+func (consumer *Consumer) joinConsumerGroup() *consumergroup.ConsumerGroup {
+
+	for {
+		kafkaConfig := consumer.configHolder.Get().ConnectionsConfig.KafkaServer
+		cg, err := consumergroup.JoinConsumerGroup(kafkaConfig.CGroup, kafkaConfig.Topics, kafkaConfig.ServerUrls, consumerConfig(kafkaConfig))
+		if err == nil {
+			slog.Info("Connected to queue successfully", "topics", kafkaConfig.Topics)
+			return cg
+		}
+		slog.Warn("Unable to join consumer group, retrying", "c_group", kafkaConfig.CGroup, logging.Err(err))
+		select {
+		case <-consumer.stop:
+			return nil
+		case <-consumer.reload:
+			slog.Info("Kafka consumer settings changed, joining with them")
+		case <-time.After(joinRetryInterval):
+		}
+	}
+}
+
+// consumerConfig returns the settings the group is joined with. Sarama speaks the protocol of Kafka 0.8.2 unless
+// told the version of the brokers, its records would then have neither headers nor timestamps
+func consumerConfig(kafkaConfig config.KafkaConsumer) *consumergroup.Config {
+	kafkaConfiguration := consumergroup.NewConfig()
+	kafkaConfiguration.Offsets.Initial = sarama.OffsetOldest
+	kafkaConfiguration.Offsets.ProcessingTimeout = 10 * time.Second
+	kafkaConfiguration.Config.Version = kafkaVersion(kafkaConfig)
+	return kafkaConfiguration
+}
+
+// kafkaVersion returns KafkaConsumer.version, which is checked when the configuration is loaded
+func kafkaVersion(kafkaConfig config.KafkaConsumer) sarama.KafkaVersion {
+	version, err := sarama.ParseKafkaVersion(kafkaConfig.Version)
+	if err != nil {
+		return sarama.V0_11_0_0
+	}
+	return version
+}
+
+// consumeMessagesFromQueue processes records until the Kafka settings are reloaded or the consumer is closed.
+// It returns true in the latter case
+func (consumer *Consumer) consumeMessagesFromQueue(cg *consumergroup.ConsumerGroup) bool {
+
+	slog.Info("Starting receiving messages from queue")
+	for {
+		select {
+		case msg := <-cg.Messages():
+			err := cg.CommitUpto(msg)
+			if err != nil {
+				slog.Error("Error commit zookeeper", logging.Topic, msg.Topic, logging.Partition, msg.Partition, logging.Offset, msg.Offset, logging.Err(err))
+			}
+			consumer.handler(msg)
+			consumer.consumed.mark(msg)
+		case <-consumer.reload:
+			slog.Info("Leaving consumer group to apply new Kafka settings")
+			return false
+		case <-consumer.stop:
+			slog.Info("Leaving consumer group")
+			return true
+		}
+	}
+
+}
@@ -0,0 +1,35 @@
+package queue
+
+import (
+	"github.com/Shopify/sarama"
+	"partyfy-message-service/config"
+	"testing"
+)
+
+func TestConsumerConfigSpeaksTheVersionOfTheBrokers(t *testing.T) {
+	tests := []struct {
+		version string
+		want    sarama.KafkaVersion
+	}{
+		{"2.0.0", sarama.V2_0_0_0},
+		{"0.11.0.0", sarama.V0_11_0_0},
+		// Refused when the configuration is loaded, headers are still asked for
+		{"", sarama.V0_11_0_0},
+	}
+	for _, test := range tests {
+		kafkaConfiguration := consumerConfig(config.KafkaConsumer{Version: test.version})
+		if got := kafkaConfiguration.Config.Version; got != test.want {
+			t.Errorf("version %q: got %v, want %v", test.version, got, test.want)
+		}
+		if !kafkaConfiguration.Config.Version.IsAtLeast(sarama.V0_11_0_0) {
+			t.Errorf("version %q: records would have no headers", test.version)
+		}
+	}
+}
+
+func TestDefaultVersionCarriesHeaders(t *testing.T) {
+	version, err := sarama.ParseKafkaVersion(config.Defaults().ConnectionsConfig.KafkaServer.Version)
+	if err != nil || !version.IsAtLeast(sarama.V0_11_0_0) {
+		t.Errorf("default version: got %v, %v", version, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"log/slog"
+	"os"
+	"partyfy-message-service/config"
+	"partyfy-message-service/db"
+	"partyfy-message-service/logging"
+)
+
+// Re-encrypts stored message bodies with the active master key. Run it after adding a new key to the keyring
+// and making it active; old keys must stay in the keyring until it finishes
+func main() {
+
+	configPath := flag.String("config", "", "path of the JSON, YAML or TOML configuration file; "+config.PathEnv+" is used when empty")
+	flag.Parse()
+
+	configHolder, err := config.NewHolder(*configPath)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	logging.Setup(configHolder.Get().ConnectionsConfig.Logging)
+	store, err := db.NewStore(configHolder.Get().ConnectionsConfig.Storage)
+	if err == nil {
+		err = store.Start(context.Background())
+	}
+	if err != nil {
+		slog.Error("Unable to open storage", logging.Err(err))
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	slog.Info("Re-encrypting messages...")
+	updated, err := db.Reencrypt(context.Background(), store)
+	if err != nil {
+		slog.Error("Re-encryption failed", "updated", updated, logging.Err(err))
+		store.Close()
+		os.Exit(1)
+	}
+	slog.Info("Re-encryption finished", "updated", updated)
+
+}
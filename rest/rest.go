@@ -1,101 +1,215 @@
 package rest
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
+	neturl "net/url"
 	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/tracing"
 	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	getEventByMemberIdPath   = "/event/get_ids_by_member_id/"
 	getUsersIdsByEventIdPath = "/user/get_users_ids_by_event_id/"
+	getRelationPath          = "/user/get_relation/"
 	loginPath                = "/user/login/?username=message-processor&secret=password"
 )
 
-var baseURL string
-var token = ""
+// Client talks to the Main Event Processor. It logs in on Start and again on the first request after a failure
+type Client struct {
+	sessionMutex sync.RWMutex
+	baseURL      string
+	token        string
+	httpClient   *http.Client
+}
 
-func init() {
-	baseURL = config.GetConfig().ConnectionsConfig.EventProcessor.Url
-	token, _ = login()
+func NewClient(eventProcessorConfig config.EventProcessor) *Client {
+	return &Client{
+		baseURL:    eventProcessorConfig.Url,
+		httpClient: &http.Client{},
+	}
 }
 
-func login() (string, error) {
+// Start tries to login. A failed login is not fatal, every request retries it
+func (client *Client) Start(ctx context.Context) error {
+	_, _ = client.login(ctx)
+	return nil
+}
 
-	if token != "" {
-		return token, nil
+// Check fails when the client has no session with the Main Event Processor and can not log in
+func (client *Client) Check(ctx context.Context) error {
+	token, err := client.login(ctx)
+	if err != nil {
+		return err
+	}
+	if token == "" {
+		return errors.New("login to Main Event Processor refused")
 	}
+	return nil
+}
+
+func (client *Client) Close() error {
+	client.httpClient.CloseIdleConnections()
+	return nil
+}
 
-	log.Println("Trying to login to Main Event Processor")
+// ApplyConfig points the client to the new Main Event Processor. The next request logs in there again
+func (client *Client) ApplyConfig(previous config.GlobalConfig, current config.GlobalConfig) {
+	url := current.ConnectionsConfig.EventProcessor.Url
+	if url == previous.ConnectionsConfig.EventProcessor.Url {
+		return
+	}
+	slog.Info("Main Event Processor url changed", "url", url)
+	client.sessionMutex.Lock()
+	client.baseURL = url
+	client.token = ""
+	client.sessionMutex.Unlock()
+}
 
-	url := baseURL + loginPath
-	body, status, err := performGet(url)
-	if status != 200 || err != nil {
-		log.Println("Failed to login with url : ", loginPath, "Will retry to login each request:", err)
+func (client *Client) getBaseURL() string {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	return client.baseURL
+}
+
+func (client *Client) getToken() string {
+	client.sessionMutex.RLock()
+	defer client.sessionMutex.RUnlock()
+	return client.token
+}
+
+func (client *Client) login(ctx context.Context) (string, error) {
+
+	if currentToken := client.getToken(); currentToken != "" {
+		return currentToken, nil
+	}
+
+	slog.Debug("Trying to login to Main Event Processor")
+
+	loginURL := client.getBaseURL()
+	body, status, err := client.performGet(ctx, "login", loginURL+loginPath)
+	if err != nil {
+		slog.Warn("Failed to login to Main Event Processor. Will retry to login each request", "url", loginURL, "status", status, logging.Err(err))
 		return "", err
 	}
 
-	log.Println("Login successful. Token is: ", string(body[:10]), "....")
+	slog.Info("Login to Main Event Processor successful")
+	client.sessionMutex.Lock()
+	if client.baseURL == loginURL {
+		client.token = string(body)
+	}
+	client.sessionMutex.Unlock()
 	return string(body), nil
 }
 
-func GetEventsIDsMemberID(userID int) (eventIds []int64, err error) {
+func (client *Client) GetEventsIDsMemberID(ctx context.Context, userID int) (eventIds []int64, err error) {
 
-	log.Println("Getting events for user with id : ", userID)
+	slog.Debug("Getting events for user", logging.UserID, userID)
 
-	if token, err = login(); err != nil {
-		log.Println("Will not perform request without token: ",err)
+	if _, err = client.login(ctx); err != nil {
+		slog.Warn("Will not perform request without token", logging.UserID, userID, logging.Err(err))
 		return nil, err
 	}
 
-	url := baseURL + getEventByMemberIdPath + strconv.FormatInt(int64(userID), 10) + "/"
-	body, status, err := performGet(url)
-	if status == 200 {
-		err = json.Unmarshal(body, &eventIds)
-		return eventIds, err
+	url := client.getBaseURL() + getEventByMemberIdPath + strconv.FormatInt(int64(userID), 10) + "/"
+	body, _, err := client.performGet(ctx, "get_events_ids_by_member_id", url)
+	if err != nil {
+		return nil, err
 	}
-	return nil, err
+	err = json.Unmarshal(body, &eventIds)
+	return eventIds, err
 }
 
-func GetUserIDsByEventID(eventId int64) (userIds []int, err error) {
+func (client *Client) GetUserIDsByEventID(ctx context.Context, eventId int64) (userIds []int, err error) {
 
-	if token, err = login(); err != nil {
-		log.Println("Will not perform request without token: ",err)
+	if _, err = client.login(ctx); err != nil {
+		slog.Warn("Will not perform request without token", logging.EventID, eventId, logging.Err(err))
 		return nil, err
 	}
 
-	url := baseURL + getUsersIdsByEventIdPath + strconv.FormatInt(eventId, 10) + "/"
-	body, status, err := performGet(url)
-	if status == 200 {
-		err = json.Unmarshal(body, &userIds)
+	url := client.getBaseURL() + getUsersIdsByEventIdPath + strconv.FormatInt(eventId, 10) + "/"
+	body, _, err := client.performGet(ctx, "get_user_ids_by_event_id", url)
+	if err != nil {
+		return nil, err
 	}
+	err = json.Unmarshal(body, &userIds)
 	return userIds, err
 }
 
-func performGet(url string) (body []byte, status int, err error) {
+// Relation is how a user stands towards another one
+type Relation struct {
+	Related bool `json:"related"`
+	Blocked bool `json:"blocked"` //either user blocked the other
+}
+
+func (client *Client) GetRelation(ctx context.Context, userID int, otherUserID int) (relation Relation, err error) {
+
+	if _, err = client.login(ctx); err != nil {
+		slog.Warn("Will not perform request without token", logging.UserID, userID, logging.Err(err))
+		return relation, err
+	}
+
+	url := client.getBaseURL() + getRelationPath + strconv.Itoa(userID) + "/" + strconv.Itoa(otherUserID) + "/"
+	body, _, err := client.performGet(ctx, "get_relation", url)
+	if err != nil {
+		return relation, err
+	}
+	err = json.Unmarshal(body, &relation)
+	return relation, err
+}
 
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Add("AUTHORIZATION", token)
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// performGet records the request duration under operation and traces the request, the trace context is sent along.
+// Transport errors and status codes other than 2xx are returned as errors, callers never take them for an answer
+func (client *Client) performGet(ctx context.Context, operation string, url string) (body []byte, status int, err error) {
+
+	ctx, span := tracing.Tracer().Start(ctx, "event_processor."+operation, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", "GET")))
+	start := time.Now()
+	defer func() {
+		metrics.ObserveDuration(metrics.EventProcessorDuration, metrics.EventProcessorErrors, operation, start, err)
+		span.SetAttributes(attribute.Int("http.response.status_code", status))
+		tracing.End(span, err)
+	}()
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", url, nil)
+	req.Header.Add("AUTHORIZATION", client.getToken())
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+	resp, err := client.httpClient.Do(req)
 	if err != nil {
-		log.Println("Unable to to perform GET request for URL : ", url, "; ", err)
+		// the error text repeats the URL, and the login URL holds the secret
+		if urlErr, ok := err.(*neturl.Error); ok {
+			err = urlErr.Err
+		}
+		slog.Error("Unable to perform GET request", "operation", operation, "url", url, logging.Err(err))
 		return nil, 0, err
 	}
 	defer resp.Body.Close()
 
 	status = resp.StatusCode
-	if status == 200 || status == 201 {
-		body, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			log.Println("Unable to read body from response", err)
-			return nil, 0, err
-		}
-		return body, status, nil
+	if status < 200 || status > 299 {
+		err = fmt.Errorf("%s answered %d %s", operation, status, http.StatusText(status))
+		slog.Warn("Main Event Processor refused request", "operation", operation, "status", status)
+		return nil, status, err
+	}
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		slog.Error("Unable to read body from response", "operation", operation, logging.Err(err))
+		return nil, 0, err
 	}
-	return nil, status, nil
+	return body, status, nil
 
 }
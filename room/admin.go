@@ -0,0 +1,179 @@
+package room
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/persistient"
+	"strconv"
+	"time"
+)
+
+const (
+	adminExportPath = "/admin/users/export"
+	adminErasePath  = "/admin/users/erase"
+	adminReloadPath = "/admin/config/reload"
+)
+
+// serveUserExport answers a data subject access request with every message where the user is sender or receiver.
+// The result is a JSON array, or a ZIP archive holding that array when format=zip is requested
+func (room *Room) serveUserExport(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter expected", http.StatusBadRequest)
+		return
+	}
+
+	fileName := "user-" + strconv.Itoa(userID) + "-messages.json"
+	var out io.Writer = w
+	var archive *zip.Writer
+	if r.URL.Query().Get("format") == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", "attachment; filename=\"user-"+strconv.Itoa(userID)+"-messages.zip\"")
+		archive = zip.NewWriter(w)
+		out, err = archive.Create(fileName)
+		if err != nil {
+			slog.Error("Unable to create export archive", logging.UserID, userID, logging.Err(err))
+			http.Error(w, "Unable to create export archive", http.StatusInternalServerError)
+			return
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+fileName+"\"")
+	}
+
+	err = room.writeUserMessages(r.Context(), out, userID)
+	if archive != nil {
+		if closeErr := archive.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		slog.Error("Export of user failed", logging.UserID, userID, logging.Err(err))
+		return
+	}
+
+	room.writeAuditRecord(r, persistient.AuditRecord{Action: "export", UserID: userID})
+}
+
+// serveUserErase removes everything stored about the user. Their connections to this replica are closed first, and
+// the erase waits until the messages they left queued are stored back so that none outlives it. Connections to other
+// replicas are not closed, whatever they store afterwards outlives the erase
+func (room *Room) serveUserErase(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "POST or DELETE expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter expected", http.StatusBadRequest)
+		return
+	}
+
+	for _, entry := range room.disconnectUser(userID) {
+		if !entry.wait(r.Context()) {
+			slog.Warn("Erase of user abandoned before their connections stopped", logging.UserID, userID, logging.Err(r.Context().Err()))
+			http.Error(w, "Connections of the user did not stop, nothing was erased", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	deleted, anonymized, err := room.store.EraseUser(r.Context(), userID)
+	if err != nil {
+		http.Error(w, "Unable to erase user messages", http.StatusInternalServerError)
+		return
+	}
+
+	record := persistient.AuditRecord{Action: "erase", UserID: userID, Deleted: deleted, Anonymized: anonymized}
+	record = room.writeAuditRecord(r, record)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(record)
+}
+
+// serveConfigReload does the same as SIGHUP: reloads the configuration and applies what can change live
+func (room *Room) serveConfigReload(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := room.configHolder.Reload()
+	switch err.(type) {
+	case nil:
+		w.WriteHeader(http.StatusNoContent)
+	case config.RestartRequiredError:
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, "Configuration was not reloaded: "+err.Error(), http.StatusUnprocessableEntity)
+	}
+}
+
+func (room *Room) isAdminRequest(w http.ResponseWriter, r *http.Request) bool {
+	adminToken := room.currentConfig().ConnectionsConfig.Admin.Token
+	requestToken := r.Header.Get("AUTHORIZATION")
+	if adminToken == "" || subtle.ConstantTimeCompare([]byte(adminToken), []byte(requestToken)) != 1 {
+		slog.Warn("Rejected admin request", "remote_addr", r.RemoteAddr, "path", r.URL.Path)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func (room *Room) writeAuditRecord(r *http.Request, record persistient.AuditRecord) persistient.AuditRecord {
+	record.Requester = r.RemoteAddr
+	record.Time = time.Now().UTC()
+	// The trail is written even when the requester went away
+	if err := room.store.InsertAudit(context.WithoutCancel(r.Context()), record); err != nil {
+		slog.Error("Unable to write audit record", logging.UserID, record.UserID, "action", record.Action, logging.Err(err))
+	}
+	return record
+}
+
+func (room *Room) writeUserMessages(ctx context.Context, out io.Writer, userID int) error {
+
+	if _, err := io.WriteString(out, "["); err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(out)
+	first := true
+	err := room.store.FindByUserID(ctx, userID, func(message persistient.EventMessage, err error) error {
+		if err != nil {
+			return err
+		}
+		if !first {
+			if _, err = io.WriteString(out, ","); err != nil {
+				return err
+			}
+		}
+		first = false
+		return encoder.Encode(message)
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(out, "]")
+	return err
+}
@@ -0,0 +1,188 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"net/http"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+)
+
+const (
+	adminConnectionsPath = "/admin/connections"
+	adminBacklogPath     = "/admin/users/backlog"
+	adminDisconnectPath  = "/admin/users/disconnect"
+	adminInjectPath      = "/admin/users/message"
+	metricsPath          = "/metrics"
+
+	injectedChannel = "admin-test"
+)
+
+// AdminServer serves the admin API, the metrics and the health checks on their own port, away from the client
+// listener. Every admin endpoint needs the admin token in the AUTHORIZATION header, the others are open
+type AdminServer struct {
+	room          *Room
+	server        *http.Server
+	extraHandlers map[string]http.Handler //pattern -> handler, served without the admin token
+}
+
+func NewAdminServer(room *Room) *AdminServer {
+	return &AdminServer{room: room}
+}
+
+// Start listens on Admin.listen_port. It returns once the port is bound
+func (admin *AdminServer) Start(ctx context.Context) error {
+
+	listenPort := admin.room.currentConfig().ConnectionsConfig.Admin.ListenPort
+	listener, err := net.Listen("tcp", listenPort)
+	if err != nil {
+		slog.Error("Error while listening to admin requests", "listen_port", listenPort, logging.Err(err))
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminExportPath, admin.room.serveUserExport)
+	mux.HandleFunc(adminErasePath, admin.room.serveUserErase)
+	mux.HandleFunc(adminReloadPath, admin.room.serveConfigReload)
+	mux.HandleFunc(adminConnectionsPath, admin.room.serveConnections)
+	mux.HandleFunc(adminBacklogPath, admin.room.serveUserBacklog)
+	mux.HandleFunc(adminDisconnectPath, admin.room.serveUserDisconnect)
+	mux.HandleFunc(adminInjectPath, admin.room.serveMessageInjection)
+	mux.Handle(metricsPath, metrics.Handler())
+	for pattern, handler := range admin.extraHandlers {
+		mux.Handle(pattern, handler)
+	}
+	admin.server = &http.Server{Handler: mux}
+
+	slog.Info("Waiting for admin requests", "listen_port", listenPort)
+	go func() {
+		if err := admin.server.Serve(listener); err != http.ErrServerClosed {
+			slog.Error("Error while listening to admin requests", logging.Err(err))
+		}
+	}()
+	return nil
+}
+
+// Handle serves handler on the admin listener, without the admin token. It must be called before Start
+func (admin *AdminServer) Handle(pattern string, handler http.Handler) {
+	if admin.extraHandlers == nil {
+		admin.extraHandlers = make(map[string]http.Handler)
+	}
+	admin.extraHandlers[pattern] = handler
+}
+
+func (admin *AdminServer) Close() error {
+	if admin.server == nil {
+		return nil
+	}
+	return admin.server.Shutdown(context.Background())
+}
+
+// serveConnections lists the connected users with the metadata of their connection
+func (room *Room) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, room.ConnectionInfos())
+}
+
+// serveUserBacklog tells how many stored messages wait for the user
+func (room *Room) serveUserBacklog(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter expected", http.StatusBadRequest)
+		return
+	}
+
+	unsent, err := room.store.CountUnsentByReceiverID(r.Context(), userID)
+	if err != nil {
+		slog.Error("Unable to count unsent messages of user", logging.UserID, userID, logging.Err(err))
+		http.Error(w, "Unable to count unsent messages", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"user_id":   userID,
+		"connected": room.connected(userID),
+		"unsent":    unsent,
+	})
+}
+
+// serveUserDisconnect closes the live socket of the user. Messages keep being stored for them
+func (room *Room) serveUserDisconnect(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter expected", http.StatusBadRequest)
+		return
+	}
+
+	if len(room.disconnectUser(userID)) == 0 {
+		http.Error(w, "User is not connected", http.StatusNotFound)
+		return
+	}
+	slog.Info("User disconnected by admin request", logging.UserID, userID, "remote_addr", r.RemoteAddr)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveMessageInjection routes a test message to the user like any other one: it is delivered when the user
+// is connected and stored otherwise. The request body is {"channel": ..., "body": ...}, channel defaults to admin-test
+func (room *Room) serveMessageInjection(w http.ResponseWriter, r *http.Request) {
+
+	if !room.isAdminRequest(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "POST expected", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter expected", http.StatusBadRequest)
+		return
+	}
+
+	var injected struct {
+		Channel string      `json:"channel"`
+		Body    interface{} `json:"body"`
+	}
+	if err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&injected); err != nil {
+		http.Error(w, "JSON body with channel and body expected", http.StatusBadRequest)
+		return
+	}
+	if injected.Channel == "" {
+		injected.Channel = injectedChannel
+	}
+
+	connected := room.connected(userID)
+	message := &persistient.EventMessage{ReceiverID: userID, Channel: injected.Channel, Body: injected.Body}
+	room.sendMessageToUser(r.Context(), message)
+	slog.Info("Message injected by admin request", logging.UserID, userID, "channel", injected.Channel, "connected", connected)
+
+	writeJSON(w, http.StatusAccepted, map[string]interface{}{
+		"user_id":   userID,
+		"connected": connected,
+		"trace_id":  message.TraceID,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(value)
+}
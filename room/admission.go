@@ -0,0 +1,120 @@
+package room
+
+import (
+	"net"
+	"net/http"
+	"partyfy-message-service/config"
+	"sync"
+	"time"
+)
+
+// retryAfter is suggested to the clients refused because the service is full
+const retryAfter = 5 * time.Second
+
+// Reasons a connection is refused, also the label of the rejected connections metric
+const (
+	rejectPoolFull    = "pool_full"
+	rejectIPLimit     = "ip_limit"
+	rejectUserLimit   = "user_limit"
+	rejectRateLimited = "rate_limited"
+)
+
+// admission counts the open sockets and decides, before the upgrade, whether a new one is accepted
+type admission struct {
+	mutex   sync.Mutex
+	open    int
+	perIP   map[string]int //remote address -> open sockets
+	perUser map[int]int    //userID -> open sockets
+	connect tokenBucket
+	sends   map[string]int //remote address -> send requests being served
+	send    tokenBucket
+}
+
+func newAdmission() *admission {
+	return &admission{
+		perIP:   make(map[string]int),
+		perUser: make(map[int]int),
+		sends:   make(map[string]int),
+	}
+}
+
+// admit reserves a socket for the user connecting from ip. When it is refused the reason and the time
+// the client should wait before retrying are returned, release must be called otherwise
+func (gate *admission) admit(ip string, userID int, limits config.Client) (reason string, wait time.Duration) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	switch {
+	case gate.open >= limits.MaxConnectionPoolSize:
+		return rejectPoolFull, retryAfter
+	case limits.MaxConnectionsPerIP > 0 && gate.perIP[ip] >= limits.MaxConnectionsPerIP:
+		return rejectIPLimit, retryAfter
+	case limits.MaxConnectionsPerUser > 0 && gate.perUser[userID] >= limits.MaxConnectionsPerUser:
+		return rejectUserLimit, retryAfter
+	}
+	if allowed, wait := gate.connect.take(limits.ConnectRate, limits.ConnectBurst, time.Now()); !allowed {
+		return rejectRateLimited, wait
+	}
+
+	gate.open++
+	gate.perIP[ip]++
+	gate.perUser[userID]++
+	return "", 0
+}
+
+// release frees the socket reserved by admit
+func (gate *admission) release(ip string, userID int) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	gate.open--
+	if gate.perIP[ip]--; gate.perIP[ip] <= 0 {
+		delete(gate.perIP, ip)
+	}
+	if gate.perUser[userID]--; gate.perUser[userID] <= 0 {
+		delete(gate.perUser, userID)
+	}
+}
+
+// admitSend reserves a send request from ip under the same per address cap and rate as sockets. Sends are
+// counted apart from the sockets, a client holding as many as it may still sends; releaseSend must be called
+// once the request is served
+func (gate *admission) admitSend(ip string, limits config.Client) (reason string, wait time.Duration) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+
+	if limits.MaxConnectionsPerIP > 0 && gate.sends[ip] >= limits.MaxConnectionsPerIP {
+		return rejectIPLimit, retryAfter
+	}
+	if allowed, wait := gate.send.take(limits.ConnectRate, limits.ConnectBurst, time.Now()); !allowed {
+		return rejectRateLimited, wait
+	}
+	gate.sends[ip]++
+	return "", 0
+}
+
+// releaseSend frees the send request reserved by admitSend
+func (gate *admission) releaseSend(ip string) {
+	gate.mutex.Lock()
+	defer gate.mutex.Unlock()
+	if gate.sends[ip]--; gate.sends[ip] <= 0 {
+		delete(gate.sends, ip)
+	}
+}
+
+// remoteIP returns the address the request comes from, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rejectionStatus is the HTTP status answered to a refused connection: the caps of a single client are
+// reported as too many requests, a full service as unavailable
+func rejectionStatus(reason string) int {
+	if reason == rejectIPLimit || reason == rejectUserLimit {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
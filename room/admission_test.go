@@ -0,0 +1,51 @@
+package room
+
+import (
+	"partyfy-message-service/config"
+	"testing"
+)
+
+func TestAdmitSendCapsTheSendsOfAnAddress(t *testing.T) {
+	gate := newAdmission()
+	limits := config.Client{MaxConnectionPoolSize: 1, MaxConnectionsPerIP: 2}
+	if reason, _ := gate.admit("10.0.0.1", 1, limits); reason != "" {
+		t.Fatalf("socket refused: %s", reason)
+	}
+
+	// The sockets of the address do not count, the service being full neither
+	for i := 0; i < 2; i++ {
+		if reason, _ := gate.admitSend("10.0.0.1", limits); reason != "" {
+			t.Fatalf("send %d refused: %s", i, reason)
+		}
+	}
+	if reason, _ := gate.admitSend("10.0.0.1", limits); reason != rejectIPLimit {
+		t.Errorf("third send at once: got %q, want %q", reason, rejectIPLimit)
+	}
+	if reason, _ := gate.admitSend("10.0.0.2", limits); reason != "" {
+		t.Errorf("send of another address refused: %s", reason)
+	}
+	gate.releaseSend("10.0.0.1")
+	if reason, _ := gate.admitSend("10.0.0.1", limits); reason != "" {
+		t.Errorf("send after a release refused: %s", reason)
+	}
+}
+
+func TestAdmitSendFollowsTheConnectRate(t *testing.T) {
+	gate := newAdmission()
+	limits := config.Client{MaxConnectionPoolSize: 10, ConnectRate: 0.001, ConnectBurst: 2}
+	for i := 0; i < 2; i++ {
+		if reason, _ := gate.admitSend("10.0.0.1", limits); reason != "" {
+			t.Fatalf("send %d of the burst refused: %s", i, reason)
+		}
+		gate.releaseSend("10.0.0.1")
+	}
+	reason, wait := gate.admitSend("10.0.0.2", limits)
+	if reason != rejectRateLimited || wait <= 0 {
+		t.Errorf("send over the rate: got %q after %v, want %q", reason, wait, rejectRateLimited)
+	}
+
+	// Sends take their own tokens, sockets still connect
+	if reason, _ := gate.admit("10.0.0.1", 1, limits); reason != "" {
+		t.Errorf("socket refused after the sends: %s", reason)
+	}
+}
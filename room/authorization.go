@@ -0,0 +1,224 @@
+package room
+
+import (
+	"context"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"partyfy-message-service/rest"
+	"sync"
+	"time"
+)
+
+type membershipEntry struct {
+	eventIDs map[int64]bool
+	expires  time.Time
+}
+
+type eventMembersEntry struct {
+	userIDs []int
+	expires time.Time
+}
+
+type relationEntry struct {
+	allowed bool
+	expires time.Time
+}
+
+// authorizer decides whether a user may send to an event or to another user, caching the answers
+// of the Main Event Processor. It is safe for concurrent use
+type authorizer struct {
+	events    *rest.Client
+	mutex     sync.Mutex
+	members   map[int]membershipEntry       //userID -> events the user is a member of
+	relations map[int]map[int]relationEntry //senderID -> receiverID -> direct messages allowed
+	attendees map[int64]eventMembersEntry   //eventID -> members of the event
+	stores    int
+}
+
+func newAuthorizer(events *rest.Client) *authorizer {
+	return &authorizer{
+		events:    events,
+		members:   make(map[int]membershipEntry),
+		relations: make(map[int]map[int]relationEntry),
+		attendees: make(map[int64]eventMembersEntry),
+	}
+}
+
+// authorizeSender checks that the user may send the message, the error frame to answer is returned otherwise.
+// Messages are refused while the Main Event Processor can not answer
+func (room *Room) authorizeSender(ctx context.Context, userID int, message *persistient.EventMessage, logger *slog.Logger) *protocol.Error {
+	settings := room.currentConfig().ConnectionsConfig.Authorization
+	var allowed bool
+	var err error
+	var denied protocol.Error
+	switch {
+	case message.EventID != 0:
+		allowed, err = room.authorizer.canSendToEvent(ctx, userID, message.EventID, settings)
+		denied = protocol.Error{Code: protocol.ErrNotEventMember, Message: "You are not a member of this event"}
+	case message.ReceiverID != 0:
+		allowed, err = room.authorizer.canSendToUser(ctx, userID, message.ReceiverID, settings)
+		denied = protocol.Error{Code: protocol.ErrDirectMessageDenied, Message: "You can not send messages to this user"}
+	default:
+		return nil
+	}
+	if err != nil {
+		logger.Warn("Unable to authorize message", logging.EventID, message.EventID, "receiver_id", message.ReceiverID, logging.Err(err))
+		return &protocol.Error{Code: protocol.ErrAuthorizationUnavailable, Message: "Message could not be authorized, retry later"}
+	}
+	if !allowed {
+		logger.Info("Message refused", "code", denied.Code, logging.EventID, message.EventID, "receiver_id", message.ReceiverID)
+		return &denied
+	}
+	return nil
+}
+
+// canSendToEvent tells whether the user is a member of the event
+func (auth *authorizer) canSendToEvent(ctx context.Context, userID int, eventID int64, settings config.Authorization) (bool, error) {
+	eventIDs, err := auth.eventsOf(ctx, userID, settings)
+	return eventIDs[eventID], err
+}
+
+// eventsOf returns the events the user is a member of. The map must not be modified
+func (auth *authorizer) eventsOf(ctx context.Context, userID int, settings config.Authorization) (map[int64]bool, error) {
+	now := time.Now()
+	auth.mutex.Lock()
+	entry, cached := auth.members[userID]
+	auth.mutex.Unlock()
+	if cached && now.Before(entry.expires) {
+		return entry.eventIDs, nil
+	}
+
+	eventIDs, err := auth.events.GetEventsIDsMemberID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	entry = membershipEntry{eventIDs: make(map[int64]bool, len(eventIDs)), expires: now.Add(cacheDuration(settings))}
+	for _, memberOf := range eventIDs {
+		entry.eventIDs[memberOf] = true
+	}
+	auth.mutex.Lock()
+	auth.members[userID] = entry
+	auth.stored(now)
+	auth.mutex.Unlock()
+	return entry.eventIDs, nil
+}
+
+// membersOf returns the members of the event. The slice must not be modified
+func (auth *authorizer) membersOf(ctx context.Context, eventID int64, settings config.Authorization) ([]int, error) {
+	now := time.Now()
+	auth.mutex.Lock()
+	entry, cached := auth.attendees[eventID]
+	auth.mutex.Unlock()
+	if cached && now.Before(entry.expires) {
+		return entry.userIDs, nil
+	}
+
+	userIDs, err := auth.events.GetUserIDsByEventID(ctx, eventID)
+	if err != nil {
+		return nil, err
+	}
+	entry = eventMembersEntry{userIDs: userIDs, expires: now.Add(cacheDuration(settings))}
+	auth.mutex.Lock()
+	auth.attendees[eventID] = entry
+	auth.stored(now)
+	auth.mutex.Unlock()
+	return entry.userIDs, nil
+}
+
+// sharesEvent tells whether both users are members of a same event
+func (auth *authorizer) sharesEvent(ctx context.Context, userID int, otherID int, settings config.Authorization) (bool, error) {
+	eventIDs, err := auth.eventsOf(ctx, userID, settings)
+	if err != nil {
+		return false, err
+	}
+	otherEventIDs, err := auth.eventsOf(ctx, otherID, settings)
+	if err != nil {
+		return false, err
+	}
+	for eventID := range eventIDs {
+		if otherEventIDs[eventID] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// canSendToUser tells whether the sender may write to the receiver directly
+func (auth *authorizer) canSendToUser(ctx context.Context, senderID int, receiverID int, settings config.Authorization) (bool, error) {
+	if settings.DirectMessages == "any" {
+		return true, nil
+	}
+	now := time.Now()
+	auth.mutex.Lock()
+	entry, cached := auth.relations[senderID][receiverID]
+	auth.mutex.Unlock()
+	if cached && now.Before(entry.expires) {
+		return entry.allowed, nil
+	}
+
+	relation, err := auth.events.GetRelation(ctx, senderID, receiverID)
+	if err != nil {
+		return false, err
+	}
+	entry = relationEntry{allowed: relation.Related && !relation.Blocked, expires: now.Add(cacheDuration(settings))}
+	auth.mutex.Lock()
+	if auth.relations[senderID] == nil {
+		auth.relations[senderID] = make(map[int]relationEntry)
+	}
+	auth.relations[senderID][receiverID] = entry
+	auth.stored(now)
+	auth.mutex.Unlock()
+	return entry.allowed, nil
+}
+
+// forgetMember drops the cached events of the user and the cached members of the event, the membership changed
+func (auth *authorizer) forgetMember(userID int, eventID int64) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	delete(auth.members, userID)
+	delete(auth.attendees, eventID)
+}
+
+// forgetRelations drops the cached relations of the user with everyone, one of them changed
+func (auth *authorizer) forgetRelations(userID int) {
+	auth.mutex.Lock()
+	defer auth.mutex.Unlock()
+	delete(auth.relations, userID)
+	for _, receivers := range auth.relations {
+		delete(receivers, userID)
+	}
+}
+
+// stored removes the expired answers now and then, the mutex must be held
+func (auth *authorizer) stored(now time.Time) {
+	if auth.stores++; auth.stores%sweepEvery != 0 {
+		return
+	}
+	for userID, entry := range auth.members {
+		if now.After(entry.expires) {
+			delete(auth.members, userID)
+		}
+	}
+	for senderID, receivers := range auth.relations {
+		for receiverID, entry := range receivers {
+			if now.After(entry.expires) {
+				delete(receivers, receiverID)
+			}
+		}
+		if len(receivers) == 0 {
+			delete(auth.relations, senderID)
+		}
+	}
+	for eventID, entry := range auth.attendees {
+		if now.After(entry.expires) {
+			delete(auth.attendees, eventID)
+		}
+	}
+}
+
+func cacheDuration(settings config.Authorization) time.Duration {
+	return time.Duration(settings.CacheSeconds) * time.Second
+}
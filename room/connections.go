@@ -0,0 +1,85 @@
+package room
+
+import (
+	"net/http"
+	"sort"
+	"time"
+)
+
+// ConnectionInfo describes a live client connection for the admin API. The counters are a snapshot taken by ConnectionInfos
+type ConnectionInfo struct {
+	UserID           int       `json:"user_id"`
+	ConnectionID     int64     `json:"connection_id"`
+	RemoteAddr       string    `json:"remote_addr"`
+	ConnectedAt      time.Time `json:"connected_at"`
+	Transport        string    `json:"transport"`        //websocket, sse or poll
+	ProtocolVersion  string    `json:"protocol_version"` //Sec-WebSocket-Version of the handshake
+	Subprotocol      string    `json:"subprotocol,omitempty"`
+	UserAgent        string    `json:"user_agent,omitempty"`
+	ClientCert       string    `json:"client_cert,omitempty"` //subject of the verified TLS client certificate
+	MessagesSent     int64     `json:"messages_sent"`
+	MessagesReceived int64     `json:"messages_received"`
+}
+
+// Transports of the client connections
+const (
+	TransportWebSocket = "websocket"
+	TransportSSE       = "sse"
+	TransportPoll      = "poll"
+)
+
+func newConnectionInfo(userID int, connectionID int64, r *http.Request, transport string, subprotocol string) *ConnectionInfo {
+	var clientCert string
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		clientCert = r.TLS.VerifiedChains[0][0].Subject.String()
+	}
+	return &ConnectionInfo{
+		UserID:          userID,
+		ConnectionID:    connectionID,
+		RemoteAddr:      r.RemoteAddr,
+		ConnectedAt:     time.Now().UTC(),
+		Transport:       transport,
+		ProtocolVersion: r.Header.Get("Sec-Websocket-Version"),
+		Subprotocol:     subprotocol,
+		UserAgent:       r.UserAgent(),
+		ClientCert:      clientCert,
+	}
+}
+
+// connected tells whether the user has a live connection
+func (room *Room) connected(userID int) bool {
+	return len(room.connections.lookup(userID)) > 0
+}
+
+// countSent and countReceived update the counters of the connection
+func (entry *connection) countSent() {
+	entry.sent.Add(1)
+}
+
+func (entry *connection) countReceived() {
+	entry.received.Add(1)
+}
+
+// countPosted counts a message posted to the send endpoint on the event stream or poll of the user, if any
+func (room *Room) countPosted(userID int) {
+	for _, entry := range room.connections.lookup(userID) {
+		if entry.info.Transport != TransportWebSocket {
+			entry.countReceived()
+			return
+		}
+	}
+}
+
+// ConnectionInfos returns a copy of the metadata of every live connection, ordered by user ID
+func (room *Room) ConnectionInfos() []ConnectionInfo {
+	infos := make([]ConnectionInfo, 0, room.connections.size())
+	room.connections.forEach(func(userID int, entry *connection) bool {
+		copied := *entry.info
+		copied.MessagesSent = entry.sent.Load()
+		copied.MessagesReceived = entry.received.Load()
+		infos = append(infos, copied)
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].UserID < infos[j].UserID })
+	return infos
+}
@@ -0,0 +1,30 @@
+package room
+
+import (
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+)
+
+// ErrorChannel is the channel of the legacy frames telling a client that its message was refused
+const ErrorChannel = "error"
+
+// sendErrorFrame queues an error for the client in reply to the frame requestID. It goes through the outgoing
+// routine, the only writer of the socket
+func (room *Room) sendErrorFrame(entry *connection, userID int, requestID string, body protocol.Error) {
+	entry.enqueue(persistient.EventMessage{
+		ReceiverID: userID,
+		Channel:    ErrorChannel,
+		Body:       body,
+		Reply:      protocol.TypeError,
+		RequestID:  requestID,
+		Ephemeral:  true,
+	})
+}
+
+// reply queues a frame of the given type in reply to the frame requestID. Legacy clients get errors only
+func (room *Room) reply(entry *connection, userID int, requestID string, frameType string, data interface{}) {
+	if entry.version == legacyVersion {
+		return
+	}
+	entry.enqueue(persistient.EventMessage{ReceiverID: userID, Body: data, Reply: frameType, RequestID: requestID, Ephemeral: true})
+}
@@ -0,0 +1,169 @@
+package room
+
+import (
+	"partyfy-message-service/config"
+	"sync"
+	"time"
+)
+
+const (
+	// throttleWindow is the period the throttled messages of a user are counted in before a mute
+	throttleWindow = time.Minute
+	// muteMemory is how long a mute is remembered to escalate the next one
+	muteMemory = time.Hour
+	// sweepEvery is the number of checks between two removals of the idle senders and events
+	sweepEvery = 4096
+)
+
+// Reasons a client message is refused, also the label of the inbound rejected metric
+const (
+	throttleUserRate   = "user_rate"
+	throttleEventRate  = "event_rate"
+	throttleMuted      = "muted"
+	throttleSignalRate = "signal_rate"
+	rejectTooLarge     = "too_large"
+)
+
+// senderState is kept per user rather than per connection, reconnecting does not lift the limits
+type senderState struct {
+	bucket      tokenBucket
+	signals     tokenBucket //the signals of the user, spent apart from their messages
+	throttled   int         //messages refused for the rate since windowStart
+	windowStart time.Time
+	mutes       int //mutes since the last quiet muteMemory, each one doubles the next
+	mutedUntil  time.Time
+	notified    bool //the client was told about the current throttling, it is not told again until a message passes
+	lastSeen    time.Time
+}
+
+type eventState struct {
+	bucket   tokenBucket
+	lastSeen time.Time
+}
+
+// inboundLimiter throttles the messages the clients send, per user and per event. It is safe for concurrent use
+type inboundLimiter struct {
+	mutex   sync.Mutex
+	senders map[int]*senderState  //userID -> limits of the user
+	events  map[int64]*eventState //eventID -> limits of the event
+	checks  int
+}
+
+func newInboundLimiter() *inboundLimiter {
+	return &inboundLimiter{
+		senders: make(map[int]*senderState),
+		events:  make(map[int64]*eventState),
+	}
+}
+
+// allow spends the tokens of a message of the user to the event, eventID is 0 for direct messages.
+// A refused message gets the reason and the time to wait; notify is true when the client should be told
+func (limiter *inboundLimiter) allow(userID int, eventID int64, limits config.InboundLimits, now time.Time) (reason string, wait time.Duration, notify bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	sender := limiter.sender(userID, now)
+	if now.Before(sender.mutedUntil) {
+		return throttleMuted, sender.mutedUntil.Sub(now), sender.notify()
+	}
+	allowed, wait := sender.bucket.take(limits.Rate, limits.Burst, now)
+	if !allowed {
+		if sender.countThrottled(limits, now) {
+			return throttleMuted, sender.mutedUntil.Sub(now), sender.notify()
+		}
+		return throttleUserRate, wait, sender.notify()
+	}
+	if eventID != 0 {
+		event := limiter.events[eventID]
+		if event == nil {
+			event = &eventState{}
+			limiter.events[eventID] = event
+		}
+		event.lastSeen = now
+		if allowed, wait = event.bucket.take(limits.EventRate, limits.EventBurst, now); !allowed {
+			return throttleEventRate, wait, sender.notify()
+		}
+	}
+	sender.notified = false
+	return "", 0, false
+}
+
+// allowSignal spends the token of a signal of the user. Signals are refused while the user is muted too, but they
+// do not count towards a mute: clients send them on their own, without the user noticing
+func (limiter *inboundLimiter) allowSignal(userID int, limits config.Signals, now time.Time) (reason string, wait time.Duration) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	sender := limiter.sender(userID, now)
+	if now.Before(sender.mutedUntil) {
+		return throttleMuted, sender.mutedUntil.Sub(now)
+	}
+	if allowed, wait := sender.signals.take(limits.Rate, limits.Burst, now); !allowed {
+		return throttleSignalRate, wait
+	}
+	return "", 0
+}
+
+// sender returns the state of the user, created on their first message
+func (limiter *inboundLimiter) sender(userID int, now time.Time) *senderState {
+	if limiter.checks++; limiter.checks%sweepEvery == 0 {
+		limiter.sweep(now)
+	}
+	sender := limiter.senders[userID]
+	if sender == nil {
+		sender = &senderState{}
+		limiter.senders[userID] = sender
+	}
+	sender.lastSeen = now
+	return sender
+}
+
+// countThrottled records a message refused for the rate of the user and mutes them when they reach MuteAfter.
+// It returns true when the user was muted
+func (sender *senderState) countThrottled(limits config.InboundLimits, now time.Time) bool {
+	if now.Sub(sender.windowStart) > throttleWindow {
+		sender.windowStart = now
+		sender.throttled = 0
+	}
+	sender.throttled++
+	if limits.MuteAfter == 0 || sender.throttled < limits.MuteAfter {
+		return false
+	}
+
+	if now.Sub(sender.mutedUntil) > muteMemory {
+		sender.mutes = 0
+	}
+	duration := time.Duration(limits.MuteSeconds) * time.Second
+	maximum := time.Duration(limits.MaxMuteSeconds) * time.Second
+	for i := 0; i < sender.mutes && duration < maximum; i++ {
+		duration *= 2
+	}
+	if duration > maximum {
+		duration = maximum
+	}
+	sender.mutes++
+	sender.mutedUntil = now.Add(duration)
+	sender.throttled = 0
+	sender.notified = false
+	return true
+}
+
+func (sender *senderState) notify() bool {
+	notify := !sender.notified
+	sender.notified = true
+	return notify
+}
+
+// sweep forgets the users and events that have been quiet long enough for their state not to matter anymore
+func (limiter *inboundLimiter) sweep(now time.Time) {
+	for userID, sender := range limiter.senders {
+		if now.Sub(sender.lastSeen) > muteMemory && now.Sub(sender.mutedUntil) > muteMemory {
+			delete(limiter.senders, userID)
+		}
+	}
+	for eventID, event := range limiter.events {
+		if now.Sub(event.lastSeen) > throttleWindow {
+			delete(limiter.events, eventID)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package room
+
+import (
+	"encoding/json"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+)
+
+// legacyVersion is the protocol of the clients that did not negotiate a subprotocol: they send bare
+// EventMessage documents and receive them the same way
+const legacyVersion = 0
+
+// frameCodec returns the protocol version and the codec of a connection from its negotiated subprotocol
+func frameCodec(subprotocol string) (int, protocol.Codec) {
+	if codec, negotiated := protocol.CodecFor(subprotocol); negotiated {
+		return protocol.Version, codec
+	}
+	return legacyVersion, protocol.JSON
+}
+
+// decodeFrame reads a client frame. Legacy frames are turned into send envelopes, the server tells
+// their intent from which of receiverID and eventID is set; the ones of the signal channel into signal envelopes
+func decodeFrame(version int, raw []byte) (*protocol.Envelope, error) {
+	if version != legacyVersion {
+		return protocol.Decode(raw)
+	}
+	var message persistient.EventMessage
+	if err := json.Unmarshal(raw, &message); err != nil {
+		return nil, err
+	}
+	if message.Channel == SignalChannel {
+		return legacySignal(message)
+	}
+	data, err := json.Marshal(protocol.SendData{ReceiverID: message.ReceiverID, EventID: message.EventID, Body: message.Body})
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Envelope{Version: legacyVersion, Type: protocol.TypeSend, Data: data}, nil
+}
+
+// requestIDOf returns the ID of a frame that could not be decoded, if it has one, to correlate the error with it
+func requestIDOf(raw []byte) string {
+	var frame struct {
+		ID interface{} `json:"id"`
+	}
+	if json.Unmarshal(raw, &frame) != nil {
+		return ""
+	}
+	id, _ := frame.ID.(string)
+	return id
+}
+
+// encodeFrame returns what is written to the client for the message: the message itself on legacy
+// connections, an envelope otherwise. It returns false when the message is not meant for the connection
+func encodeFrame(version int, message *persistient.EventMessage) (interface{}, bool) {
+	if version == legacyVersion {
+		if message.Reply != "" && message.Reply != protocol.TypeError {
+			return nil, false
+		}
+		return message, true
+	}
+
+	envelope := protocol.Envelope{Version: protocol.Version, Type: message.Reply, ID: message.RequestID}
+	switch message.Reply {
+	case "":
+		envelope.Type = protocol.TypeMessage
+		envelope.Data, _ = json.Marshal(message)
+	case protocol.TypeError:
+		if body, ok := message.Body.(protocol.Error); ok {
+			envelope.Error = &body
+		}
+	default:
+		if message.Body != nil {
+			envelope.Data, _ = json.Marshal(message.Body)
+		}
+	}
+	return envelope, true
+}
@@ -2,47 +2,44 @@ package room
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
+	"partyfy-message-service/logging"
 )
 
-func unmarshalEventActionRecord(raw []byte) (record *EventActionRecord) {
+func unmarshalEventActionRecord(raw []byte, logger *slog.Logger) (record *EventActionRecord) {
 	record = new(EventActionRecord)
 	err := json.Unmarshal(raw, record)
 	if err != nil {
-		log.Println("Unable to unmarshal ", string(raw), "to EventUpdatedRecord")
-		log.Println(err)
+		logger.Error("Unable to unmarshal record to EventUpdatedRecord", "payload", string(raw), logging.Err(err))
 		return nil
 	}
 	return record
 }
 
-func unmarshalEventUserActionRecord(raw []byte) (record *EventUserActionRecord) {
+func unmarshalEventUserActionRecord(raw []byte, logger *slog.Logger) (record *EventUserActionRecord) {
 	record = new(EventUserActionRecord)
 	err := json.Unmarshal(raw, record)
 	if err != nil {
-		log.Println("Unable to unmarshal ", string(raw), "to EventUserActionRecord")
-		log.Println(err)
+		logger.Error("Unable to unmarshal record to EventUserActionRecord", "payload", string(raw), logging.Err(err))
 		return nil
 	}
 	return record
 }
 
-func unmarshalUserActionRecord(raw []byte) (record *UserActionRecord) {
+func unmarshalUserActionRecord(raw []byte, logger *slog.Logger) (record *UserActionRecord) {
 	record = new(UserActionRecord)
 	err := json.Unmarshal(raw, record)
 	if err != nil {
-		log.Println("Unable to unmarshal ", string(raw), "to EventUserActionRecord")
-		log.Println(err)
+		logger.Error("Unable to unmarshal record to EventUserActionRecord", "payload", string(raw), logging.Err(err))
 		return nil
 	}
 	return record
 }
-func unmarshalImageAddedRecord(raw []byte) (record *MultipleUserEventActionRecord) {
+func unmarshalImageAddedRecord(raw []byte, logger *slog.Logger) (record *MultipleUserEventActionRecord) {
 	record = new(MultipleUserEventActionRecord)
 	err := json.Unmarshal(raw, record)
 	if err != nil {
-		log.Println("Unable to unmarshal ", string(raw), "to MultipleUserEventActionRecord")
-		log.Println(err)
+		logger.Error("Unable to unmarshal record to MultipleUserEventActionRecord", "payload", string(raw), logging.Err(err))
 		return nil
 	}
 	return record
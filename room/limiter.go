@@ -0,0 +1,31 @@
+package room
+
+import (
+	"math"
+	"time"
+)
+
+// tokenBucket allows bursts of up to burst events and rate events per second on average.
+// The limits are passed on every call so that reloaded settings apply at once. It is not safe for concurrent use
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token when one is available. Otherwise it returns false and the time until the next token
+func (bucket *tokenBucket) take(rate float64, burst int, now time.Time) (bool, time.Duration) {
+	if rate <= 0 {
+		return true, 0
+	}
+	if bucket.last.IsZero() {
+		bucket.tokens = float64(burst)
+	} else {
+		bucket.tokens = math.Min(float64(burst), bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	}
+	bucket.last = now
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+}
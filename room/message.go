@@ -1,146 +1,422 @@
 package room
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/gorilla/websocket"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"math"
+	"partyfy-message-service/config"
 	"partyfy-message-service/db"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
 	"partyfy-message-service/persistient"
-	"partyfy-message-service/rest"
+	"partyfy-message-service/protocol"
+	"partyfy-message-service/tracing"
+	"time"
 )
 
 type MessageChannel chan persistient.EventMessage
-type EventMessagesChannel map[int]*MessageChannel
 
-func (room *Room) createMessageChannel(userId int) *MessageChannel {
-	//create user message channel ad it to MessageChannels and return a pointer
-	userMessageChannel := make(MessageChannel)
-	room.userChannels[userId] = &userMessageChannel
-	return &userMessageChannel
+// sendMessageToUser hands the message to every live connection of the receiver or stores it for later. Only the
+// first connection that queues it stores it once written, the others get copies.
+// The message carries the IDs of the routing span so that the delivery continues its trace
+func (room *Room) sendMessageToUser(ctx context.Context, message *persistient.EventMessage) {
+
+	ctx, span := tracing.Tracer().Start(ctx, "route.user",
+		trace.WithAttributes(tracing.UserID(message.ReceiverID), attribute.String("partyfy.channel", message.Channel)))
+	defer span.End()
+	message.TraceID, message.SpanID = tracing.IDs(span)
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = time.Now().UTC()
+	}
+
+	metrics.MessagesRouted.WithLabelValues(message.Channel).Inc()
+	queued := false
+	for _, entry := range room.connections.lookup(message.ReceiverID) {
+		copied := *message
+		copied.Copy = queued
+		if room.deliver(entry, copied) {
+			queued = true
+		}
+	}
+	span.SetAttributes(attribute.Bool("partyfy.online", queued))
+	if !queued {
+		room.storeUndelivered(ctx, *message)
+	}
 }
 
-func (room *Room) sendMessageToUser(message *persistient.EventMessage) {
+// deliver queues the message for the live connection without blocking. When the queue is full the configured
+// overflow policy applies. It returns false when the message was not queued
+func (room *Room) deliver(entry *connection, message persistient.EventMessage) bool {
+	if entry.enqueue(message) {
+		return true
+	}
+	select {
+	case <-entry.done:
+		return false
+	default:
+	}
+	policy := room.currentConfig().ConnectionsConfig.Client.OverflowPolicy
+	metrics.OutboundOverflows.WithLabelValues(policy).Inc()
 
-	messagesCollection := db.GetCollection(db.MessagesCollection)
+	switch policy {
+	case config.OverflowDropOldest:
+		evicted, queued := entry.replaceOldest(message)
+		if evicted != nil {
+			room.storeUndelivered(deliveryContext(evicted), *evicted)
+		}
+		if queued || message.Ephemeral {
+			return queued
+		}
+		// Only ephemeral messages are evicted, stored ones would reach the client out of order
+		select {
+		case <-entry.done:
+			return false
+		default:
+		}
+		slog.Warn("Outbound queue is full with nothing to evict, disconnecting slow client", logging.UserID, message.ReceiverID)
+		entry.stop()
+		_ = entry.transport.Close()
+	case config.OverflowDisconnect:
+		slog.Warn("Outbound queue is full, disconnecting slow client", logging.UserID, message.ReceiverID)
+		entry.stop()
+		_ = entry.transport.Close()
+	}
+	return false
+}
 
-	userChannel := room.userChannels[message.ReceiverID]
-	if userChannel != nil {
-		*userChannel <- *message
-	} else {
-		_ = messagesCollection.Insert(*message)
+// storeUndelivered keeps the message as unsent for the next connection of the receiver. Ephemeral messages are dropped,
+// copies too since the connection that got the message itself stores it
+func (room *Room) storeUndelivered(ctx context.Context, message persistient.EventMessage) {
+	if message.Copy {
+		return
+	}
+	if message.Ephemeral {
+		metrics.OutboundDropped.Inc()
+		return
 	}
+	_ = room.store.Insert(ctx, message)
 }
 
-func (room *Room) sendMessageToEventChannel(message *persistient.EventMessage) {
+func (room *Room) sendMessageToEventChannel(ctx context.Context, message *persistient.EventMessage, logger *slog.Logger) {
 
-	messagesCollection := db.GetCollection(db.MessagesCollection)
+	ctx, span := tracing.Tracer().Start(ctx, "route.event", trace.WithAttributes(tracing.EventID(message.EventID)))
+	defer span.End()
+	if message.CreatedAt.IsZero() {
+		message.CreatedAt = time.Now().UTC()
+	}
 
-	userIds, err := rest.GetUserIDsByEventID(message.EventID)
+	userIds, err := room.events.GetUserIDsByEventID(ctx, message.EventID)
 	if err != nil {
-		log.Println("Error getting userIds. Notifications would not be sent : ", err)
-		_ = messagesCollection.Insert(*message)
+		logger.Error("Error getting userIds. Notifications would not be sent", logging.EventID, message.EventID, logging.Err(err))
+		span.RecordError(err)
+		message.TraceID, message.SpanID = tracing.IDs(span)
+		_ = room.store.Insert(ctx, *message)
 		return
 	}
 
-	for userId := range userIds {
+	room.expectReceipts(ctx, message, userIds, logger)
+	for _, userId := range userIds {
 		message.ReceiverID = userId
-		room.sendMessageToUser(message)
+		room.sendMessageToUser(ctx, message)
 	}
 
 }
 
-func (room *Room) startIncomingClientMessagesRoutine(userConnection *websocket.Conn, userID int) {
+func (room *Room) startIncomingClientMessagesRoutine(entry *connection, userConnection *websocket.Conn, userID int, logger *slog.Logger) {
 
 	defer userConnection.Close()
-	defer delete(room.userChannels, userID)
-	var eventMessage persistient.EventMessage
+	defer entry.stop()
+	defer room.unregister(userID, entry)
 
 	for {
-		err := userConnection.ReadJSON(&eventMessage)
+		_, raw, err := userConnection.ReadMessage()
+		if err == websocket.ErrReadLimit {
+			logger.Warn("Client message exceeds the size limit. Closing connection")
+			metrics.InboundRejected.WithLabelValues(rejectTooLarge).Inc()
+			break
+		}
 		if err != nil {
-			log.Println("Error while reading from buffer :", err)
+			logger.Debug("Error while reading from buffer", logging.Err(err))
 			break
 		}
 
-		if eventMessage.ReceiverID != 0 && eventMessage.EventID != 0 {
-			errorMsg := persistient.EventMessage{ReceiverID: userID, Channel: "error", Body: "Unable to send message both to event and user"}
-			err = sendMessageToSocketConnection(userConnection, &errorMsg)
-			if err != nil {
-				log.Println("Error sending error message")
-				break
+		decoded, err := entry.codec.Decode(raw)
+		var frame *protocol.Envelope
+		if err == nil {
+			frame, err = decodeFrame(entry.version, decoded)
+		}
+		if err != nil && entry.version == legacyVersion {
+			logger.Debug("Error while reading from buffer", logging.Err(err))
+			break
+		}
+		if err != nil {
+			requestID := requestIDOf(decoded)
+			if room.admitFrame(entry, userID, 0, requestID, logger) {
+				metrics.InboundRejected.WithLabelValues(protocol.ErrInvalidFrame).Inc()
+				room.sendErrorFrame(entry, userID, requestID, protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()})
 			}
 			continue
 		}
+		room.handleFrame(entry, userID, frame, logger)
+	}
+
+}
+
+// handleFrame acts on a client frame once it passed the rate limits
+func (room *Room) handleFrame(entry *connection, userID int, frame *protocol.Envelope, logger *slog.Logger) {
 
-		eventMessage.SenderID = userID
-		eventMessage.IsSent = false
-		eventMessage.Channel = "message"
+	if frame.Type == protocol.TypeSignal {
+		// Signals have limits of their own
+		room.handleSignal(entry, userID, frame, logger)
+		return
+	}
+	var send protocol.SendData
+	if frame.Type == protocol.TypeSend {
+		_ = json.Unmarshal(frame.Data, &send)
+	}
+	if !room.admitFrame(entry, userID, send.EventID, frame.ID, logger) {
+		return
+	}
 
-		if eventMessage.ReceiverID != 0 {
-			room.sendMessageToUser(&eventMessage)
-		} else if eventMessage.EventID != 0 {
-			room.sendMessageToEventChannel(&eventMessage)
+	switch frame.Type {
+	case protocol.TypeSend:
+		room.handleSend(entry, userID, frame.ID, send, logger)
+	case protocol.TypePing:
+		room.reply(entry, userID, frame.ID, protocol.TypePong, nil)
+	default:
+		if handler, ok := requestHandlers[frame.Type]; ok {
+			room.handleRequest(entry, userID, frame, handler, logger)
+			return
 		}
+		room.sendErrorFrame(entry, userID, frame.ID, protocol.Error{Code: protocol.ErrUnsupportedType, Message: frame.Type + " frames are not supported yet"})
+	}
+}
 
+// admitFrame applies the inbound limits to a client frame, eventID is the event it sends to if any.
+// It returns false when the frame must be dropped
+func (room *Room) admitFrame(entry *connection, userID int, eventID int64, requestID string, logger *slog.Logger) bool {
+	limits := room.currentConfig().ConnectionsConfig.Client.Inbound
+	reason, wait, notify := room.inbound.allow(userID, eventID, limits, time.Now())
+	if reason == "" {
+		return true
+	}
+	metrics.InboundRejected.WithLabelValues(reason).Inc()
+	if notify {
+		room.throttled(entry, userID, requestID, reason, wait, logger)
 	}
+	return false
+}
 
+// handleSend routes a message of the client to a user or to the members of an event
+func (room *Room) handleSend(entry *connection, userID int, requestID string, send protocol.SendData, logger *slog.Logger) {
+	entry.countReceived()
+	messageKey, denied := room.acceptMessage(userID, send, logger)
+	if denied != nil {
+		room.sendErrorFrame(entry, userID, requestID, *denied)
+		return
+	}
+	room.reply(entry, userID, requestID, protocol.TypeAccepted, protocol.AcceptedData{MessageKey: messageKey})
 }
 
-func (room *Room) startOutgoingClientMessagesRoutine(clientConnection *websocket.Conn, channel *MessageChannel, outputStarted *chan bool, userID int) {
+// acceptMessage authorizes a message of the user and routes it, whatever the transport it came in.
+// It returns the key of the message, or the error to answer when the message is refused
+func (room *Room) acceptMessage(userID int, send protocol.SendData, logger *slog.Logger) (string, *protocol.Error) {
+
+	if send.ReceiverID != 0 && send.EventID != 0 {
+		return "", &protocol.Error{Code: protocol.ErrInvalidTarget, Message: "Unable to send message both to event and user"}
+	}
+
+	eventMessage := persistient.EventMessage{
+		ReceiverID: send.ReceiverID,
+		EventID:    send.EventID,
+		Body:       send.Body,
+		SenderID:   userID,
+		IsSent:     false,
+		Channel:    db.ChatChannel,
+	}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "websocket.receive",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(tracing.UserID(userID)))
+	defer span.End()
+	if denied := room.authorizeSender(ctx, userID, &eventMessage, logger); denied != nil {
+		metrics.InboundRejected.WithLabelValues(denied.Code).Inc()
+		span.SetAttributes(attribute.String("partyfy.denied", denied.Code))
+		return "", denied
+	}
+	eventMessage.MessageKey = newMessageKey()
+	eventMessage.CreatedAt = time.Now().UTC()
+	if eventMessage.ReceiverID != 0 {
+		room.expectReceipts(ctx, &eventMessage, []int{eventMessage.ReceiverID}, logger)
+		room.sendMessageToUser(ctx, &eventMessage)
+	} else if eventMessage.EventID != 0 {
+		room.sendMessageToEventChannel(ctx, &eventMessage, logger)
+	}
+	return eventMessage.MessageKey, nil
+}
+
+// throttled tells the client that its messages are dropped and for how long
+func (room *Room) throttled(entry *connection, userID int, requestID string, reason string, wait time.Duration, logger *slog.Logger) {
+	noteThrottled(reason, wait, logger)
+	room.sendErrorFrame(entry, userID, requestID, throttleError(reason, wait))
+}
+
+// noteThrottled logs that a client starts being throttled and counts the mutes
+func noteThrottled(reason string, wait time.Duration, logger *slog.Logger) {
+	switch reason {
+	case throttleMuted:
+		logger.Warn("Client muted for flooding", "seconds", retrySeconds(wait))
+		metrics.SenderMutes.Inc()
+	default:
+		logger.Info("Client throttled", "seconds", retrySeconds(wait))
+	}
+}
+
+// throttleError returns the error telling a client that its messages are dropped and for how long
+func throttleError(reason string, wait time.Duration) protocol.Error {
+	switch reason {
+	case throttleMuted:
+		return protocol.Error{Code: protocol.ErrMuted, Message: "Muted after repeated flooding", RetryAfter: retrySeconds(wait)}
+	case throttleEventRate:
+		return protocol.Error{Code: protocol.ErrEventRateLimited, Message: "Too many messages to this event", RetryAfter: retrySeconds(wait)}
+	default:
+		return protocol.Error{Code: protocol.ErrRateLimited, Message: "Too many messages", RetryAfter: retrySeconds(wait)}
+	}
+}
+
+func retrySeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+func (room *Room) startOutgoingClientMessagesRoutine(entry *connection, outputStarted *chan bool, userID int, logger *slog.Logger) {
+	defer entry.routines.Done()
 	*outputStarted <- true
-	defer clientConnection.Close()
-	defer delete(room.userChannels, userID)
+	defer entry.transport.Close()
+	defer room.unregister(userID, entry)
+	defer func() {
+		entry.stop()
+		for _, message := range entry.drain() {
+			if message.SenderID == userID {
+				room.storeEcho(message)
+			} else {
+				room.storeUndelivered(deliveryContext(&message), message)
+			}
+		}
+	}()
 
-	messagesCollection := db.GetCollection("messages")
-	err := sendUnsentMessages(clientConnection, userID)
+	err := room.sendUnsentMessages(entry, userID, logger)
 	if err != nil {
-		log.Print("Error sending unsent messages. Maybe you should check database")
+		logger.Error("Error sending unsent messages. Maybe you should check database", logging.Err(err))
 	}
 	for {
-		message := <-(*channel)
+		var message persistient.EventMessage
+		select {
+		case message = <-entry.channel:
+		case <-entry.done:
+			return
+		}
 		if message.SenderID == userID {
+			room.storeEcho(message)
 			continue
 		}
-		err := sendMessageToSocketConnection(clientConnection, &message)
+		err := room.sendMessageToSocketConnection(entry, &message, logger)
 		if err != nil {
-			log.Print("Error with client connection occurred. Closing connection")
-			_ = messagesCollection.Insert(message)
+			logger.Warn("Error with client connection occurred. Closing connection", logging.Err(err))
+			room.storeUndelivered(deliveryContext(&message), message)
 			break
 		}
 	}
 
 }
 
-func sendMessageToSocketConnection(connection *websocket.Conn, message *persistient.EventMessage) error {
+// sendMessageToSocketConnection writes the message in the protocol of the connection
+func (room *Room) sendMessageToSocketConnection(entry *connection, message *persistient.EventMessage, logger *slog.Logger) error {
 
-	messagesCollection := db.GetCollection(db.MessagesCollection)
-	err := connection.WriteJSON(message)
+	frame, ok := encodeFrame(entry.version, message)
+	if !ok {
+		return nil
+	}
+	if expired(message, time.Now()) {
+		metrics.OutboundDropped.Inc()
+		return nil
+	}
+	ctx, span := tracing.Tracer().Start(deliveryContext(message), "websocket.write",
+		trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(tracing.UserID(message.ReceiverID)))
+	payload, err := json.Marshal(frame)
+	if err == nil {
+		payload, err = entry.codec.Encode(payload)
+	}
+	if err == nil {
+		err = entry.transport.writeFrame(message, payload)
+	}
 	if err != nil {
-		log.Println("Error while writing message to client :", err)
+		logger.Debug("Error while writing message to client", logging.MessageID, message.ID, logging.Err(err))
+		tracing.End(span, err)
 		return err
 	} else {
+		if !message.RecordTime.IsZero() {
+			metrics.DeliveryLatency.Observe(time.Since(message.RecordTime).Seconds())
+		}
+		entry.countSent()
 		message.IsSent = true
-		_ = messagesCollection.Insert(*message)
+		// Messages replayed from the store are only marked sent by the caller
+		if !message.Ephemeral && !message.Copy && message.ID == nil {
+			_ = room.store.Insert(ctx, *message)
+		}
+		span.End()
 		return nil
 	}
 }
 
-func sendUnsentMessages(connection *websocket.Conn, userID int) error {
-	messagesCollection := db.GetCollection("messages")
-	err := messagesCollection.FindUnsentByReceiverUserID(userID, func(message persistient.EventMessage, err error) error {
+// storeEcho keeps the copy of an event message routed back to its sender, not written to the socket,
+// as already sent so that it is part of the history of the event for its sender
+func (room *Room) storeEcho(message persistient.EventMessage) {
+	if message.Ephemeral || message.Copy {
+		return
+	}
+	message.IsSent, message.IsRead = true, true
+	_ = room.store.Insert(deliveryContext(&message), message)
+}
+
+// deliveryContext continues the trace the message was routed in, it may have been stored in between
+func deliveryContext(message *persistient.EventMessage) context.Context {
+	return tracing.ContextWithIDs(context.Background(), message.TraceID, message.SpanID)
+}
+
+// sendUnsentMessages writes the messages stored while the user was away. An event stream that reconnects with
+// the ID of the last event it got also gets again what was sent after it, the client may have lost it
+func (room *Room) sendUnsentMessages(entry *connection, userID int, logger *slog.Logger) error {
+	send := func(message persistient.EventMessage, err error) error {
 		if err != nil {
-			log.Println("Error while unmarshal EventMessage")
+			logger.Error("Error while unmarshal EventMessage", logging.Err(err))
 			return err
 		}
-		err = sendMessageToSocketConnection(connection, &message)
+		if message.SenderID == userID {
+			// Copy of a message of the user, kept as an echo like the ones routed while connected
+			if !message.IsSent {
+				room.store.SetMessageSent(deliveryContext(&message), message.ID)
+			}
+			return nil
+		}
+		err = room.sendMessageToSocketConnection(entry, &message, logger)
 		if err != nil {
-			log.Print("Error sending unsent message: ", err)
+			logger.Warn("Error sending unsent message", logging.MessageID, message.ID, logging.Err(err))
 			return err
 		}
-		messagesCollection.SetMessageSent(message.ID)
+		room.store.SetMessageSent(deliveryContext(&message), message.ID)
 		return nil
-	})
+	}
+	var err error
+	if entry.resumeAfter.IsZero() {
+		err = room.store.FindUnsentByReceiverUserID(context.Background(), userID, send)
+	} else {
+		err = room.store.FindUnsentOrCreatedAfter(context.Background(), userID, entry.resumeAfter, send)
+	}
 	if err != nil {
-		log.Print("Unable to get user unsent messages: ", err)
+		logger.Error("Unable to get user unsent messages", logging.Err(err))
 		return err
 	}
 	return nil
@@ -0,0 +1,42 @@
+package room
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// checkOrigin accepts requests from the allowed origins and requests without an Origin header, which
+// do not come from a browser. An empty allowlist accepts the origin of the host only
+func (room *Room) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	allowed := room.currentConfig().ConnectionsConfig.Client.AllowedOrigins
+	if len(allowed) == 0 {
+		parsed, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(parsed.Host, r.Host)
+	}
+	for _, pattern := range allowed {
+		if matchOrigin(strings.ToLower(origin), strings.ToLower(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin compares scheme://host[:port] origins. "*" matches any origin and a "*." host prefix any subdomain
+func matchOrigin(origin string, pattern string) bool {
+	if pattern == "*" || pattern == origin {
+		return true
+	}
+	wildcard := strings.Index(pattern, "://*.")
+	if wildcard < 0 {
+		return false
+	}
+	scheme := pattern[:wildcard+len("://")]
+	domain := pattern[wildcard+len("://*"):]
+	return strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, domain) &&
+		len(origin) > len(scheme)+len(domain)
+}
@@ -0,0 +1,268 @@
+package room
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"net/http"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	pollPath = "/events/poll"
+	// defaultPollTimeout is how long a poll is held when no message is waiting, clients may ask for up to maxPollTimeout
+	defaultPollTimeout = 25 * time.Second
+	maxPollTimeout     = 55 * time.Second
+	// pollBatchSize caps the messages of a poll response, the rest comes with the next polls
+	pollBatchSize = 100
+	// pollCursorLifetime is how long the batch of a poll waits for the next poll to acknowledge it
+	pollCursorLifetime = 10 * time.Minute
+	cursorParameter    = "cursor"
+	timeoutParameter   = "timeout"
+)
+
+var errBatchFull = errors.New("poll batch is full")
+
+// pollResult is the response of a poll. Cursor acknowledges the messages when it is sent with the next poll
+type pollResult struct {
+	Messages []persistient.EventMessage `json:"messages"`
+	Cursor   string                     `json:"cursor,omitempty"`
+}
+
+// pollWaiter takes the place of a socket in the connection registry while a poll is held. Routed messages
+// wake the poll through the queue of the connection, nothing is written to the waiter
+type pollWaiter struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newPollWaiter() *pollWaiter {
+	return &pollWaiter{done: make(chan struct{})}
+}
+
+func (waiter *pollWaiter) writeFrame(message *persistient.EventMessage, payload []byte) error {
+	return errors.New("polls are not written to")
+}
+
+func (waiter *pollWaiter) Close() error {
+	waiter.closeOnce.Do(func() { close(waiter.done) })
+	return nil
+}
+
+type pollBatch struct {
+	cursor      string
+	ids         []interface{}
+	messageKeys []string
+	expires     time.Time
+}
+
+// pollCursors remembers the last batch returned to every polling user until the next poll acknowledges it.
+// It is safe for concurrent use
+type pollCursors struct {
+	mutex   sync.Mutex
+	batches map[int]pollBatch
+	stores  int
+}
+
+func newPollCursors() *pollCursors {
+	return &pollCursors{batches: make(map[int]pollBatch)}
+}
+
+// remember keeps the IDs and keys of the messages returned to the user and returns the cursor acknowledging them
+func (cursors *pollCursors) remember(userID int, ids []interface{}, messageKeys []string, now time.Time) string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	cursor := hex.EncodeToString(random)
+
+	cursors.mutex.Lock()
+	defer cursors.mutex.Unlock()
+	cursors.batches[userID] = pollBatch{cursor: cursor, ids: ids, messageKeys: messageKeys, expires: now.Add(pollCursorLifetime)}
+	if cursors.stores++; cursors.stores%sweepEvery == 0 {
+		for otherID, batch := range cursors.batches {
+			if now.After(batch.expires) {
+				delete(cursors.batches, otherID)
+			}
+		}
+	}
+	return cursor
+}
+
+// acknowledge returns the batch the cursor was returned with and forgets it. Unknown, expired and superseded
+// cursors acknowledge nothing, their messages are returned again
+func (cursors *pollCursors) acknowledge(userID int, cursor string, now time.Time) pollBatch {
+	if cursor == "" {
+		return pollBatch{}
+	}
+	cursors.mutex.Lock()
+	defer cursors.mutex.Unlock()
+	batch, found := cursors.batches[userID]
+	if !found || batch.cursor != cursor {
+		return pollBatch{}
+	}
+	delete(cursors.batches, userID)
+	if now.After(batch.expires) {
+		return pollBatch{}
+	}
+	return batch
+}
+
+// servePoll answers with the unsent messages of the user, holding the request until one arrives when there are
+// none. The cursor of the previous response acknowledges its messages, they are marked sent and delivered
+func (room *Room) servePoll(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	room.waitGroup.Add(1)
+	defer room.waitGroup.Done()
+
+	connectionID := atomic.AddInt64(&room.clientCounter, 1)
+	logger := slog.With(logging.ConnectionID, connectionID, "remote_addr", r.RemoteAddr)
+
+	userID, logger, admitted := room.admitClient(w, r, logger)
+	if !admitted {
+		return
+	}
+	defer room.admission.release(remoteIP(r), userID)
+
+	acknowledged := room.polls.acknowledge(userID, r.URL.Query().Get(cursorParameter), time.Now())
+	for _, id := range acknowledged.ids {
+		room.store.SetMessageSent(context.Background(), id)
+	}
+	if len(acknowledged.messageKeys) > 0 {
+		_, _ = room.recordDelivered(context.Background(), userID, acknowledged.messageKeys, logger)
+	}
+
+	metrics.ConnectedClients.Inc()
+	defer metrics.ConnectedClients.Dec()
+
+	// The poll is registered before the store is read, a message routed in between wakes it
+	waiter := newPollWaiter()
+	entry := newConnection(waiter, newConnectionInfo(userID, connectionID, r, TransportPoll, ""), room.currentConfig().ConnectionsConfig.Client.OutboundQueueSize)
+	// A new poll of the user supersedes the one still held, their other connections stay
+	for _, previous := range room.connections.lookup(userID) {
+		if previous.info.Transport == TransportPoll {
+			_ = previous.transport.Close()
+		}
+	}
+	entry.routines.Add(1)
+	room.register(userID, entry)
+
+	messages, ids, err := room.unsentBatch(r.Context(), userID, logger)
+	var woken []persistient.EventMessage
+	if err == nil && len(messages) == 0 {
+		timer := time.NewTimer(pollTimeout(r))
+		select {
+		case message := <-entry.channel:
+			woken = append(woken, message)
+		case <-waiter.done:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+	entry.stop()
+	room.unregister(userID, entry)
+	live := room.keepQueued(userID, append(woken, entry.drain()...))
+	entry.routines.Done()
+
+	if r.Context().Err() != nil {
+		logger.Debug("Client went away while polling")
+		return
+	}
+	if err == nil && len(woken) > 0 {
+		messages, ids, err = room.unsentBatch(r.Context(), userID, logger)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	result := pollResult{Messages: append(live, messages...)}
+	if len(ids) > 0 {
+		result.Cursor = room.polls.remember(userID, ids, messageKeys(messages), time.Now())
+	}
+	for range result.Messages {
+		entry.countSent()
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// unsentBatch returns the first unsent messages of the user and their IDs
+func (room *Room) unsentBatch(ctx context.Context, userID int, logger *slog.Logger) ([]persistient.EventMessage, []interface{}, error) {
+	messages := []persistient.EventMessage{}
+	var ids []interface{}
+	err := room.store.FindUnsentByReceiverUserID(ctx, userID, func(message persistient.EventMessage, err error) error {
+		if err != nil {
+			logger.Error("Error while unmarshal EventMessage", logging.MessageID, message.ID, logging.Err(err))
+			return nil
+		}
+		if message.SenderID == userID {
+			room.store.SetMessageSent(deliveryContext(&message), message.ID)
+			return nil
+		}
+		messages = append(messages, message)
+		ids = append(ids, message.ID)
+		if len(messages) == pollBatchSize {
+			return errBatchFull
+		}
+		return nil
+	})
+	if err != nil {
+		logger.Error("Unable to get user unsent messages", logging.Err(err))
+	}
+	return messages, ids, err
+}
+
+// messageKeys returns the keys of the client messages among the messages
+func messageKeys(messages []persistient.EventMessage) []string {
+	var keys []string
+	for _, message := range messages {
+		if message.MessageKey != "" {
+			keys = append(keys, message.MessageKey)
+		}
+	}
+	return keys
+}
+
+// keepQueued stores the messages routed to a poll, the response then reads them back with their IDs.
+// Ephemeral messages and copies are not stored, they are returned as they are unless they expired
+func (room *Room) keepQueued(userID int, queued []persistient.EventMessage) []persistient.EventMessage {
+	live := []persistient.EventMessage{}
+	for _, message := range queued {
+		switch {
+		case message.SenderID == userID:
+			room.storeEcho(message)
+		case message.Ephemeral || message.Copy:
+			if !expired(&message, time.Now()) {
+				live = append(live, message)
+			}
+		default:
+			room.storeUndelivered(deliveryContext(&message), message)
+		}
+	}
+	return live
+}
+
+// pollTimeout returns how long the poll may be held, from the timeout query parameter in seconds
+func pollTimeout(r *http.Request) time.Duration {
+	seconds, err := strconv.Atoi(r.URL.Query().Get(timeoutParameter))
+	if err != nil || seconds <= 0 {
+		return defaultPollTimeout
+	}
+	if timeout := time.Duration(seconds) * time.Second; timeout < maxPollTimeout {
+		return timeout
+	}
+	return maxPollTimeout
+}
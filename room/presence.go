@@ -0,0 +1,406 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	presencePath     = "/presence"
+	usersParameter   = "users"
+	eventIDParameter = "event_id"
+	// PresenceChannel is the channel of the messages telling that a user came online or went offline
+	PresenceChannel = "presence"
+	// presenceOverlap is how far back the changes are looked for again, for the clocks of the replicas
+	// and the writes in flight
+	presenceOverlap = 5 * time.Second
+	// maxWatched caps the users a connection gets the presence changes of, besides the members of its events
+	maxWatched = 1000
+	// presenceBacklog is how many presence changes may wait for their notifications, later ones are dropped
+	presenceBacklog = 1024
+	// maxPresenceUsers caps the users of a presence query, as the schema does for presence frames
+	maxPresenceUsers = 100
+)
+
+type presenceUpdate struct {
+	userID int
+	online bool
+}
+
+type knownPresence struct {
+	updatedAt time.Time
+	visible   bool
+}
+
+// presenceTracker records in the store which users are connected to this replica, and pushes the presence
+// changes of every replica to the connected users they concern. Only its own routines use its maps
+type presenceTracker struct {
+	room        *Room
+	replica     string
+	updates     chan presenceUpdate
+	changes     chan persistient.Presence
+	online      map[int]bool          //users recorded online by this replica
+	leaving     map[int]time.Time     //users whose last connection closed -> when it closed
+	known       map[int]knownPresence //last change seen of every user, forgotten once it can no longer be read again
+	stores      int
+	syncedUntil time.Time
+	stop        chan struct{}
+	done        chan struct{}
+	stopOnce    sync.Once
+}
+
+func newPresenceTracker(room *Room, replica string) *presenceTracker {
+	return &presenceTracker{
+		room:        room,
+		replica:     replica,
+		updates:     make(chan presenceUpdate, presenceBacklog),
+		changes:     make(chan persistient.Presence, presenceBacklog),
+		online:      make(map[int]bool),
+		leaving:     make(map[int]time.Time),
+		known:       make(map[int]knownPresence),
+		syncedUntil: time.Now(),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+}
+
+// replicaName identifies the replica in the presence records, from the configured uuid or else the host name
+func replicaName(globalConfig config.GlobalConfig) string {
+	if globalConfig.Uuid != 0 {
+		return fmt.Sprintf("%.0f", globalConfig.Uuid)
+	}
+	hostname, _ := os.Hostname()
+	return hostname
+}
+
+func (tracker *presenceTracker) start() {
+	go tracker.run()
+	go tracker.notifyChanges()
+}
+
+// close records the users of the replica offline and stops the routines
+func (tracker *presenceTracker) close() {
+	tracker.stopOnce.Do(func() { close(tracker.stop) })
+	<-tracker.done
+}
+
+func (tracker *presenceTracker) connected(userID int) {
+	tracker.send(presenceUpdate{userID: userID, online: true})
+}
+
+func (tracker *presenceTracker) disconnected(userID int) {
+	tracker.send(presenceUpdate{userID: userID})
+}
+
+func (tracker *presenceTracker) send(update presenceUpdate) {
+	select {
+	case tracker.updates <- update:
+	case <-tracker.stop:
+	}
+}
+
+func (tracker *presenceTracker) run() {
+
+	defer close(tracker.done)
+	defer close(tracker.changes)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastHeartbeat, lastSync := time.Now(), time.Now()
+	for {
+		select {
+		case update := <-tracker.updates:
+			tracker.apply(update, time.Now())
+		case now := <-ticker.C:
+			settings := tracker.room.currentConfig().ConnectionsConfig.Presence
+			tracker.leave(now)
+			if now.Sub(lastHeartbeat) >= time.Duration(settings.HeartbeatSeconds)*time.Second {
+				lastHeartbeat = now
+				_ = tracker.room.store.TouchPresence(context.Background(), tracker.replica, now.UTC())
+			}
+			if now.Sub(lastSync) >= time.Duration(settings.SyncSeconds)*time.Second {
+				lastSync = now
+				tracker.sync()
+			}
+		case <-tracker.stop:
+			now := time.Now().UTC()
+			for userID := range tracker.online {
+				_ = tracker.room.store.SetOffline(context.Background(), userID, tracker.replica, now, now)
+			}
+			return
+		}
+	}
+}
+
+// apply records a user online right away, and offline once the grace delay passed without a new connection
+func (tracker *presenceTracker) apply(update presenceUpdate, now time.Time) {
+	if !update.online {
+		if tracker.online[update.userID] {
+			tracker.leaving[update.userID] = now
+		}
+		return
+	}
+	delete(tracker.leaving, update.userID)
+	if tracker.online[update.userID] {
+		return
+	}
+	if tracker.room.store.SetOnline(context.Background(), update.userID, tracker.replica, now.UTC()) == nil {
+		tracker.online[update.userID] = true
+	}
+}
+
+// leave records offline the users whose last connection closed more than the grace delay ago, last seen when it closed
+func (tracker *presenceTracker) leave(now time.Time) {
+	grace := time.Duration(tracker.room.currentConfig().ConnectionsConfig.Presence.OfflineGraceSeconds) * time.Second
+	for userID, left := range tracker.leaving {
+		if now.Sub(left) < grace {
+			continue
+		}
+		delete(tracker.leaving, userID)
+		if len(tracker.room.connections.lookup(userID)) > 0 {
+			continue
+		}
+		if tracker.room.store.SetOffline(context.Background(), userID, tracker.replica, left.UTC(), now.UTC()) == nil {
+			delete(tracker.online, userID)
+		}
+	}
+}
+
+// sync reads the presence changes of every replica, this one included, and queues the ones others may see
+func (tracker *presenceTracker) sync() {
+	changes, err := tracker.room.store.FindPresenceChanges(context.Background(), tracker.syncedUntil.Add(-presenceOverlap))
+	if err != nil {
+		slog.Warn("Unable to read presence changes", logging.Err(err))
+		return
+	}
+	for _, change := range changes {
+		known, seen := tracker.known[change.UserID]
+		if seen && !change.UpdatedAt.After(known.updatedAt) {
+			continue
+		}
+		visible := change.Online && !change.Hidden
+		tracker.remember(change.UserID, knownPresence{updatedAt: change.UpdatedAt, visible: visible})
+		if change.UpdatedAt.After(tracker.syncedUntil) {
+			tracker.syncedUntil = change.UpdatedAt
+		}
+		if seen && known.visible == visible {
+			continue
+		}
+		select {
+		case tracker.changes <- change:
+		default:
+			slog.Warn("Too many presence changes, dropping notification", logging.UserID, change.UserID)
+		}
+	}
+}
+
+// remember keeps the last change seen of the user. Changes older than the overlap are never read again, the users
+// they belong to are forgotten now and then
+func (tracker *presenceTracker) remember(userID int, known knownPresence) {
+	tracker.known[userID] = known
+	if tracker.stores++; tracker.stores%sweepEvery == 0 {
+		oldest := tracker.syncedUntil.Add(-presenceOverlap)
+		for otherID, other := range tracker.known {
+			if other.updatedAt.Before(oldest) {
+				delete(tracker.known, otherID)
+			}
+		}
+	}
+}
+
+func (tracker *presenceTracker) notifyChanges() {
+	for change := range tracker.changes {
+		tracker.room.notifyPresence(change)
+	}
+}
+
+// notifyPresence pushes the change to the connected users that share an event with the user, or that asked for
+// their presence. Hidden users are announced offline
+func (room *Room) notifyPresence(change persistient.Presence) {
+	ctx := context.Background()
+	settings := room.currentConfig().ConnectionsConfig.Authorization
+	recipients := make(map[int]bool)
+	room.connections.forEach(func(userID int, entry *connection) bool {
+		if userID != change.UserID && entry.watches(change.UserID) {
+			recipients[userID] = true
+		}
+		return true
+	})
+	eventIDs, err := room.authorizer.eventsOf(ctx, change.UserID, settings)
+	if err != nil {
+		slog.Warn("Unable to get the events of user, presence is only pushed to watchers", logging.UserID, change.UserID, logging.Err(err))
+	}
+	for eventID := range eventIDs {
+		members, err := room.authorizer.membersOf(ctx, eventID, settings)
+		if err != nil {
+			slog.Warn("Unable to get the members of event for presence", logging.EventID, eventID, logging.Err(err))
+			continue
+		}
+		for _, memberID := range members {
+			if memberID != change.UserID && len(room.connections.lookup(memberID)) > 0 {
+				recipients[memberID] = true
+			}
+		}
+	}
+
+	presence := room.presenceView(change, 0, time.Now())
+	for receiverID := range recipients {
+		metrics.PresenceNotifications.Inc()
+		room.sendMessageToUser(ctx, &persistient.EventMessage{
+			Channel:    PresenceChannel,
+			ReceiverID: receiverID,
+			Body:       presence,
+			Ephemeral:  true,
+		})
+	}
+}
+
+// presenceView is the presence of the record as the viewer sees it. Users see their own presence even hidden.
+// A user online on a replica that stopped refreshing the record for three heartbeats is offline
+func (room *Room) presenceView(record persistient.Presence, viewerID int, now time.Time) protocol.Presence {
+	presence := protocol.Presence{UserID: record.UserID}
+	if record.Hidden && viewerID != record.UserID {
+		return presence
+	}
+	heartbeat := time.Duration(room.currentConfig().ConnectionsConfig.Presence.HeartbeatSeconds) * time.Second
+	if record.Online && now.Sub(record.LastSeen) < 3*heartbeat {
+		since := record.Since
+		presence.Online, presence.Since = true, &since
+	}
+	// Records created by the visibility setting alone were never seen
+	if record.LastSeen.Unix() > 0 {
+		lastSeen := record.LastSeen
+		presence.LastSeen = &lastSeen
+	}
+	return presence
+}
+
+// presenceOf returns the presence of the users as the viewer sees it, in the order of userIDs
+func (room *Room) presenceOf(ctx context.Context, viewerID int, userIDs []int) ([]protocol.Presence, error) {
+	records, err := room.store.FindPresence(ctx, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	byUser := make(map[int]persistient.Presence, len(records))
+	for _, record := range records {
+		byUser[record.UserID] = record
+	}
+	now := time.Now()
+	users := make([]protocol.Presence, 0, len(userIDs))
+	for _, userID := range userIDs {
+		record, found := byUser[userID]
+		if !found {
+			record.UserID = userID
+		}
+		presence := room.presenceView(record, viewerID, now)
+		// The store lags behind the connections of this replica
+		if entries := room.connections.lookup(userID); len(entries) > 0 && !presence.Online && (!record.Hidden || viewerID == userID) {
+			since := entries[0].info.ConnectedAt
+			presence.Online, presence.Since = true, &since
+		}
+		users = append(users, presence)
+	}
+	return users, nil
+}
+
+// servePresence answers presence queries over HTTP, for the users=1,2,3 or for every member of event_id. It is
+// authorized like the presence frame
+func (room *Room) servePresence(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := slog.With("remote_addr", r.RemoteAddr)
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter is required", http.StatusBadRequest)
+		return
+	}
+	logger = logger.With(logging.UserID, userID)
+	if !room.checkOrigin(r) {
+		logger.Warn("Presence query refused, origin is not allowed", "origin", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	request, err := presenceQuery(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()})
+		return
+	}
+	data, _ := json.Marshal(request)
+	result, failure := room.presence(r.Context(), userID, data, logger)
+	metrics.ClientRequests.WithLabelValues(protocol.TypePresence, outcome(failure)).Inc()
+	if failure != nil {
+		writeJSON(w, errorStatus(failure.Code), failure)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// presenceQuery reads the users or the event of a presence query
+func presenceQuery(r *http.Request) (protocol.PresenceData, error) {
+	var request protocol.PresenceData
+	query := r.URL.Query()
+	users, event := query.Get(usersParameter), query.Get(eventIDParameter)
+	if (users == "") == (event == "") {
+		return request, errors.New("exactly one of users and event_id is required")
+	}
+	if event != "" {
+		eventID, err := strconv.ParseInt(event, 10, 64)
+		if err != nil || eventID < 1 {
+			return request, errors.New("event_id must be a positive integer")
+		}
+		request.EventID = eventID
+		return request, nil
+	}
+	for _, value := range strings.Split(users, ",") {
+		otherID, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32)
+		if err != nil || otherID < 1 {
+			return request, errors.New("users must be positive integers separated by commas")
+		}
+		request.UserIDs = append(request.UserIDs, int(otherID))
+	}
+	if len(request.UserIDs) > maxPresenceUsers {
+		return request, fmt.Errorf("at most %d users may be asked at once", maxPresenceUsers)
+	}
+	return request, nil
+}
+
+// watch makes the connection get the presence changes of the users, up to maxWatched of them
+func (entry *connection) watch(userIDs []int) {
+	entry.watchMutex.Lock()
+	defer entry.watchMutex.Unlock()
+	if entry.watching == nil {
+		entry.watching = make(map[int]bool, len(userIDs))
+	}
+	for _, userID := range userIDs {
+		if len(entry.watching) >= maxWatched {
+			return
+		}
+		entry.watching[userID] = true
+	}
+}
+
+func (entry *connection) watches(userID int) bool {
+	entry.watchMutex.Lock()
+	defer entry.watchMutex.Unlock()
+	return entry.watching[userID]
+}
@@ -1,12 +1,15 @@
 package room
 
 import (
-	"errors"
-	"fmt"
+	"context"
 	"github.com/Shopify/sarama"
-	"github.com/wvanbergen/kafka/consumergroup"
-	"log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
 	"partyfy-message-service/persistient"
+	"partyfy-message-service/tracing"
 	"time"
 )
 
@@ -28,128 +31,112 @@ type MultipleUserEventActionRecord struct {
 	UsersIDs []int `json:"receiversIDs"`
 }
 
-func (room *Room) InitKafkaConnection() {
-	log.Println("Creating server connection...")
-
-	defer room.waitGroup.Done()
-
-	kafkaConfiguration := consumergroup.NewConfig()
-	kafkaConfiguration.Offsets.Initial = sarama.OffsetOldest
-	kafkaConfiguration.Offsets.ProcessingTimeout = 10 * time.Second
-
-	cgroup := room.config.ConnectionsConfig.KafkaServer.CGroup
-	topics := room.config.ConnectionsConfig.KafkaServer.Topics
-	zookeeper := room.config.ConnectionsConfig.KafkaServer.ServerUrls
-
-	err := errors.New("")
-	var cg *consumergroup.ConsumerGroup
-	for err != nil {
-		cg, err = consumergroup.JoinConsumerGroup(cgroup, topics, zookeeper, kafkaConfiguration)
-	}
-	log.Print("Connected to queue successfully")
-
-	room.consumeMessagesFromQueue(cg)
-	err = cg.Close()
-	if err != nil {
-		log.Println("Error while closing queue consumer group : ", err)
-	}
-
-}
-
-func (room *Room) consumeMessagesFromQueue(cg *consumergroup.ConsumerGroup) {
-
-	log.Println("Starting receiving messages from queue")
-	msg := <-cg.Messages()
-	err := cg.CommitUpto(msg)
-	if err != nil {
-		fmt.Println("Error commit zookeeper: ", err.Error())
-	}
-	for {
-		select {
-		case msg = <-cg.Messages():
-			err := cg.CommitUpto(msg)
-			if err != nil {
-				fmt.Println("Error commit zookeeper: ", err.Error())
-			}
-			room.processIncomingRecord(msg)
-		}
-	}
-
-}
-
-func (room *Room) processIncomingRecord(msg *sarama.ConsumerMessage) {
+// ProcessIncomingRecord routes a Kafka record to the users it concerns
+func (room *Room) ProcessIncomingRecord(msg *sarama.ConsumerMessage) {
 
 	topic := msg.Topic
-	log.Print("New message from : ", topic)
-
+	ctx, span := tracing.Tracer().Start(tracing.FromRecord(context.Background(), msg), "kafka.consume "+topic,
+		trace.WithSpanKind(trace.SpanKindConsumer), trace.WithAttributes(
+			attribute.String("messaging.system", "kafka"),
+			attribute.String("messaging.destination.name", topic),
+			attribute.Int64("messaging.kafka.destination.partition", int64(msg.Partition)),
+			attribute.Int64("messaging.kafka.message.offset", msg.Offset),
+		))
+	traceID, _ := tracing.IDs(span)
+	logger := slog.With(logging.Topic, topic, logging.Partition, msg.Partition, logging.Offset, msg.Offset, logging.TraceID, traceID)
+	logger.Debug("New message from queue")
+	metrics.KafkaRecords.WithLabelValues(topic).Inc()
+
+	var process func()
 	switch topic {
 	case "event-updated", "event-deleted", "event-created":
-		record := unmarshalEventActionRecord(msg.Value)
+		record := unmarshalEventActionRecord(msg.Value, logger)
 		if record != nil {
-			go room.processEventActionRecord(*record, string(msg.Value), topic)
+			process = func() { room.processEventActionRecord(ctx, *record, string(msg.Value), topic, msg.Timestamp, logger) }
 		}
 	case "event-user-removed", "event-user-added":
-		record := unmarshalEventUserActionRecord(msg.Value)
+		record := unmarshalEventUserActionRecord(msg.Value, logger)
 		if record != nil {
-			go room.processEventUserActionRecord(*record, string(msg.Value), topic)
+			process = func() {
+				room.processEventUserActionRecord(ctx, *record, string(msg.Value), topic, msg.Timestamp, logger)
+			}
 		}
 	case "user-relation-created":
-		record := unmarshalUserActionRecord(msg.Value)
+		record := unmarshalUserActionRecord(msg.Value, logger)
 		if record != nil {
-			go room.processUserActionRecord(*record, string(msg.Value), topic)
+			process = func() { room.processUserActionRecord(ctx, *record, string(msg.Value), topic, msg.Timestamp, logger) }
 		}
 	case "image-added", "image-user-attached":
-		record := unmarshalImageAddedRecord(msg.Value)
+		record := unmarshalImageAddedRecord(msg.Value, logger)
 		if record != nil {
-			go room.processMultipleUserEventActionRecord(*record, string(msg.Value), topic)
+			process = func() {
+				room.processMultipleUserEventActionRecord(ctx, *record, string(msg.Value), topic, msg.Timestamp, logger)
+			}
 		}
 	}
+	if process == nil {
+		span.End()
+		return
+	}
+	// The span covers the routing of the record, it ends in the goroutine that routes it
+	go func() {
+		defer span.End()
+		process()
+	}()
 }
 
-func (room *Room) processEventActionRecord(record EventActionRecord, payload, topic string) {
+func (room *Room) processEventActionRecord(ctx context.Context, record EventActionRecord, payload, topic string, recordTime time.Time, logger *slog.Logger) {
 	message := &persistient.EventMessage{
-		EventID: record.EventID,
-		Channel: topic,
-		Body:    payload,
-		IsSent:  false,
+		EventID:    record.EventID,
+		Channel:    topic,
+		Body:       payload,
+		IsSent:     false,
+		RecordTime: recordTime,
 	}
-	room.sendMessageToEventChannel(message)
+	room.sendMessageToEventChannel(ctx, message, logger)
 }
 
-func (room *Room) processUserActionRecord(record UserActionRecord, payload, topic string) {
+func (room *Room) processUserActionRecord(ctx context.Context, record UserActionRecord, payload, topic string, recordTime time.Time, logger *slog.Logger) {
+	if topic == "user-relation-created" {
+		room.authorizer.forgetRelations(record.ReceiverID)
+	}
 	message := &persistient.EventMessage{
 		ReceiverID: record.ReceiverID,
 		Body:       payload,
 		Channel:    topic,
 		IsSent:     false,
+		RecordTime: recordTime,
 	}
-	room.sendMessageToUser(message)
+	room.sendMessageToUser(ctx, message)
 }
 
-func (room *Room) processEventUserActionRecord(record EventUserActionRecord, payload, topic string) {
+func (room *Room) processEventUserActionRecord(ctx context.Context, record EventUserActionRecord, payload, topic string, recordTime time.Time, logger *slog.Logger) {
+	room.authorizer.forgetMember(record.ReceiverID, record.EventID)
 	message := &persistient.EventMessage{
 		ReceiverID: record.ReceiverID,
 		EventID:    record.EventID,
 		Body:       payload,
 		Channel:    topic,
 		IsSent:     false,
+		RecordTime: recordTime,
 	}
-	room.sendMessageToUser(message)
-	room.sendMessageToEventChannel(message)
+	room.sendMessageToUser(ctx, message)
+	room.sendMessageToEventChannel(ctx, message, logger)
 }
 
-func (room *Room) processMultipleUserEventActionRecord(record MultipleUserEventActionRecord, payload, topic string) {
+func (room *Room) processMultipleUserEventActionRecord(ctx context.Context, record MultipleUserEventActionRecord, payload, topic string, recordTime time.Time, logger *slog.Logger) {
 	message := &persistient.EventMessage{
-		Channel: topic,
-		Body:    payload,
-		IsSent:  false,
+		Channel:    topic,
+		Body:       payload,
+		IsSent:     false,
+		RecordTime: recordTime,
 	}
-	for receiverUserID := range record.UsersIDs {
+	for _, receiverUserID := range record.UsersIDs {
 		message.ReceiverID = receiverUserID
-		room.sendMessageToUser(message)
+		room.sendMessageToUser(ctx, message)
 	}
 	if record.EventID != 0 {
 		message.EventID = record.EventID
-		room.sendMessageToEventChannel(message)
+		room.sendMessageToEventChannel(ctx, message, logger)
 	}
 }
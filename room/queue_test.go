@@ -0,0 +1,101 @@
+package room
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"log/slog"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"testing"
+	"time"
+)
+
+// recordSpans installs a tracer provider recording the ended spans, and the propagator the service uses
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	propagator := otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		_ = provider.Shutdown(context.Background())
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagator)
+	})
+	return recorder
+}
+
+func TestProcessIncomingRecordContinuesTheProducerTrace(t *testing.T) {
+	recorder := recordSpans(t)
+	const traceID, producerSpanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+
+	room := &Room{}
+	room.ProcessIncomingRecord(&sarama.ConsumerMessage{
+		Topic:   "unrouted-topic",
+		Headers: []*sarama.RecordHeader{{Key: []byte("traceparent"), Value: []byte("00-" + traceID + "-" + producerSpanID + "-01")}},
+	})
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want the kafka.consume one", len(spans))
+	}
+	span := spans[0]
+	if span.Name() != "kafka.consume unrouted-topic" {
+		t.Errorf("span name: got %q", span.Name())
+	}
+	if parent := span.Parent(); !parent.IsRemote() || parent.TraceID().String() != traceID || parent.SpanID().String() != producerSpanID {
+		t.Errorf("parent: got %v, want span %s of trace %s", parent, producerSpanID, traceID)
+	}
+	if span.SpanContext().TraceID().String() != traceID {
+		t.Errorf("trace: got %s, want %s", span.SpanContext().TraceID(), traceID)
+	}
+}
+
+func TestProcessIncomingRecordStartsATraceWithoutHeaders(t *testing.T) {
+	recorder := recordSpans(t)
+
+	room := &Room{}
+	room.ProcessIncomingRecord(&sarama.ConsumerMessage{Topic: "unrouted-topic"})
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Parent().IsValid() {
+		t.Fatalf("got %d spans, want one root span", len(spans))
+	}
+}
+
+// deliveryLatencySamples returns the count of delivery latencies observed so far
+func deliveryLatencySamples(t *testing.T) uint64 {
+	var sample dto.Metric
+	if err := metrics.DeliveryLatency.Write(&sample); err != nil {
+		t.Fatal(err)
+	}
+	return sample.GetHistogram().GetSampleCount()
+}
+
+func TestDeliveryOfARecordObservesItsLatency(t *testing.T) {
+	room := &Room{}
+	entry := newTestConnection(9, 1)
+
+	before := deliveryLatencySamples(t)
+	message := &persistient.EventMessage{ReceiverID: 9, Channel: "user-relation-created", Body: "{}", Copy: true}
+	if err := room.sendMessageToSocketConnection(entry, message, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if samples := deliveryLatencySamples(t); samples != before {
+		t.Errorf("message of no record observed a latency")
+	}
+
+	message = &persistient.EventMessage{ReceiverID: 9, Channel: "user-relation-created", Body: "{}", Copy: true, RecordTime: time.Now().Add(-time.Second)}
+	if err := room.sendMessageToSocketConnection(entry, message, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+	if samples := deliveryLatencySamples(t); samples != before+1 {
+		t.Errorf("samples: got %d, want %d", samples, before+1)
+	}
+}
@@ -0,0 +1,190 @@
+package room
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"partyfy-message-service/db"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"sort"
+	"time"
+)
+
+// ReceiptChannel is the channel of the receipts pushed to senders when their messages are delivered or read.
+// They only reach senders connected to this replica and are never routed to the others, the receipts request
+// is the only reliable way for a client to know its receipts
+const ReceiptChannel = "receipt"
+
+// newMessageKey returns the key shared by the copies of a client message and by its receipts
+func newMessageKey() string {
+	random := make([]byte, 16)
+	_, _ = rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// expectReceipts records the receivers of a client message before it is routed to them, the sender is no receiver
+// of their own message. Messages whose receipts could not be recorded are still routed, without receipts
+func (room *Room) expectReceipts(ctx context.Context, message *persistient.EventMessage, receiverIDs []int, logger *slog.Logger) {
+	if message.MessageKey == "" {
+		return
+	}
+	receipts := make([]persistient.Receipt, 0, len(receiverIDs))
+	for _, receiverID := range receiverIDs {
+		if receiverID == message.SenderID {
+			continue
+		}
+		receipts = append(receipts, persistient.Receipt{
+			MessageKey: message.MessageKey,
+			SenderID:   message.SenderID,
+			ReceiverID: receiverID,
+			EventID:    message.EventID,
+			CreatedAt:  message.CreatedAt,
+		})
+	}
+	if len(receipts) == 0 {
+		return
+	}
+	if err := room.store.ExpectReceipts(ctx, receipts...); err != nil {
+		logger.Error("Unable to record the receivers of message, it has no receipts", "message_key", message.MessageKey, logging.Err(err))
+	}
+}
+
+// ack records that the client got the messages, their senders are told
+func (room *Room) ack(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.AckData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	delivered, err := room.recordDelivered(ctx, userID, request.MessageKeys, logger)
+	if err != nil {
+		return nil, &unavailable
+	}
+	return protocol.AckResult{Delivered: delivered}, nil
+}
+
+// recordDelivered records that the receiver got the messages and pushes the receipts to their senders. It returns
+// the number of messages that were not delivered yet
+func (room *Room) recordDelivered(ctx context.Context, receiverID int, messageKeys []string, logger *slog.Logger) (int, error) {
+	at := time.Now().UTC()
+	receipts, err := room.store.RecordDelivered(ctx, receiverID, messageKeys, at)
+	if err != nil {
+		logger.Error("Unable to record delivered messages", logging.Err(err))
+		return 0, err
+	}
+	room.pushReceipts(ctx, receiverID, protocol.ReceiptDelivered, at, receipts, logger)
+	return len(receipts), nil
+}
+
+// receipts returns the receipts of messages the client sent, per receiver
+func (room *Room) receipts(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.ReceiptsData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	found, err := room.store.FindReceipts(ctx, userID, request.MessageKeys)
+	if err != nil {
+		logger.Error("Unable to get receipts", logging.Err(err))
+		return nil, &unavailable
+	}
+
+	byKey := make(map[string]*protocol.Receipts, len(request.MessageKeys))
+	for _, receipt := range found {
+		summary := byKey[receipt.MessageKey]
+		if summary == nil {
+			summary = &protocol.Receipts{MessageKey: receipt.MessageKey, Users: []protocol.UserReceipt{}}
+			byKey[receipt.MessageKey] = summary
+		}
+		user := protocol.UserReceipt{UserID: receipt.ReceiverID}
+		summary.Receivers++
+		if deliveredAt := receipt.DeliveredAt; !deliveredAt.IsZero() {
+			summary.Delivered++
+			user.DeliveredAt = &deliveredAt
+		}
+		if readAt := receipt.ReadAt; !readAt.IsZero() {
+			summary.Read++
+			user.ReadAt = &readAt
+		}
+		summary.Users = append(summary.Users, user)
+	}
+
+	// Receipts come in the order of the request, once per message
+	result := protocol.ReceiptsResult{Receipts: []protocol.Receipts{}}
+	for _, key := range request.MessageKeys {
+		summary := byKey[key]
+		if summary == nil {
+			continue
+		}
+		delete(byKey, key)
+		sort.Slice(summary.Users, func(i, j int) bool { return summary.Users[i].UserID < summary.Users[j].UserID })
+		result.Receipts = append(result.Receipts, *summary)
+	}
+	return result, nil
+}
+
+// pushReceipts tells the senders of the messages that the receiver got or read them, with the totals of every
+// message so that event chats show how many members read it. The updates are ephemeral, they are dropped when
+// the sender is not connected to this replica
+func (room *Room) pushReceipts(ctx context.Context, receiverID int, status string, at time.Time, receipts []persistient.Receipt, logger *slog.Logger) {
+	if len(receipts) == 0 {
+		return
+	}
+	messageKeys := make([]string, 0, len(receipts))
+	for _, receipt := range receipts {
+		messageKeys = append(messageKeys, receipt.MessageKey)
+	}
+	counts, err := room.store.CountReceipts(ctx, messageKeys)
+	if err != nil {
+		logger.Warn("Unable to count receipts, senders are not told", logging.Err(err))
+		return
+	}
+	totals := make(map[string]db.ReceiptCount, len(counts))
+	for _, count := range counts {
+		totals[count.MessageKey] = count
+	}
+
+	type conversation struct {
+		senderID int
+		eventID  int64
+	}
+	updates := make(map[conversation]*protocol.ReceiptUpdate)
+	var order []conversation
+	for _, receipt := range receipts {
+		key := conversation{senderID: receipt.SenderID, eventID: receipt.EventID}
+		update := updates[key]
+		if update == nil {
+			update = &protocol.ReceiptUpdate{UserID: receiverID, EventID: receipt.EventID, Status: status, At: at}
+			updates[key] = update
+			order = append(order, key)
+		}
+		total := totals[receipt.MessageKey]
+		update.Receipts = append(update.Receipts, protocol.Receipts{
+			MessageKey: receipt.MessageKey,
+			Receivers:  total.Receivers,
+			Delivered:  total.Delivered,
+			Read:       total.Read,
+		})
+	}
+
+	for _, key := range order {
+		message := persistient.EventMessage{
+			Channel:    ReceiptChannel,
+			SenderID:   receiverID,
+			ReceiverID: key.senderID,
+			EventID:    key.eventID,
+			Body:       *updates[key],
+			Ephemeral:  true,
+			CreatedAt:  at,
+		}
+		for _, entry := range room.connections.lookup(key.senderID) {
+			metrics.MessagesRouted.WithLabelValues(ReceiptChannel).Inc()
+			if !entry.enqueue(message) {
+				metrics.OutboundDropped.Inc()
+			}
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package room
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// registryShards spreads the users over independently locked maps so that connects, disconnects and
+// message routing for different users do not contend on one lock
+const registryShards = 64
+
+// transport carries the encoded frames of a connection to the client. Closing it makes both client routines stop
+type transport interface {
+	writeFrame(message *persistient.EventMessage, payload []byte) error
+	Close() error
+}
+
+// socketTransport writes the frames on a WebSocket, in binary messages when the codec of the connection is binary
+type socketTransport struct {
+	*websocket.Conn
+	messageType int
+}
+
+func (socket socketTransport) writeFrame(message *persistient.EventMessage, payload []byte) error {
+	return socket.WriteMessage(socket.messageType, payload)
+}
+
+// connection is the live socket or event stream of a user and the bounded queue its outgoing routine reads
+type connection struct {
+	transport   transport
+	channel     MessageChannel
+	info        *ConnectionInfo //never changed once registered, the counters are kept apart
+	sent        atomic.Int64
+	received    atomic.Int64
+	version     int //protocol version of the frames, legacyVersion or protocol.Version
+	codec       protocol.Codec
+	resumeAfter time.Time      //creation time of the last message an event stream got before it reconnected
+	done        chan struct{}  //closed when either client routine stops, the outgoing one then stops reading the channel
+	routines    sync.WaitGroup //client routines of the connection, done once they stored what it left queued
+	mutex       sync.Mutex     //serializes the senders with stop, nothing is queued once stopped is set
+	stopped     bool
+	watchMutex  sync.Mutex
+	watching    map[int]bool //users whose presence changes the client asked for
+}
+
+func newConnection(transport transport, info *ConnectionInfo, queueSize int) *connection {
+	return &connection{
+		transport: transport,
+		channel:   make(MessageChannel, queueSize),
+		info:      info,
+		codec:     protocol.JSON,
+		done:      make(chan struct{}),
+	}
+}
+
+// enqueue queues the message for the outgoing routine without blocking. It returns false when the queue
+// is full or the routine stopped
+func (entry *connection) enqueue(message persistient.EventMessage) bool {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if entry.stopped {
+		return false
+	}
+	select {
+	case entry.channel <- message:
+		return true
+	default:
+		return false
+	}
+}
+
+// replaceOldest queues the message in place of the oldest queued ephemeral message when the queue is full. It
+// returns the evicted message, if any, and false when the message could not be queued: the routine stopped or
+// nothing queued may be dropped
+func (entry *connection) replaceOldest(message persistient.EventMessage) (evicted *persistient.EventMessage, queued bool) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if entry.stopped {
+		return nil, false
+	}
+	select {
+	case entry.channel <- message:
+		return nil, true
+	default:
+	}
+
+	// Senders hold the mutex, so the queue only shrinks while it is taken apart and put back in order
+	waiting := make([]persistient.EventMessage, 0, cap(entry.channel))
+	for taken := true; taken; {
+		select {
+		case oldest := <-entry.channel:
+			waiting = append(waiting, oldest)
+		default:
+			taken = false
+		}
+	}
+	for i := range waiting {
+		if evicted == nil && waiting[i].Ephemeral {
+			evicted = &waiting[i]
+			continue
+		}
+		entry.channel <- waiting[i]
+	}
+	if evicted == nil {
+		return nil, false
+	}
+	entry.channel <- message
+	return evicted, true
+}
+
+// stop tells the senders that nobody reads the queue anymore
+func (entry *connection) stop() {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	if !entry.stopped {
+		entry.stopped = true
+		close(entry.done)
+	}
+}
+
+// wait waits until the client routines of the connection returned, false when ctx is done first
+func (entry *connection) wait(ctx context.Context) bool {
+	returned := make(chan struct{})
+	go func() {
+		entry.routines.Wait()
+		close(returned)
+	}()
+	select {
+	case <-returned:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// drain empties the queue of a stopped connection and returns the messages that were never written
+func (entry *connection) drain() []persistient.EventMessage {
+	var left []persistient.EventMessage
+	for {
+		select {
+		case message := <-entry.channel:
+			left = append(left, message)
+		default:
+			return left
+		}
+	}
+}
+
+type registryShard struct {
+	mutex       sync.RWMutex
+	connections map[int][]*connection //userID -> live connections, oldest first
+}
+
+// registry holds the live connections of every connected user, a user may be connected from several devices.
+// It is safe for concurrent use
+type registry struct {
+	shards [registryShards]registryShard
+	count  int64
+}
+
+func newRegistry(capacity int) *registry {
+	created := &registry{}
+	for i := range created.shards {
+		created.shards[i].connections = make(map[int][]*connection, capacity/registryShards+1)
+	}
+	return created
+}
+
+func (connections *registry) shard(userID int) *registryShard {
+	return &connections.shards[uint(userID)%registryShards]
+}
+
+// register adds entry to the connections of the user
+func (connections *registry) register(userID int, entry *connection) {
+	shard := connections.shard(userID)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if len(shard.connections[userID]) == 0 {
+		atomic.AddInt64(&connections.count, 1)
+	}
+	shard.connections[userID] = append(shard.connections[userID], entry)
+}
+
+// unregister removes entry from the connections of the user. It returns true when it was the last one, false
+// when others are left or entry was already removed
+func (connections *registry) unregister(userID int, entry *connection) bool {
+	shard := connections.shard(userID)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	entries := shard.connections[userID]
+	for i, registered := range entries {
+		if registered != entry {
+			continue
+		}
+		if len(entries) == 1 {
+			delete(shard.connections, userID)
+			atomic.AddInt64(&connections.count, -1)
+			return true
+		}
+		left := make([]*connection, 0, len(entries)-1)
+		shard.connections[userID] = append(append(left, entries[:i]...), entries[i+1:]...)
+		return false
+	}
+	return false
+}
+
+// lookup returns the live connections of the user, oldest first, none when they are not connected. Later
+// registrations never change the returned slice, it may be read without the lock
+func (connections *registry) lookup(userID int) []*connection {
+	shard := connections.shard(userID)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return shard.connections[userID]
+}
+
+// forEach calls visit for every connection until it returns false. A shard stays read locked while
+// its connections are visited, so visit must not register or unregister
+func (connections *registry) forEach(visit func(userID int, entry *connection) bool) {
+	for i := range connections.shards {
+		shard := &connections.shards[i]
+		shard.mutex.RLock()
+		for userID, entries := range shard.connections {
+			for _, entry := range entries {
+				if !visit(userID, entry) {
+					shard.mutex.RUnlock()
+					return
+				}
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+}
+
+// size returns the number of connected users
+func (connections *registry) size() int {
+	return int(atomic.LoadInt64(&connections.count))
+}
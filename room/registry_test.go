@@ -0,0 +1,190 @@
+package room
+
+import (
+	"context"
+	"fmt"
+	"partyfy-message-service/persistient"
+	"sync"
+	"testing"
+)
+
+// nopTransport drops every frame, the registry never writes
+type nopTransport struct{}
+
+func (nopTransport) writeFrame(message *persistient.EventMessage, payload []byte) error {
+	return nil
+}
+
+func (nopTransport) Close() error {
+	return nil
+}
+
+func newTestConnection(userID int, connectionID int64) *connection {
+	return newConnection(nopTransport{}, &ConnectionInfo{UserID: userID, ConnectionID: connectionID, Transport: TransportWebSocket}, 4)
+}
+
+func TestRegistryKeepsEveryConnectionOfAUser(t *testing.T) {
+	connections := newRegistry(16)
+	first, second := newTestConnection(1, 1), newTestConnection(1, 2)
+	connections.register(1, first)
+	connections.register(1, second)
+	connections.register(2, newTestConnection(2, 3))
+
+	if entries := connections.lookup(1); len(entries) != 2 || entries[0] != first || entries[1] != second {
+		t.Fatalf("lookup: got %v, want both connections oldest first", entries)
+	}
+	if size := connections.size(); size != 2 {
+		t.Errorf("size: got %d users, want 2", size)
+	}
+
+	if connections.unregister(1, first) {
+		t.Errorf("unregister of the first connection reported the last one")
+	}
+	if connections.unregister(1, first) {
+		t.Errorf("unregister twice reported the last one")
+	}
+	if entries := connections.lookup(1); len(entries) != 1 || entries[0] != second {
+		t.Fatalf("lookup after unregister: got %v", entries)
+	}
+	if !connections.unregister(1, second) {
+		t.Errorf("unregister of the last connection not reported")
+	}
+	if entries := connections.lookup(1); len(entries) != 0 {
+		t.Errorf("lookup of a disconnected user: got %v", entries)
+	}
+	if size := connections.size(); size != 1 {
+		t.Errorf("size: got %d users, want 1", size)
+	}
+}
+
+func TestRegistryLookupIsNotChangedByLaterRegistrations(t *testing.T) {
+	connections := newRegistry(16)
+	first := newTestConnection(1, 1)
+	connections.register(1, first)
+	connections.register(1, newTestConnection(1, 2))
+	entries := connections.lookup(1)
+
+	connections.unregister(1, first)
+	connections.register(1, newTestConnection(1, 3))
+	if len(entries) != 2 || entries[0] != first {
+		t.Errorf("earlier lookup changed: %v", entries)
+	}
+}
+
+// TestRegistryConcurrentUse registers, replaces, looks up and unregisters the connections of a few users
+// from many goroutines while the admin API lists them, run it with -race
+func TestRegistryConcurrentUse(t *testing.T) {
+	const users, workers, rounds = 8, 16, 200
+	room := &Room{connections: newRegistry(users)}
+
+	var wait sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			userID := worker % users
+			for round := 0; round < rounds; round++ {
+				entry := newTestConnection(userID, int64(worker*rounds+round))
+				room.connections.register(userID, entry)
+				for _, found := range room.connections.lookup(userID) {
+					found.countSent()
+					found.countReceived()
+				}
+
+				// A reconnect registers the new connection before the old one goes away
+				replacement := newTestConnection(userID, int64(-worker*rounds-round))
+				room.connections.register(userID, replacement)
+				room.connections.unregister(userID, entry)
+				room.connections.unregister(userID, replacement)
+			}
+		}(worker)
+	}
+	for lister := 0; lister < 2; lister++ {
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for round := 0; round < rounds; round++ {
+				for _, info := range room.ConnectionInfos() {
+					if info.MessagesSent < 0 || info.MessagesReceived < 0 {
+						t.Errorf("negative counters: %+v", info)
+					}
+				}
+				_ = room.connections.size()
+			}
+		}()
+	}
+	wait.Wait()
+
+	if size := room.connections.size(); size != 0 {
+		t.Errorf("size after every connection left: got %d", size)
+	}
+	room.connections.forEach(func(userID int, entry *connection) bool {
+		t.Errorf("connection of user %d left in the registry", userID)
+		return true
+	})
+}
+
+func TestConnectionInfosSnapshotsTheCounters(t *testing.T) {
+	room := &Room{connections: newRegistry(16)}
+	entry := newTestConnection(1, 1)
+	room.connections.register(1, entry)
+	entry.countSent()
+	entry.countSent()
+	entry.countReceived()
+
+	infos := room.ConnectionInfos()
+	if len(infos) != 1 || infos[0].MessagesSent != 2 || infos[0].MessagesReceived != 1 {
+		t.Fatalf("ConnectionInfos: got %+v", infos)
+	}
+	entry.countSent()
+	if infos[0].MessagesSent != 2 {
+		t.Errorf("snapshot changed after it was taken: %+v", infos[0])
+	}
+}
+
+func TestReplaceOldestEvictsEphemeralMessagesOnly(t *testing.T) {
+	entry := newTestConnection(1, 1)
+	for _, message := range []persistient.EventMessage{
+		{Channel: "stored-1"}, {Channel: "typing-1", Ephemeral: true}, {Channel: "stored-2"}, {Channel: "typing-2", Ephemeral: true},
+	} {
+		if !entry.enqueue(message) {
+			t.Fatalf("enqueue %s: queue full too early", message.Channel)
+		}
+	}
+
+	evicted, queued := entry.replaceOldest(persistient.EventMessage{Channel: "stored-3"})
+	if !queued || evicted == nil || evicted.Channel != "typing-1" {
+		t.Fatalf("replaceOldest: evicted %v, queued %v, want typing-1 evicted", evicted, queued)
+	}
+	evicted, queued = entry.replaceOldest(persistient.EventMessage{Channel: "stored-4"})
+	if !queued || evicted == nil || evicted.Channel != "typing-2" {
+		t.Fatalf("replaceOldest: evicted %v, queued %v, want typing-2 evicted", evicted, queued)
+	}
+	evicted, queued = entry.replaceOldest(persistient.EventMessage{Channel: "stored-5"})
+	if queued || evicted != nil {
+		t.Fatalf("replaceOldest without ephemeral messages: evicted %v, queued %v", evicted, queued)
+	}
+
+	var order []string
+	for _, message := range entry.drain() {
+		order = append(order, message.Channel)
+	}
+	if want := "[stored-1 stored-2 stored-3 stored-4]"; fmt.Sprint(order) != want {
+		t.Errorf("queue after evictions: got %v, want %s", order, want)
+	}
+}
+
+func TestWaitReturnsOnceTheRoutinesReturned(t *testing.T) {
+	entry := newTestConnection(1, 1)
+	entry.routines.Add(1)
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if entry.wait(cancelled) {
+		t.Fatalf("wait returned true while a routine runs")
+	}
+	go entry.routines.Done()
+	if !entry.wait(context.Background()) {
+		t.Errorf("wait returned false once the routines returned")
+	}
+}
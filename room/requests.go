@@ -0,0 +1,249 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"partyfy-message-service/config"
+	"partyfy-message-service/db"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"partyfy-message-service/tracing"
+	"sort"
+	"time"
+)
+
+// historyPageSize is the number of messages of a history page when the client does not set a limit
+const historyPageSize = 50
+
+var unavailable = protocol.Error{Code: protocol.ErrUnavailable, Message: "Request could not be served, retry later"}
+
+// requestHandler serves a request frame of the user, it returns the data of the result frame or the error to answer
+type requestHandler func(room *Room, ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error)
+
+var requestHandlers = map[string]requestHandler{
+	protocol.TypeHistory:          (*Room).history,
+	protocol.TypeMarkRead:         (*Room).markRead,
+	protocol.TypeUnreadCounts:     (*Room).unreadCounts,
+	protocol.TypeAck:              (*Room).ack,
+	protocol.TypeReceipts:         (*Room).receipts,
+	protocol.TypePresence:         (*Room).presence,
+	protocol.TypePresenceSettings: (*Room).presenceSettings,
+}
+
+// handleRequest answers a request frame with a result frame carrying the same ID, or with an error frame
+func (room *Room) handleRequest(entry *connection, userID int, frame *protocol.Envelope, handler requestHandler, logger *slog.Logger) {
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "websocket.request", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(tracing.UserID(userID), attribute.String("partyfy.request", frame.Type)))
+	defer span.End()
+
+	result, failure := handler(room, ctx, userID, frame.Data, logger)
+	metrics.ClientRequests.WithLabelValues(frame.Type, outcome(failure)).Inc()
+	if failure != nil {
+		span.SetAttributes(attribute.String("partyfy.denied", failure.Code))
+		room.sendErrorFrame(entry, userID, frame.ID, *failure)
+		return
+	}
+	room.reply(entry, userID, frame.ID, protocol.TypeResult, result)
+}
+
+func (room *Room) history(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.HistoryData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	if failure := room.authorizeConversation(ctx, userID, request.UserID, request.EventID, logger); failure != nil {
+		return nil, failure
+	}
+	limit := request.Limit
+	if limit == 0 {
+		limit = historyPageSize
+	}
+
+	// One more message than asked tells whether there is a next page
+	result := protocol.HistoryResult{Messages: []persistient.EventMessage{}}
+	query := db.HistoryQuery{UserID: userID, PeerID: request.UserID, EventID: request.EventID, Before: request.Before, Limit: limit + 1}
+	err := room.store.FindHistory(ctx, query, func(message persistient.EventMessage, err error) error {
+		if err != nil {
+			logger.Warn("Skipping unreadable message of history", logging.MessageID, message.ID, logging.Err(err))
+			return nil
+		}
+		result.Messages = append(result.Messages, message)
+		return nil
+	})
+	if err != nil {
+		logger.Error("Unable to get history", logging.EventID, request.EventID, "peer_id", request.UserID, logging.Err(err))
+		return nil, &unavailable
+	}
+	if len(result.Messages) > limit {
+		result.Messages = result.Messages[:limit]
+		next := result.Messages[limit-1].CreatedAt
+		result.Next = &next
+	}
+	return result, nil
+}
+
+func (room *Room) markRead(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.MarkReadData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	if failure := room.authorizeConversation(ctx, userID, request.UserID, request.EventID, logger); failure != nil {
+		return nil, failure
+	}
+	// Receipts are recorded first, when marking fails the messages stay unread and the client marks them again
+	query := db.ReadQuery{UserID: userID, PeerID: request.UserID, EventID: request.EventID, Until: request.Until}
+	at := time.Now().UTC()
+	receipts, err := room.store.RecordRead(ctx, query, at)
+	if err != nil {
+		logger.Error("Unable to record read receipts", logging.EventID, request.EventID, "peer_id", request.UserID, logging.Err(err))
+		return nil, &unavailable
+	}
+	updated, err := room.store.MarkRead(ctx, query)
+	if err != nil {
+		logger.Error("Unable to mark messages read", logging.EventID, request.EventID, "peer_id", request.UserID, logging.Err(err))
+		return nil, &unavailable
+	}
+	room.pushReceipts(ctx, userID, protocol.ReceiptRead, at, receipts, logger)
+	return protocol.MarkReadResult{Updated: updated}, nil
+}
+
+func (room *Room) unreadCounts(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	counts, err := room.store.CountUnread(ctx, userID)
+	if err != nil {
+		logger.Error("Unable to count unread messages", logging.Err(err))
+		return nil, &unavailable
+	}
+	result := protocol.UnreadCountsResult{Counts: make([]protocol.UnreadCount, 0, len(counts))}
+	for _, count := range counts {
+		result.Counts = append(result.Counts, protocol.UnreadCount{UserID: count.SenderID, EventID: count.EventID, Count: count.Count})
+	}
+	sort.Slice(result.Counts, func(i, j int) bool {
+		if result.Counts[i].EventID != result.Counts[j].EventID {
+			return result.Counts[i].EventID < result.Counts[j].EventID
+		}
+		return result.Counts[i].UserID < result.Counts[j].UserID
+	})
+	return result, nil
+}
+
+// presence tells which of the users, or of the members of the event, are connected and when they were last seen.
+// Only the users the client may write to or shares an event with are answered for, the client then gets their
+// presence changes
+func (room *Room) presence(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.PresenceData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	settings := room.currentConfig().ConnectionsConfig.Authorization
+	var userIDs []int
+	if request.EventID != 0 {
+		if failure := room.authorizeConversation(ctx, userID, 0, request.EventID, logger); failure != nil {
+			return nil, failure
+		}
+		members, err := room.authorizer.membersOf(ctx, request.EventID, settings)
+		if err != nil {
+			logger.Warn("Unable to get the members of event", logging.EventID, request.EventID, logging.Err(err))
+			return nil, &unavailable
+		}
+		userIDs = members
+	} else {
+		seen := make(map[int]bool, len(request.UserIDs))
+		for _, otherID := range request.UserIDs {
+			if seen[otherID] {
+				continue
+			}
+			seen[otherID] = true
+			allowed, err := room.maySeePresence(ctx, userID, otherID, settings)
+			if err != nil {
+				logger.Warn("Unable to authorize presence request", "receiver_id", otherID, logging.Err(err))
+				return nil, &protocol.Error{Code: protocol.ErrAuthorizationUnavailable, Message: "Request could not be authorized, retry later"}
+			}
+			if allowed {
+				userIDs = append(userIDs, otherID)
+			}
+		}
+		for _, entry := range room.connections.lookup(userID) {
+			entry.watch(userIDs)
+		}
+	}
+	users, err := room.presenceOf(ctx, userID, userIDs)
+	if err != nil {
+		logger.Error("Unable to get presence", logging.Err(err))
+		return nil, &unavailable
+	}
+	return protocol.PresenceResult{Users: users}, nil
+}
+
+// presenceSettings sets whether the user hides their presence, the users who know it see them go offline
+func (room *Room) presenceSettings(ctx context.Context, userID int, data json.RawMessage, logger *slog.Logger) (interface{}, *protocol.Error) {
+	var request protocol.PresenceSettingsData
+	if failure := decodeRequest(data, &request); failure != nil {
+		return nil, failure
+	}
+	if err := room.store.SetPresenceHidden(ctx, userID, request.Hidden, time.Now().UTC()); err != nil {
+		return nil, &unavailable
+	}
+	return protocol.PresenceSettingsResult{Hidden: request.Hidden}, nil
+}
+
+// maySeePresence tells whether the user may know the presence of the other one: themselves, a user they may write to
+// or a member of one of their events
+func (room *Room) maySeePresence(ctx context.Context, userID int, otherID int, settings config.Authorization) (bool, error) {
+	if otherID == userID {
+		return true, nil
+	}
+	allowed, err := room.authorizer.canSendToUser(ctx, userID, otherID, settings)
+	if err != nil || allowed {
+		return allowed, err
+	}
+	return room.authorizer.sharesEvent(ctx, userID, otherID, settings)
+}
+
+// authorizeConversation checks that the user may read the chat of the event, or the direct conversation with peerID.
+// Users always may read their own direct conversations, even with users they may not write to any more
+func (room *Room) authorizeConversation(ctx context.Context, userID int, peerID int, eventID int64, logger *slog.Logger) *protocol.Error {
+	if eventID == 0 {
+		if peerID == 0 {
+			return &protocol.Error{Code: protocol.ErrInvalidTarget, Message: "A user or an event is required"}
+		}
+		if peerID == userID {
+			return &protocol.Error{Code: protocol.ErrInvalidTarget, Message: "Unable to read a conversation with yourself"}
+		}
+		return nil
+	}
+	settings := room.currentConfig().ConnectionsConfig.Authorization
+	member, err := room.authorizer.canSendToEvent(ctx, userID, eventID, settings)
+	if err != nil {
+		logger.Warn("Unable to authorize request", logging.EventID, eventID, logging.Err(err))
+		return &protocol.Error{Code: protocol.ErrAuthorizationUnavailable, Message: "Request could not be authorized, retry later"}
+	}
+	if !member {
+		return &protocol.Error{Code: protocol.ErrNotEventMember, Message: "You are not a member of this event"}
+	}
+	return nil
+}
+
+// outcome labels a served request in the metrics: ok or the error code
+func outcome(failure *protocol.Error) string {
+	if failure != nil {
+		return failure.Code
+	}
+	return "ok"
+}
+
+// decodeRequest reads the data of a request frame. The schema validated its shape, times may still be malformed
+func decodeRequest(data json.RawMessage, request interface{}) *protocol.Error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, request); err != nil {
+		return &protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()}
+	}
+	return nil
+}
@@ -1,7 +1,17 @@
 package room
 
 import (
+	"context"
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"log/slog"
+	"net"
+	"net/http"
 	"partyfy-message-service/config"
+	"partyfy-message-service/db"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/protocol"
+	"partyfy-message-service/rest"
 	"sync"
 )
 
@@ -10,31 +20,126 @@ const (
 )
 
 type Room struct {
-	clientCounter        int
-	serverError          error
-	thisPort             string
-	kafkaAddress         []string
-	clientBuffSize       int
-	serverBuffSize       int
-	maxClientConnections int
-	channelsCount        int
-	userChannels         map[int]*MessageChannel         //userID -> MessageChannel
-	waitGroup            *sync.WaitGroup
-	config               config.GlobalConfig
-}
-
-func NewRoomFromConfig(waitGroup *sync.WaitGroup) *Room {
-
-	var globalConfig = config.GetConfig()
-
-	return &Room{
-		thisPort:             globalConfig.ConnectionsConfig.Client.ListenPort,
-		kafkaAddress:         globalConfig.ConnectionsConfig.KafkaServer.ServerUrls,
-		clientBuffSize:       globalConfig.ConnectionsConfig.Client.MaxBuffSize,
-		userChannels:         make(map[int]*MessageChannel, globalConfig.ConnectionsConfig.Client.MaxConnectionPoolSize),
-		waitGroup:            waitGroup,
-		maxClientConnections: globalConfig.ConnectionsConfig.Client.MaxConnectionPoolSize,
-		config:               globalConfig,
+	clientCounter int64 //connections served so far, the last value is the ID of the newest connection
+	admission     *admission
+	inbound       *inboundLimiter
+	authorizer    *authorizer
+	polls         *pollCursors
+	tracker       *presenceTracker
+	upgrader      websocket.Upgrader
+	certificates  *certificateWatcher //nil when the listener serves plain HTTP
+	connections   *registry
+	waitGroup     sync.WaitGroup
+	configHolder  *config.Holder
+	store         db.Store
+	events        *rest.Client
+	server        *http.Server
+}
+
+func NewRoom(configHolder *config.Holder, store db.Store, events *rest.Client) *Room {
+
+	maxConnections := configHolder.Get().ConnectionsConfig.Client.MaxConnectionPoolSize
+
+	room := &Room{
+		connections:  newRegistry(maxConnections),
+		admission:    newAdmission(),
+		inbound:      newInboundLimiter(),
+		authorizer:   newAuthorizer(events),
+		polls:        newPollCursors(),
+		configHolder: configHolder,
+		store:        store,
+		events:       events,
+	}
+	room.tracker = newPresenceTracker(room, replicaName(configHolder.Get()))
+	room.upgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Subprotocols:    protocol.Subprotocols(),
+		CheckOrigin:     room.checkOrigin,
+	}
+	return room
+
+}
+
+// Start listens for client connections. It returns once the port is bound, connections are served in the background
+func (room *Room) Start(ctx context.Context) error {
+
+	clientConfig := room.currentConfig().ConnectionsConfig.Client
+	listenPort := clientConfig.ListenPort
+	listener, err := net.Listen("tcp", listenPort)
+	if err != nil {
+		slog.Error("Error while listening to connections", "listen_port", listenPort, logging.Err(err))
+		return err
+	}
+	if clientConfig.TLS.Enabled() {
+		room.certificates, err = newCertificateWatcher(clientConfig.TLS)
+		if err != nil {
+			_ = listener.Close()
+			return err
+		}
+		listener = tls.NewListener(listener, room.certificates.tlsConfig())
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", room.serveClientConnection)
+	mux.HandleFunc(streamPath, room.serveEventStream)
+	mux.HandleFunc(streamSendPath, room.serveStreamSend)
+	mux.HandleFunc(pollPath, room.servePoll)
+	mux.HandleFunc(presencePath, room.servePresence)
+	room.server = &http.Server{Handler: mux}
+	// Event streams and held polls are plain requests, Shutdown waits for them until they are closed
+	room.server.RegisterOnShutdown(room.closeConnections)
+
+	room.tracker.start()
+
+	slog.Info("Waiting for client connections", "listen_port", listenPort, "tls", clientConfig.TLS.Enabled(),
+		"client_auth", clientConfig.TLS.ClientAuth)
+	go func() {
+		if err := room.server.Serve(listener); err != http.ErrServerClosed {
+			slog.Error("Error while listening to connections", logging.Err(err))
+		}
+	}()
+	return nil
+}
+
+// Close stops accepting connections, closes the open sockets and event streams and waits for their routines to finish.
+// The users of the replica are then recorded offline
+func (room *Room) Close() error {
+	if room.server == nil {
+		return nil
 	}
+	err := room.server.Shutdown(context.Background())
+	room.closeConnections()
+	room.waitGroup.Wait()
+	room.tracker.close()
+	if room.certificates != nil {
+		room.certificates.close()
+	}
+	return err
+}
+
+// closeConnections closes every socket and event stream, their routines then stop
+func (room *Room) closeConnections() {
+	room.connections.forEach(func(userID int, entry *connection) bool {
+		_ = entry.transport.Close()
+		return true
+	})
+}
+
+// register adds entry to the connections of the user and tells the presence tracker
+func (room *Room) register(userID int, entry *connection) {
+	room.connections.register(userID, entry)
+	room.tracker.connected(userID)
+}
+
+// unregister removes entry, the presence tracker is told when the user has no connection left
+func (room *Room) unregister(userID int, entry *connection) {
+	if room.connections.unregister(userID, entry) {
+		room.tracker.disconnected(userID)
+	}
+}
 
+// currentConfig returns the configuration the room runs with. It changes when the configuration is reloaded
+func (room *Room) currentConfig() config.GlobalConfig {
+	return room.configHolder.Get()
 }
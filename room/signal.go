@@ -0,0 +1,144 @@
+package room
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"net/http"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"partyfy-message-service/tracing"
+	"strconv"
+	"time"
+)
+
+// SignalChannel is the channel of the ephemeral signals: typing indicators, "is viewing" and the like.
+// They go at once to the receivers connected to this replica only, they are never routed to the other replicas,
+// stored nor replayed
+const SignalChannel = "signal"
+
+// handleSignal routes a signal frame of the client. Signals over the rate are dropped without telling the
+// client, the next one replaces them anyway. The client only gets a reply when the signal is refused or
+// when the frame has an ID
+func (room *Room) handleSignal(entry *connection, userID int, frame *protocol.Envelope, logger *slog.Logger) {
+	var signal protocol.SignalData
+	if err := json.Unmarshal(frame.Data, &signal); err != nil {
+		room.sendErrorFrame(entry, userID, frame.ID, protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()})
+		return
+	}
+	limits := room.currentConfig().ConnectionsConfig.Client.Signals
+	if reason, _ := room.inbound.allowSignal(userID, limits, time.Now()); reason != "" {
+		metrics.InboundRejected.WithLabelValues(reason).Inc()
+		return
+	}
+	if denied := room.acceptSignal(userID, signal, logger); denied != nil {
+		room.sendErrorFrame(entry, userID, frame.ID, *denied)
+		return
+	}
+	if frame.ID != "" {
+		room.reply(entry, userID, frame.ID, protocol.TypeAccepted, nil)
+	}
+}
+
+// serveSignal routes a signal posted to the send endpoint of event streams and long polls
+func (room *Room) serveSignal(w http.ResponseWriter, userID int, data json.RawMessage, logger *slog.Logger) {
+	var signal protocol.SignalData
+	if err := json.Unmarshal(data, &signal); err != nil {
+		writeJSON(w, http.StatusBadRequest, protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()})
+		return
+	}
+	limits := room.currentConfig().ConnectionsConfig.Client.Signals
+	if reason, wait := room.inbound.allowSignal(userID, limits, time.Now()); reason != "" {
+		metrics.InboundRejected.WithLabelValues(reason).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(wait)))
+		writeJSON(w, http.StatusTooManyRequests, throttleError(reason, wait))
+		return
+	}
+	if denied := room.acceptSignal(userID, signal, logger); denied != nil {
+		writeJSON(w, errorStatus(denied.Code), denied)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// acceptSignal authorizes a signal of the user like a message to the same target, and queues it for the
+// receivers connected to this replica. It returns the error to answer when the signal is refused
+func (room *Room) acceptSignal(userID int, signal protocol.SignalData, logger *slog.Logger) *protocol.Error {
+
+	if (signal.ReceiverID != 0) == (signal.EventID != 0) {
+		return &protocol.Error{Code: protocol.ErrInvalidTarget, Message: "A signal goes either to an event or to a user"}
+	}
+	if signal.Kind != protocol.SignalTyping && signal.Kind != protocol.SignalViewing {
+		return &protocol.Error{Code: protocol.ErrInvalidFrame, Message: "Unknown signal kind " + strconv.Quote(signal.Kind)}
+	}
+
+	ctx, span := tracing.Tracer().Start(context.Background(), "websocket.signal",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(tracing.UserID(userID)))
+	defer span.End()
+	now := time.Now().UTC()
+	message := persistient.EventMessage{
+		Channel:    SignalChannel,
+		SenderID:   userID,
+		ReceiverID: signal.ReceiverID,
+		EventID:    signal.EventID,
+		Ephemeral:  true,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(time.Duration(room.currentConfig().ConnectionsConfig.Client.Signals.TTLSeconds) * time.Second),
+	}
+	if denied := room.authorizeSender(ctx, userID, &message, logger); denied != nil {
+		metrics.InboundRejected.WithLabelValues(denied.Code).Inc()
+		return denied
+	}
+	message.Body = protocol.Signal{Kind: signal.Kind, Active: signal.Active, ExpiresAt: message.ExpiresAt}
+
+	receivers := []int{signal.ReceiverID}
+	if signal.EventID != 0 {
+		members, err := room.authorizer.membersOf(ctx, signal.EventID, room.currentConfig().ConnectionsConfig.Authorization)
+		if err != nil {
+			logger.Warn("Unable to get the members of the event, signal dropped", logging.EventID, signal.EventID, logging.Err(err))
+			return &protocol.Error{Code: protocol.ErrAuthorizationUnavailable, Message: "Signal could not be routed, retry later"}
+		}
+		receivers = members
+	}
+	for _, receiverID := range receivers {
+		if receiverID == userID {
+			continue
+		}
+		// A signal never evicts a message nor disconnects a slow client, it is dropped when the queue is full
+		message.ReceiverID = receiverID
+		for _, entry := range room.connections.lookup(receiverID) {
+			metrics.MessagesRouted.WithLabelValues(SignalChannel).Inc()
+			if !entry.enqueue(message) {
+				metrics.OutboundDropped.Inc()
+			}
+		}
+	}
+	return nil
+}
+
+// expired tells whether an ephemeral message is too late to be written
+func expired(message *persistient.EventMessage, now time.Time) bool {
+	return !message.ExpiresAt.IsZero() && now.After(message.ExpiresAt)
+}
+
+// legacySignal turns a legacy frame of the signal channel, whose body holds the kind and whether it is active,
+// into a signal envelope
+func legacySignal(message persistient.EventMessage) (*protocol.Envelope, error) {
+	body, err := json.Marshal(message.Body)
+	if err != nil {
+		return nil, err
+	}
+	var signal protocol.Signal
+	if err := json.Unmarshal(body, &signal); err != nil {
+		return nil, errors.New("the body of a signal needs its kind and whether it is active")
+	}
+	data, err := json.Marshal(protocol.SignalData{ReceiverID: message.ReceiverID, EventID: message.EventID, Kind: signal.Kind, Active: signal.Active})
+	if err != nil {
+		return nil, err
+	}
+	return &protocol.Envelope{Version: legacyVersion, Type: protocol.TypeSignal, Data: data}, nil
+}
@@ -2,71 +2,119 @@ package room
 
 import (
 	"github.com/gorilla/websocket"
-	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
 	"strconv"
+	"sync/atomic"
 )
 
-var upgrade = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-func (room *Room) InitClientConnectionsHandler() {
-	log.Println("Waiting for client connections")
-	defer room.waitGroup.Done()
-	http.HandleFunc("/", room.serveClientConnection)
-	err := http.ListenAndServe(room.config.ConnectionsConfig.Client.ListenPort, nil)
-	if err != nil {
-		log.Print("Error while listening to connections")
-		log.Fatal(err)
-	}
-}
-
 func (room *Room) serveClientConnection(w http.ResponseWriter, r *http.Request) {
 
 	room.waitGroup.Add(1)
 	defer room.waitGroup.Done()
 
-	userConnection, err := upgrade.Upgrade(w, r, nil)
-	if err != nil {
-		log.Print("Error upgrading request : ", err)
-	}
-	defer userConnection.Close()
+	connectionID := atomic.AddInt64(&room.clientCounter, 1)
+	logger := slog.With(logging.ConnectionID, connectionID, "remote_addr", r.RemoteAddr)
 
-	//log.Println("Creating client connection : " + userConnection.RemoteAddr().String())
-	//userConnection.MaxPayloadBytes = room.clientBuffSize
-
-	if room.channelsCount >= room.maxClientConnections {
-		log.Println("Cannot create connection due the stack is full")
+	userID, logger, admitted := room.admitClient(w, r, logger)
+	if !admitted {
 		return
 	}
-	room.channelsCount++
-	addr := userConnection.RemoteAddr().String()
-	log.Print("Client connection from " + addr + " created")
+	defer room.admission.release(remoteIP(r), userID)
 
-	userID, err := getUserID(r)
+	// The upgrader is copied so that compression follows the configuration as it is reloaded
+	clientConfig := room.currentConfig().ConnectionsConfig.Client
+	upgrader := room.upgrader
+	upgrader.EnableCompression = clientConfig.Compression.Enabled
+	userConnection, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Print("Can not process user connection without userID")
+		logger.Warn("Error upgrading request", logging.Err(err))
+		metrics.ConnectionsRejected.WithLabelValues("upgrade_failed").Inc()
 		return
 	}
+	defer userConnection.Close()
+	userConnection.SetReadLimit(int64(clientConfig.MaxBuffSize))
+	if clientConfig.Compression.Enabled {
+		_ = userConnection.SetCompressionLevel(clientConfig.Compression.Level)
+	}
+	logger.Debug("Client connection created")
+
+	metrics.ConnectionsAccepted.Inc()
+	metrics.ConnectedClients.Inc()
+	defer metrics.ConnectedClients.Dec()
 
-	messageChannel := room.createMessageChannel(userID)
-	room.clientCounter++
+	version, codec := frameCodec(userConnection.Subprotocol())
+	socket := socketTransport{Conn: userConnection, messageType: websocket.TextMessage}
+	if codec.Binary() {
+		socket.messageType = websocket.BinaryMessage
+	}
+	info := newConnectionInfo(userID, connectionID, r, TransportWebSocket, userConnection.Subprotocol())
+	entry := newConnection(socket, info, clientConfig.OutboundQueueSize)
+	entry.version, entry.codec = version, codec
+	entry.routines.Add(1)
+	defer entry.routines.Done()
+	room.register(userID, entry)
+	defer room.unregister(userID, entry)
 
 	//userMessageChannel := make(MessageChannel,10)
 	outputStarted := make(chan bool)
 
-	log.Println("Client connection " + userConnection.RemoteAddr().String() + " successfully instantiated; Users online : " + strconv.Itoa(len(room.userChannels)))
-	go room.startOutgoingClientMessagesRoutine(userConnection, messageChannel, &outputStarted, userID)
+	logger.Info("Client connection successfully instantiated", "users_online", room.connections.size(), "encoding", codec.Name())
+	entry.routines.Add(1)
+	go room.startOutgoingClientMessagesRoutine(entry, &outputStarted, userID, logger)
 	<-outputStarted
-	room.startIncomingClientMessagesRoutine(userConnection, userID)
+	room.startIncomingClientMessagesRoutine(entry, userConnection, userID, logger)
+
+	logger.Info("Closing client connection", "users_online", room.connections.size())
+
+}
 
-	log.Println("Closing client connection " + userConnection.RemoteAddr().String() + " ; Users online : " + strconv.Itoa(len(room.userChannels)))
+// admitClient runs the checks every client connection goes through, whatever its transport: user ID, origin and
+// admission limits. Refused requests are answered here. The admission must be released once the client is gone
+func (room *Room) admitClient(w http.ResponseWriter, r *http.Request, logger *slog.Logger) (int, *slog.Logger, bool) {
+
+	userID, err := getUserID(r)
+	if err != nil {
+		logger.Warn("Can not process user connection without userID", logging.Err(err))
+		metrics.ConnectionsRejected.WithLabelValues("no_user_id").Inc()
+		http.Error(w, "user_id query parameter is required", http.StatusBadRequest)
+		return 0, logger, false
+	}
+	logger = logger.With(logging.UserID, userID)
 
+	if !room.checkOrigin(r) {
+		logger.Warn("Connection refused, origin is not allowed", "origin", r.Header.Get("Origin"))
+		metrics.ConnectionsRejected.WithLabelValues("origin_denied").Inc()
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return 0, logger, false
+	}
+
+	reason, wait := room.admission.admit(remoteIP(r), userID, room.currentConfig().ConnectionsConfig.Client)
+	if reason != "" {
+		logger.Warn("Connection refused", "reason", reason)
+		metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		http.Error(w, http.StatusText(rejectionStatus(reason)), rejectionStatus(reason))
+		return 0, logger, false
+	}
+	return userID, logger, true
+}
+
+// disconnectUser closes every live socket, event stream and poll of the user and returns them, none when the
+// user is not connected. The client routines stop as if the client went away
+func (room *Room) disconnectUser(userID int) []*connection {
+	entries := room.connections.lookup(userID)
+	if len(entries) == 0 {
+		return nil
+	}
+	slog.Info("Disconnecting user", logging.UserID, userID, "connections", len(entries))
+	for _, entry := range entries {
+		_ = entry.transport.Close()
+	}
+	return entries
 }
 
 func getUserID(r *http.Request) (int, error) {
@@ -74,7 +122,7 @@ func getUserID(r *http.Request) (int, error) {
 	userID, err := strconv.ParseInt(query.Get(UserID), 10, 32)
 
 	if err != nil {
-		log.Println("Cannot parse id from query string  : "+query.Encode(), " ", err)
+		slog.Debug("Cannot parse id from query string", "query", query.Encode(), logging.Err(err))
 		return 0, err
 	}
 	return int(userID), nil
@@ -0,0 +1,284 @@
+package room
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"partyfy-message-service/logging"
+	"partyfy-message-service/metrics"
+	"partyfy-message-service/persistient"
+	"partyfy-message-service/protocol"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	streamPath     = "/events/stream"
+	streamSendPath = "/events/send"
+	// streamHeartbeat is how often an event stream gets a comment, so that proxies keep it open and a gone client is noticed
+	streamHeartbeat = 15 * time.Second
+	// streamRetry is the delay in milliseconds clients wait before they reconnect a broken stream
+	streamRetry          = 3000
+	lastEventIDParameter = "last_event_id"
+)
+
+var errStreamClosed = errors.New("event stream closed")
+
+// eventStream writes frames as Server-Sent Events. Stored and routed messages carry their creation time as
+// event ID, the client sends the last one it got back in Last-Event-ID when it reconnects
+type eventStream struct {
+	writer     http.ResponseWriter
+	controller *http.ResponseController
+	mutex      sync.Mutex //serializes the writers, nothing is written once finished is set
+	finished   bool
+	done       chan struct{} //closed by Close, the handler then returns
+	closeOnce  sync.Once
+}
+
+func newEventStream(w http.ResponseWriter) *eventStream {
+	return &eventStream{writer: w, controller: http.NewResponseController(w), done: make(chan struct{})}
+}
+
+// open sends the headers and the reconnection delay. It fails when the response can not be streamed
+func (stream *eventStream) open() error {
+	header := stream.writer.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	stream.writer.WriteHeader(http.StatusOK)
+	return stream.write([]byte("retry: " + strconv.Itoa(streamRetry) + "\n\n"))
+}
+
+func (stream *eventStream) writeFrame(message *persistient.EventMessage, payload []byte) error {
+	var event bytes.Buffer
+	if !message.Ephemeral && !message.CreatedAt.IsZero() {
+		event.WriteString("id: " + message.CreatedAt.UTC().Format(time.RFC3339Nano) + "\n")
+	}
+	event.WriteString("data: ")
+	event.Write(payload)
+	event.WriteString("\n\n")
+	return stream.write(event.Bytes())
+}
+
+func (stream *eventStream) heartbeat() error {
+	return stream.write([]byte(": heartbeat\n\n"))
+}
+
+func (stream *eventStream) write(event []byte) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.finished {
+		return errStreamClosed
+	}
+	if _, err := stream.writer.Write(event); err != nil {
+		return err
+	}
+	return stream.controller.Flush()
+}
+
+// Close ends the stream. A write blocked on a slow client fails right away
+func (stream *eventStream) Close() error {
+	stream.closeOnce.Do(func() {
+		close(stream.done)
+		_ = stream.controller.SetWriteDeadline(time.Now())
+	})
+	return nil
+}
+
+// finish closes the stream and waits for the write in progress, the response must not be used once the handler returned
+func (stream *eventStream) finish() {
+	_ = stream.Close()
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.finished = true
+}
+
+// serveEventStream streams the messages of the user as Server-Sent Events, for the clients that can not hold
+// a WebSocket. The stream takes the place of a socket in the connection registry
+func (room *Room) serveEventStream(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	room.waitGroup.Add(1)
+	defer room.waitGroup.Done()
+
+	connectionID := atomic.AddInt64(&room.clientCounter, 1)
+	logger := slog.With(logging.ConnectionID, connectionID, "remote_addr", r.RemoteAddr)
+
+	userID, logger, admitted := room.admitClient(w, r, logger)
+	if !admitted {
+		return
+	}
+	defer room.admission.release(remoteIP(r), userID)
+
+	stream := newEventStream(w)
+	if err := stream.open(); err != nil {
+		logger.Warn("Unable to stream events", logging.Err(err))
+		metrics.ConnectionsRejected.WithLabelValues("stream_failed").Inc()
+		return
+	}
+	defer stream.finish()
+
+	metrics.ConnectionsAccepted.Inc()
+	metrics.ConnectedClients.Inc()
+	defer metrics.ConnectedClients.Dec()
+
+	info := newConnectionInfo(userID, connectionID, r, TransportSSE, "")
+	entry := newConnection(stream, info, room.currentConfig().ConnectionsConfig.Client.OutboundQueueSize)
+	entry.resumeAfter = lastEventID(r, logger)
+	entry.routines.Add(1)
+	defer entry.routines.Done()
+	room.register(userID, entry)
+	defer room.unregister(userID, entry)
+
+	outputStarted := make(chan bool)
+
+	logger.Info("Event stream successfully instantiated", "users_online", room.connections.size(), "resume", !entry.resumeAfter.IsZero())
+	entry.routines.Add(1)
+	go room.startOutgoingClientMessagesRoutine(entry, &outputStarted, userID, logger)
+	<-outputStarted
+	room.keepStreamAlive(r.Context(), entry, stream, userID)
+
+	logger.Info("Closing event stream", "users_online", room.connections.size())
+}
+
+// keepStreamAlive plays the part of the incoming routine of a socket: it writes heartbeats until the client goes
+// away or the stream is closed
+func (room *Room) keepStreamAlive(ctx context.Context, entry *connection, stream *eventStream, userID int) {
+
+	defer stream.Close()
+	defer entry.stop()
+	defer room.unregister(userID, entry)
+
+	ticker := time.NewTicker(streamHeartbeat)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stream.done:
+			return
+		case <-entry.done:
+			return
+		case <-ticker.C:
+			if stream.heartbeat() != nil {
+				return
+			}
+		}
+	}
+}
+
+// serveStreamSend takes the messages of the clients of event streams. The body is a message like the legacy
+// socket frames, it goes through the same limits and authorization
+func (room *Room) serveStreamSend(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	logger := slog.With("remote_addr", r.RemoteAddr)
+	userID, err := getUserID(r)
+	if err != nil {
+		http.Error(w, "user_id query parameter is required", http.StatusBadRequest)
+		return
+	}
+	logger = logger.With(logging.UserID, userID)
+	if !room.checkOrigin(r) {
+		logger.Warn("Message refused, origin is not allowed", "origin", r.Header.Get("Origin"))
+		http.Error(w, "origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	clientConfig := room.currentConfig().ConnectionsConfig.Client
+	ip := remoteIP(r)
+	if reason, wait := room.admission.admitSend(ip, clientConfig); reason != "" {
+		logger.Warn("Message refused", "reason", reason)
+		metrics.ConnectionsRejected.WithLabelValues(reason).Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(wait)))
+		http.Error(w, http.StatusText(rejectionStatus(reason)), rejectionStatus(reason))
+		return
+	}
+	defer room.admission.releaseSend(ip)
+
+	raw, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(clientConfig.MaxBuffSize)))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		metrics.InboundRejected.WithLabelValues(rejectTooLarge).Inc()
+		http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+		return
+	}
+	var send protocol.SendData
+	frame, err := decodeFrame(legacyVersion, raw)
+	if err == nil && frame.Type == protocol.TypeSignal {
+		room.serveSignal(w, userID, frame.Data, logger)
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(frame.Data, &send)
+	}
+	if err != nil {
+		metrics.InboundRejected.WithLabelValues(protocol.ErrInvalidFrame).Inc()
+		writeJSON(w, http.StatusBadRequest, protocol.Error{Code: protocol.ErrInvalidFrame, Message: err.Error()})
+		return
+	}
+
+	reason, wait, notify := room.inbound.allow(userID, send.EventID, clientConfig.Inbound, time.Now())
+	if reason != "" {
+		metrics.InboundRejected.WithLabelValues(reason).Inc()
+		if notify {
+			noteThrottled(reason, wait, logger)
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(retrySeconds(wait)))
+		writeJSON(w, http.StatusTooManyRequests, throttleError(reason, wait))
+		return
+	}
+
+	room.countPosted(userID)
+	messageKey, denied := room.acceptMessage(userID, send, logger)
+	if denied != nil {
+		writeJSON(w, errorStatus(denied.Code), denied)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, protocol.AcceptedData{MessageKey: messageKey})
+}
+
+// lastEventID returns the creation time of the last message the client got before it reconnected, zero when
+// it is a new stream. EventSource sends it in the Last-Event-ID header, polyfills may use the query string
+func lastEventID(r *http.Request, logger *slog.Logger) time.Time {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get(lastEventIDParameter)
+	}
+	if value == "" {
+		return time.Time{}
+	}
+	after, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		logger.Debug("Ignoring malformed Last-Event-ID", "last_event_id", value, logging.Err(err))
+		return time.Time{}
+	}
+	return after
+}
+
+// errorStatus returns the HTTP status answering a refused message
+func errorStatus(code string) int {
+	switch code {
+	case protocol.ErrNotEventMember, protocol.ErrDirectMessageDenied:
+		return http.StatusForbidden
+	case protocol.ErrAuthorizationUnavailable, protocol.ErrUnavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
@@ -0,0 +1,141 @@
+package room
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+	"sync"
+	"time"
+)
+
+// certificatePollInterval is how often the certificate files are checked for changes
+const certificatePollInterval = 10 * time.Second
+
+// certificateWatcher hands the current certificate and client CAs to every TLS handshake and loads
+// them again when their files change, so that renewed certificates apply without a restart
+type certificateWatcher struct {
+	settings    config.ClientTLS
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modified    time.Time //newest modification time of the files loaded
+	stop        chan struct{}
+}
+
+func newCertificateWatcher(settings config.ClientTLS) (*certificateWatcher, error) {
+	watcher := &certificateWatcher{settings: settings, stop: make(chan struct{})}
+	if err := watcher.load(); err != nil {
+		return nil, err
+	}
+	go watcher.watch()
+	return watcher, nil
+}
+
+// tlsConfig returns the configuration of the listener, each handshake reads the files loaded last
+func (watcher *certificateWatcher) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			watcher.mutex.RLock()
+			defer watcher.mutex.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*watcher.certificate},
+				ClientCAs:    watcher.clientCAs,
+				ClientAuth:   clientAuthType(watcher.settings.ClientAuth),
+			}, nil
+		},
+	}
+}
+
+func (watcher *certificateWatcher) load() error {
+	modified, err := watcher.lastModified()
+	if err != nil {
+		slog.Error("Unable to read TLS files", logging.Err(err))
+		return err
+	}
+
+	certificate, err := tls.LoadX509KeyPair(watcher.settings.CertFile, watcher.settings.KeyFile)
+	if err != nil {
+		slog.Error("Unable to load TLS certificate", "cert_file", watcher.settings.CertFile, logging.Err(err))
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if watcher.settings.ClientCAFile != "" {
+		pem, err := ioutil.ReadFile(watcher.settings.ClientCAFile)
+		if err != nil {
+			slog.Error("Unable to read client CA file", "client_ca_file", watcher.settings.ClientCAFile, logging.Err(err))
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			err = errors.New("no PEM certificate found")
+			slog.Error("Unable to load client CA file", "client_ca_file", watcher.settings.ClientCAFile, logging.Err(err))
+			return err
+		}
+	}
+
+	watcher.mutex.Lock()
+	watcher.certificate = &certificate
+	watcher.clientCAs = clientCAs
+	watcher.modified = modified
+	watcher.mutex.Unlock()
+	slog.Info("TLS certificate loaded", "cert_file", watcher.settings.CertFile)
+	return nil
+}
+
+// watch loads the files again when one of them changed. The certificate in use is kept when they are invalid
+func (watcher *certificateWatcher) watch() {
+	ticker := time.NewTicker(certificatePollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-watcher.stop:
+			return
+		case <-ticker.C:
+		}
+		modified, err := watcher.lastModified()
+		watcher.mutex.RLock()
+		changed := err == nil && modified.After(watcher.modified)
+		watcher.mutex.RUnlock()
+		if changed {
+			_ = watcher.load()
+		}
+	}
+}
+
+func (watcher *certificateWatcher) lastModified() (time.Time, error) {
+	var newest time.Time
+	for _, path := range []string{watcher.settings.CertFile, watcher.settings.KeyFile, watcher.settings.ClientCAFile} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return newest, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+func (watcher *certificateWatcher) close() {
+	close(watcher.stop)
+}
+
+func clientAuthType(clientAuth string) tls.ClientAuthType {
+	switch clientAuth {
+	case "optional":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
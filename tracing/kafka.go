@@ -0,0 +1,40 @@
+package tracing
+
+import (
+	"context"
+	"github.com/Shopify/sarama"
+	"go.opentelemetry.io/otel"
+)
+
+// kafkaHeaders reads and writes the trace context in the headers of a Kafka record
+type kafkaHeaders struct {
+	msg *sarama.ConsumerMessage
+}
+
+func (carrier kafkaHeaders) Get(key string) string {
+	for _, header := range carrier.msg.Headers {
+		if header != nil && string(header.Key) == key {
+			return string(header.Value)
+		}
+	}
+	return ""
+}
+
+func (carrier kafkaHeaders) Set(key string, value string) {
+	carrier.msg.Headers = append(carrier.msg.Headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+}
+
+func (carrier kafkaHeaders) Keys() []string {
+	keys := make([]string, 0, len(carrier.msg.Headers))
+	for _, header := range carrier.msg.Headers {
+		if header != nil {
+			keys = append(keys, string(header.Key))
+		}
+	}
+	return keys
+}
+
+// FromRecord continues the trace of the producer when the record headers carry one
+func FromRecord(ctx context.Context, msg *sarama.ConsumerMessage) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, kafkaHeaders{msg: msg})
+}
@@ -0,0 +1,151 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"os"
+	"partyfy-message-service/config"
+	"partyfy-message-service/logging"
+)
+
+const serviceName = "partyfy-message-service"
+
+// Provider installs the global tracer provider on Start and flushes the spans on Close
+type Provider struct {
+	globalConfig config.GlobalConfig
+	provider     *sdktrace.TracerProvider
+	file         io.Closer
+}
+
+func NewProvider(globalConfig config.GlobalConfig) *Provider {
+	return &Provider{globalConfig: globalConfig}
+}
+
+func (holder *Provider) Start(ctx context.Context) error {
+
+	tracingConfig := holder.globalConfig.ConnectionsConfig.Tracing
+	exporter, err := holder.newExporter(ctx, tracingConfig)
+	if err != nil {
+		slog.Error("Unable to create trace exporter", "exporter", tracingConfig.Exporter, logging.Err(err))
+		return err
+	}
+
+	options := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(tracingConfig.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL,
+			semconv.ServiceName(serviceName),
+			semconv.ServiceInstanceID(fmt.Sprintf("%.0f", holder.globalConfig.Uuid)),
+		)),
+	}
+	if exporter != nil {
+		options = append(options, sdktrace.WithBatcher(exporter))
+	}
+	holder.provider = sdktrace.NewTracerProvider(options...)
+
+	otel.SetTracerProvider(holder.provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	slog.Info("Tracing started", "exporter", tracingConfig.Exporter)
+	return nil
+}
+
+// Close exports the spans still buffered
+func (holder *Provider) Close() error {
+	if holder.provider == nil {
+		return nil
+	}
+	err := holder.provider.Shutdown(context.Background())
+	if holder.file != nil {
+		if closeErr := holder.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// newExporter returns nil for the none exporter: spans and trace IDs are still created, but not exported
+func (holder *Provider) newExporter(ctx context.Context, tracingConfig config.Tracing) (sdktrace.SpanExporter, error) {
+	switch tracingConfig.Exporter {
+	case "otlp":
+		var options []otlptracehttp.Option
+		if tracingConfig.Endpoint != "" {
+			options = append(options, otlptracehttp.WithEndpoint(tracingConfig.Endpoint))
+		}
+		if tracingConfig.Insecure {
+			options = append(options, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, options...)
+	case "stdout":
+		return stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	case "file":
+		file, err := os.OpenFile(tracingConfig.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		holder.file = file
+		return stdouttrace.New(stdouttrace.WithWriter(file))
+	}
+	return nil, nil
+}
+
+// Tracer creates the spans of the service
+func Tracer() trace.Tracer {
+	return otel.Tracer(serviceName)
+}
+
+// End records the error, if any, on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// IDs returns the hex encoded trace and span IDs of the span, empty when it has none
+func IDs(span trace.Span) (traceID string, spanID string) {
+	spanContext := span.SpanContext()
+	if !spanContext.IsValid() {
+		return "", ""
+	}
+	return spanContext.TraceID().String(), spanContext.SpanID().String()
+}
+
+// ContextWithIDs continues the trace of a span known only by its hex encoded IDs, e.g. stored with a message.
+// The sampling decision is not stored, the trace is continued as sampled. ctx is returned unchanged when the IDs are not valid
+func ContextWithIDs(ctx context.Context, traceID string, spanID string) context.Context {
+	parsedTraceID, err := trace.TraceIDFromHex(traceID)
+	if err != nil {
+		return ctx
+	}
+	parsedSpanID, err := trace.SpanIDFromHex(spanID)
+	if err != nil {
+		return ctx
+	}
+	return trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    parsedTraceID,
+		SpanID:     parsedSpanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	}))
+}
+
+// Attributes shared by the spans of the service
+func UserID(userID int) attribute.KeyValue {
+	return attribute.Int("partyfy.user_id", userID)
+}
+
+func EventID(eventID int64) attribute.KeyValue {
+	return attribute.Int64("partyfy.event_id", eventID)
+}